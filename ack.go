@@ -0,0 +1,172 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"sync"
+)
+
+// defaultMaxUnacked is used when MaxUnackedMessages is zero
+const defaultMaxUnacked = 4096
+
+// ackTracker tracks the inbound application messages which are not processed yet,
+// so only the processed ones are acknowledged
+type ackTracker struct {
+	mux sync.Mutex
+	// received is the sequence of the last message read
+	received uint64
+	// inflight are the sequences being processed, such as by the handlers
+	inflight []uint64
+	// queued are the sequences delivered to readCh, in the order of Seq
+	queued []uint64
+}
+
+func (w *WebSocket) tracksAck(msg *Message) bool {
+	return w.ackInterval > 0 && msg.Seq > 0
+}
+
+// ackSkip marks the message is processed, such as dropped
+func (w *WebSocket) ackSkip(msg *Message) {
+	if !w.tracksAck(msg) {
+		return
+	}
+	w.acks.mux.Lock()
+	defer w.acks.mux.Unlock()
+	w.acks.received = msg.Seq
+}
+
+// ackBegin marks the message is being processed, ackDone or ackQueued must be called later
+func (w *WebSocket) ackBegin(msg *Message) {
+	if !w.tracksAck(msg) {
+		return
+	}
+	w.acks.mux.Lock()
+	defer w.acks.mux.Unlock()
+	w.acks.received = msg.Seq
+	w.acks.inflight = append(w.acks.inflight, msg.Seq)
+}
+
+// ackDone marks the message is processed
+func (w *WebSocket) ackDone(msg *Message) {
+	if !w.tracksAck(msg) {
+		return
+	}
+	w.acks.mux.Lock()
+	defer w.acks.mux.Unlock()
+	w.acks.inflight = removeSeq(w.acks.inflight, msg.Seq)
+}
+
+// ackQueued marks the message is delivered to readCh, it's processed after taken from readCh
+func (w *WebSocket) ackQueued(msg *Message) {
+	if !w.tracksAck(msg) {
+		return
+	}
+	w.acks.mux.Lock()
+	defer w.acks.mux.Unlock()
+	w.acks.inflight = removeSeq(w.acks.inflight, msg.Seq)
+	w.acks.queued = append(w.acks.queued, msg.Seq)
+}
+
+func removeSeq(seqs []uint64, seq uint64) []uint64 {
+	for i, s := range seqs {
+		if s == seq {
+			return append(seqs[:i], seqs[i+1:]...)
+		}
+	}
+	return seqs
+}
+
+// processedSeq returns the highest sequence which it and all the messages before it are processed
+func (w *WebSocket) processedSeq() uint64 {
+	w.acks.mux.Lock()
+	defer w.acks.mux.Unlock()
+	// a message sent to readCh but not yet added to queued counts in len(readCh),
+	// so the taken messages are never overestimated
+	if taken := len(w.acks.queued) - len(w.readCh); taken > 0 {
+		w.acks.queued = append(w.acks.queued[:0], w.acks.queued[taken:]...)
+	}
+	seq := w.acks.received
+	if len(w.acks.inflight) > 0 && w.acks.inflight[0]-1 < seq {
+		seq = w.acks.inflight[0] - 1
+	}
+	if len(w.acks.queued) > 0 && w.acks.queued[0]-1 < seq {
+		seq = w.acks.queued[0] - 1
+	}
+	return seq
+}
+
+// AckedSeq returns the sequence of the last application message acknowledged by the opposite
+// It's always zero if acknowledgement is not enabled
+func (w *WebSocket) AckedSeq() uint64 {
+	return w.ackedSeq.Load()
+}
+
+// Unacked returns the application messages sent but not yet acknowledged by the opposite, in the order of Seq
+// They can be resent through a new connection if this one is lost
+func (w *WebSocket) Unacked() []*Message {
+	w.queueMux.Lock()
+	defer w.queueMux.Unlock()
+	msgs := make([]*Message, len(w.unacked))
+	copy(msgs, w.unacked)
+	return msgs
+}
+
+func (w *WebSocket) handleAck(msg *Message) {
+	var seq uint64
+	if err := w.ParseMessage(msg, &seq); err != nil {
+		w.logger.Warn("Failed to parse ack message", "err", err)
+		return
+	}
+	w.queueMux.Lock()
+	defer w.queueMux.Unlock()
+	// the sequence cannot exceed the messages sent
+	if last := w.sendSeq.Load(); seq > last {
+		seq = last
+	}
+	if seq <= w.ackedSeq.Load() {
+		return
+	}
+	w.ackedSeq.Store(seq)
+	n := 0
+	for n < len(w.unacked) && w.unacked[n].Seq <= seq {
+		n++
+	}
+	w.unacked = append(([]*Message)(nil), w.unacked[n:]...)
+}
+
+// ackHelper acknowledges the sequence of the processed application messages every ack interval
+func (w *WebSocket) ackHelper() {
+	timer := w.clock.NewTimer(w.ackInterval)
+	defer timer.Stop()
+	var acked uint64
+	for {
+		select {
+		case <-timer.C():
+			timer.Reset(w.ackInterval)
+			seq := w.processedSeq()
+			if seq <= acked {
+				continue
+			}
+			if err := w.writeInternal("$ack", seq); err != nil {
+				return
+			}
+			acked = seq
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
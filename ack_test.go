@@ -0,0 +1,116 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestMaxUnackedMessages(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:           &websocket.Upgrader{},
+		AckInterval:        20 * time.Millisecond,
+		MaxUnackedMessages: 4,
+	}
+	// the client does not enable the acknowledgement, so the messages are never acknowledged
+	s, c := pair(t, up, &aws.Dialer{})
+	for i := range 4 {
+		if err := s.Send("n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Send("n", 4); !errors.Is(err, aws.ErrSlowConsumer) {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	if cause := context.Cause(s.Context()); !errors.Is(cause, aws.ErrSlowConsumer) {
+		t.Fatal(cause)
+	}
+	if n := s.DroppedByReason()[aws.DropSlowConsumer]; n != 1 {
+		t.Fatal(n)
+	}
+	c.Close()
+}
+
+func TestAckAfterConsumed(t *testing.T) {
+	up := &aws.Upgrader{Upgrader: &websocket.Upgrader{}, AckInterval: 10 * time.Millisecond}
+	s, c := pair(t, up, &aws.Dialer{AckInterval: 10 * time.Millisecond})
+	for i := range 3 {
+		if err := s.Send("n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if seq := s.AckedSeq(); seq != 0 {
+		t.Fatalf("acknowledged %d before the messages are read", seq)
+	}
+	if _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if seq := s.AckedSeq(); seq != 1 {
+		t.Fatalf("acknowledged %d, expect 1", seq)
+	}
+	for range 2 {
+		if _, err := c.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if seq := s.AckedSeq(); seq != 3 || len(s.Unacked()) != 0 {
+		t.Fatal(seq, s.Unacked())
+	}
+}
+
+func TestAckAfterHandled(t *testing.T) {
+	up := &aws.Upgrader{Upgrader: &websocket.Upgrader{}, AckInterval: 10 * time.Millisecond}
+	s, c := pair(t, up, &aws.Dialer{AckInterval: 10 * time.Millisecond, DispatchWorkers: 2})
+	release := make(chan struct{})
+	handled := make(chan struct{}, 2)
+	c.On("slow", func(json.RawMessage) {
+		<-release
+		handled <- struct{}{}
+	})
+	c.On("fast", func(json.RawMessage) {
+		handled <- struct{}{}
+	})
+	s.Send("slow", 1)
+	s.Send("fast", 2)
+	<-handled
+	time.Sleep(100 * time.Millisecond)
+	// the second message is handled, but the first one is not
+	if seq := s.AckedSeq(); seq != 0 {
+		t.Fatalf("acknowledged %d before the handler returned", seq)
+	}
+	close(release)
+	<-handled
+	time.Sleep(100 * time.Millisecond)
+	if seq := s.AckedSeq(); seq != 2 {
+		t.Fatalf("acknowledged %d, expect 2", seq)
+	}
+}
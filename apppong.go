@@ -0,0 +1,93 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// AppPing describes the application level ping and pong messages, such as {"type":"ping"} and {"type":"pong"},
+// which are used by the clients that cannot send the native ping frames
+type AppPing struct {
+	// TypeFields are the names of the field holding the message type, default is ["type"]
+	TypeFields []string
+	// Ping is the type of the ping messages, default is "ping"
+	Ping string
+	// Pong is the type of the pong replies, default is "pong"
+	Pong string
+}
+
+// normalized returns a copy of the AppPing with the defaults filled, or nil if p is nil
+func (p *AppPing) normalized() *AppPing {
+	if p == nil {
+		return nil
+	}
+	n := &AppPing{
+		TypeFields: p.TypeFields,
+		Ping:       p.Ping,
+		Pong:       p.Pong,
+	}
+	if len(n.TypeFields) == 0 {
+		n.TypeFields = []string{"type"}
+	}
+	if n.Ping == "" {
+		n.Ping = "ping"
+	}
+	if n.Pong == "" {
+		n.Pong = "pong"
+	}
+	return n
+}
+
+// handleAppPing replies the frame if it's an application level ping, it reports whether the frame is handled
+// The pong is the ping object with the type replaced, so the other fields such as an id or a timestamp are echoed
+// It's called by the read goroutine
+func (w *WebSocket) handleAppPing(raw []byte) bool {
+	p := w.appPing
+	if !bytes.Contains(raw, ([]byte)(p.Ping)) {
+		return false
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return false
+	}
+	for _, field := range p.TypeFields {
+		var typ string
+		if v, ok := obj[field]; !ok || json.Unmarshal(v, &typ) != nil || typ != p.Ping {
+			continue
+		}
+		if !w.allowControl() {
+			return true
+		}
+		// it's not an application message, so the idle timeout is not reset
+		w.keepalive()
+		pong, _ := json.Marshal(p.Pong)
+		obj[field] = pong
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return true
+		}
+		if err := w.enqueue(&pendingMessage{binary: data, text: true}); err != nil {
+			w.logger.Debug("Failed to reply application ping", "err", err)
+			return true
+		}
+		w.Flush()
+		return true
+	}
+	return false
+}
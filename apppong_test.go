@@ -0,0 +1,72 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestAppPingNotIdleActivity(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:            &websocket.Upgrader{},
+		IdleTimeout:         150 * time.Millisecond,
+		AutoPongAppMessages: &aws.AppPing{},
+	}
+	url, ch := serve(t, up)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pongs := make(chan struct{}, 64)
+	go func() {
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if (string)(data) == `{"type":"pong"}` {
+				pongs <- struct{}{}
+			}
+		}
+	}()
+	s := <-ch
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(2 * time.Second)
+	for s.Context().Err() == nil {
+		select {
+		case <-ticker.C:
+			c.WriteMessage(websocket.TextMessage, ([]byte)(`{"type":"ping"}`))
+		case <-s.Context().Done():
+		case <-deadline:
+			t.Fatal("connection is not closed by the idle timeout")
+		}
+	}
+	if cause := context.Cause(s.Context()); !errors.Is(cause, aws.ErrIdleTimeout) {
+		t.Fatal("unexpected cause", cause)
+	}
+	if len(pongs) == 0 {
+		t.Fatal("pings are not replied")
+	}
+}
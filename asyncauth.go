@@ -0,0 +1,122 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"net/http"
+)
+
+// UpgradeAsync is same as Upgrade, but it returns the connection without waiting for the auth handshake
+// Use WaitAuth to wait for the result, the connection is closed if the auth failed
+// The messages sent before the auth completes are held and flushed after the ready message,
+// or rejected with ErrAuthPending if RejectBeforeAuth is true
+// The inbound application messages and binary frames are not delivered until the auth succeeded,
+// the read goroutine waits for it, so only the handshake messages should be sent by the opposite before the ready message
+// The errors before the websocket upgrade are still returned by UpgradeAsync
+//
+// The HTTP handler must not return until the connection is closed, even if it's going to wait for WaitAuth elsewhere,
+// since the connection's context is derived from the request's context, which is cancelled after the handler returned
+func (u *Upgrader) UpgradeAsync(rw http.ResponseWriter, req *http.Request, respHeader http.Header) (*WebSocket, error) {
+	return u.upgrade(rw, req, respHeader, upgradeAsync)
+}
+
+// WaitAuth waits until the auth handshake of the connection returned by UpgradeAsync is done,
+// then returns the auth data, or the error which failed the handshake
+// It returns immediately for the connections returned by Upgrade and Dial
+func (w *WebSocket) WaitAuth(ctx context.Context) (any, error) {
+	if w.authDone != nil {
+		select {
+		case <-w.authDone:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+		if w.authErr != nil {
+			return nil, w.authErr
+		}
+	}
+	return w.AuthData(), nil
+}
+
+// holdMessages makes enqueue hold the messages until finishAuth is called
+// It must be called before the read goroutine is started
+func (w *WebSocket) holdMessages() {
+	w.authDone = make(chan struct{})
+	w.queueMux.Lock()
+	w.authPending = true
+	w.queueMux.Unlock()
+}
+
+// holdMessage holds or rejects the message if the auth is pending, it reports whether the message is taken
+// It must be called with queueMux locked
+func (w *WebSocket) holdMessage(p *pendingMessage) (bool, error) {
+	// the handshake messages, the initial message, barriers and the replayed messages which are already sequenced are not held
+	if !w.authPending || p.barrier || p.initial || (p.msg != nil && (p.msg.Seq != 0 || isHandshakeMessage(p.msg.Type))) {
+		return false, nil
+	}
+	if w.rejectBeforeAuth {
+		return true, ErrAuthPending
+	}
+	w.held = append(w.held, p)
+	return true, nil
+}
+
+func isHandshakeMessage(typ string) bool {
+	switch typ {
+	case "$auth_ready", "$auth", "$ready", "$error", "$ping", "$pong":
+		return true
+	}
+	return false
+}
+
+// waitAuthDone waits until the auth handshake of UpgradeAsync is done,
+// it reports false if the auth failed or the connection is closed
+// It's called by the read goroutine before delivering an application message
+func (w *WebSocket) waitAuthDone() bool {
+	if w.authDone == nil {
+		return true
+	}
+	select {
+	case <-w.authDone:
+		return w.authErr == nil
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// finishAuth records the result of the auth handshake, and queues the held messages if it succeeded
+func (w *WebSocket) finishAuth(err error) {
+	w.authErr = err
+	w.queueMux.Lock()
+	w.authPending = false
+	held := w.held
+	w.held = nil
+	w.queueMux.Unlock()
+	close(w.authDone)
+	for _, p := range held {
+		if err == nil {
+			err = w.enqueue(p)
+			if err == nil {
+				continue
+			}
+		}
+		w.releaseSlot(p)
+		if p.take() {
+			p.finish(err)
+		}
+	}
+}
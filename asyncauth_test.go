@@ -0,0 +1,108 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestUpgradeAsyncHoldsInbound(t *testing.T) {
+	for _, token := range []string{"ok", "bad"} {
+		t.Run(token, func(t *testing.T) {
+			up := &aws.Upgrader{
+				Upgrader: &websocket.Upgrader{},
+				Authorizer: func(msg json.RawMessage) (any, error) {
+					time.Sleep(100 * time.Millisecond)
+					if string(msg) != `"ok"` {
+						return nil, errors.New("bad token")
+					}
+					return "user", nil
+				},
+			}
+			errCh := make(chan error, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				w, err := up.UpgradeAsync(rw, req, nil)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				errCh <- func() error {
+					select {
+					case msg := <-w.MessageReader():
+						if _, err := w.WaitAuth(context.Background()); err == nil {
+							return errors.New("message is delivered before the auth completes")
+						}
+						if msg != nil {
+							return errors.New("message is delivered after the auth failed")
+						}
+						return nil
+					case <-w.Context().Done():
+						if _, err := w.WaitAuth(context.Background()); err == nil {
+							return errors.New("connection is closed after the auth succeeded")
+						}
+						return nil
+					case <-time.After(50 * time.Millisecond):
+					}
+					if _, err := w.WaitAuth(context.Background()); err != nil {
+						return nil
+					}
+					msg, err := w.ReadMessage()
+					if err != nil {
+						return err
+					}
+					if msg.Type != "app" {
+						return errors.New("unexpected message " + msg.Type)
+					}
+					return nil
+				}()
+				<-w.Context().Done()
+			}))
+			defer srv.Close()
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// $auth_ready
+			if _, _, err := c.ReadMessage(); err != nil {
+				t.Fatal(err)
+			}
+			frame := `{"t":"$auth","d":"` + token + `"}` + "\n" + `{"t":"app","d":1}` + "\n"
+			if err := c.WriteMessage(websocket.TextMessage, ([]byte)(frame)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-errCh:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// AuthSource is where the Upgrader takes the auth message from
+type AuthSource int
+
+const (
+	// AuthFirstFrame takes the auth message from the first frame sent by the client after $auth_ready
+	AuthFirstFrame AuthSource = iota
+	// AuthHeader takes the value of the request header named by Upgrader.AuthParam, default is "Authorization"
+	AuthHeader
+	// AuthQueryParam takes the value of the query parameter named by Upgrader.AuthParam, default is "token"
+	AuthQueryParam
+)
+
+// validateAuth calls the validator, and converts the error to an *AuthError
+func validateAuth(validator func(json.RawMessage) error, msg json.RawMessage) error {
+	err := validator(msg)
+	if err == nil {
+		return nil
+	}
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return err
+	}
+	return &AuthError{
+		Code:   websocket.CloseInvalidFramePayloadData,
+		Reason: "invalid auth message",
+		Err:    fmt.Errorf("%w: %w", ErrInvalidAuthMessage, err),
+	}
+}
+
+// AuthSchema returns a function can be used as Upgrader.AuthValidator
+// It requires the auth message to be a JSON value which can be decoded into T without unknown fields
+// A missing auth message is rejected unless allowEmpty is true
+func AuthSchema[T any](allowEmpty bool) func(json.RawMessage) error {
+	return func(msg json.RawMessage) error {
+		if len(msg) == 0 || bytes.Equal(msg, ([]byte)("null")) {
+			if allowEmpty {
+				return nil
+			}
+			return errors.New("Auth message is empty")
+		}
+		d := json.NewDecoder(bytes.NewReader(msg))
+		d.DisallowUnknownFields()
+		var v T
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		if d.More() {
+			return errors.New("Unexpected data after the auth message")
+		}
+		return nil
+	}
+}
+
+// requestAuthMessage takes the auth token from the upgrade request, and encodes it as a JSON string
+// It returns nil if the token is not present
+func requestAuthMessage(req *http.Request, source AuthSource, param string) json.RawMessage {
+	token := requestAuthToken(req, source, param)
+	if token == "" {
+		return nil
+	}
+	msg, _ := json.Marshal(token)
+	return msg
+}
+
+// requestAuthToken takes the auth token from the upgrade request
+func requestAuthToken(req *http.Request, source AuthSource, param string) (token string) {
+	switch source {
+	case AuthHeader:
+		if param == "" {
+			param = "Authorization"
+		}
+		token = req.Header.Get(param)
+	case AuthQueryParam:
+		if param == "" {
+			param = "token"
+		}
+		token = req.URL.Query().Get(param)
+	}
+	return
+}
+
+// AuthNext invokes the rest stages of an AuthChain
+type AuthNext func(ctx context.Context, msg json.RawMessage) (any, error)
+
+// AuthMiddleware is a stage of an AuthChain
+// It can return an error to reject the auth message,
+// or call next with an enriched context and return, or replace, the auth data produced by the later stages
+type AuthMiddleware func(ctx context.Context, msg json.RawMessage, next AuthNext) (any, error)
+
+// AuthChain composes the middlewares in order
+// Calling next in the last middleware returns nil auth data and no error,
+// so the last middleware usually produces the auth data without calling next
+type AuthChain []AuthMiddleware
+
+// Authorize runs the chain with the auth message
+func (c AuthChain) Authorize(ctx context.Context, msg json.RawMessage) (any, error) {
+	return c.run(0, ctx, msg, nil)
+}
+
+// run runs the middlewares from i, and records the context passed to the last run middleware into last if it's not nil
+func (c AuthChain) run(i int, ctx context.Context, msg json.RawMessage, last *context.Context) (any, error) {
+	if i >= len(c) {
+		return nil, nil
+	}
+	if last != nil {
+		*last = ctx
+	}
+	return c[i](ctx, msg, func(ctx context.Context, msg json.RawMessage) (any, error) {
+		return c.run(i+1, ctx, msg, last)
+	})
+}
+
+// AuthorizerContext returns a function can be used as Upgrader.AuthorizerContext
+// The returned context is the one passed to the last run middleware
+func (c AuthChain) AuthorizerContext() func(context.Context, json.RawMessage) (context.Context, any, error) {
+	return func(ctx context.Context, msg json.RawMessage) (context.Context, any, error) {
+		last := ctx
+		data, err := c.run(0, ctx, msg, &last)
+		return last, data, err
+	}
+}
+
+// Authorizer returns a function can be used as Upgrader.Authorizer
+// The chain will be run with context.Background()
+func (c AuthChain) Authorizer() func(json.RawMessage) (any, error) {
+	return func(msg json.RawMessage) (any, error) {
+		return c.Authorize(context.Background(), msg)
+	}
+}
+
+// valuesContext is a context whose values can be overridden once by another context
+// It's used as the parent of the connection's context, so the values added during authorization are visible
+type valuesContext struct {
+	context.Context
+	values atomic.Pointer[context.Context]
+}
+
+func (c *valuesContext) setValues(ctx context.Context) {
+	c.values.Store(&ctx)
+}
+
+func (c *valuesContext) Value(key any) any {
+	if values := c.values.Load(); values != nil {
+		if v := (*values).Value(key); v != nil {
+			return v
+		}
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,141 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// AuthCache caches the results of the authorizer, so the repeated handshakes with the same auth message
+// can skip the expensive validation
+// The methods may be called concurrently
+type AuthCache interface {
+	// Get returns the cached auth data of the key and the expiry returned by ExpiringAuthorizer
+	// ok should be false if the key is not cached or the entry is expired
+	Get(key string) (data any, expiry time.Time, ok bool)
+	// Set caches the auth data of the key
+	// expiry is the expiry returned by ExpiringAuthorizer, or zero if it's not used,
+	// the entry should not be kept after it
+	Set(key string, data any, expiry time.Time)
+}
+
+// AuthCacheKey returns the key of the auth message used by AuthCache, which is the hex encoded SHA-256 of the message
+// For BinaryAuthorizer, the message is the raw bytes
+func AuthCacheKey(msg []byte) string {
+	sum := sha256.Sum256(msg)
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryAuthCache is an AuthCache keeps the recently used entries in memory
+type MemoryAuthCache struct {
+	size int
+	ttl  time.Duration
+
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+var _ AuthCache = (*MemoryAuthCache)(nil)
+
+type authCacheEntry struct {
+	key      string
+	data     any
+	expiry   time.Time
+	expireAt time.Time
+}
+
+// NewMemoryAuthCache creates a MemoryAuthCache keeps at most size entries, the least recently used one is evicted when it's full
+// An entry expires after ttl, or the expiry returned by ExpiringAuthorizer if it's earlier
+// The default size is 1024, and the default ttl is one minute
+func NewMemoryAuthCache(size int, ttl time.Duration) *MemoryAuthCache {
+	if size <= 0 {
+		size = 1024
+	}
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &MemoryAuthCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryAuthCache) Get(key string) (any, time.Time, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := elem.Value.(*authCacheEntry)
+	if !time.Now().Before(entry.expireAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, time.Time{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.data, entry.expiry, true
+}
+
+func (c *MemoryAuthCache) Set(key string, data any, expiry time.Time) {
+	expireAt := time.Now().Add(c.ttl)
+	if !expiry.IsZero() && expiry.Before(expireAt) {
+		expireAt = expiry
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*authCacheEntry)
+		entry.data, entry.expiry, entry.expireAt = data, expiry, expireAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authCacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&authCacheEntry{
+		key:      key,
+		data:     data,
+		expiry:   expiry,
+		expireAt: expireAt,
+	})
+}
+
+// Delete removes the entry of the key, such as when the credential is revoked
+func (c *MemoryAuthCache) Delete(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// Len returns the number of the entries, including the expired ones not evicted yet
+func (c *MemoryAuthCache) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,84 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+// newBatchBuffer allocates a batch buffer like before the buffers are pooled
+func newBatchBuffer() *batchBuffer {
+	b := new(batchBuffer)
+	b.jsonEncoder = json.NewEncoder(&b.buf)
+	b.jsonEncoder.SetEscapeHTML(false)
+	return b
+}
+
+// encodeBatch encodes the messages in the same way as writeBatch
+func encodeBatch(b *batchBuffer, batch []*pendingMessage) error {
+	e := b.encoder(JSONCodec)
+	for _, p := range batch {
+		if err := e.Encode(p.msg); err != nil {
+			return err
+		}
+		b.encoded = append(b.encoded, p)
+	}
+	return nil
+}
+
+func BenchmarkBatchBuffer(b *testing.B) {
+	data := json.RawMessage(`{"id":12345,"name":"example","tags":["a","b","c"]}`)
+	for _, count := range []int{1, 16, 256} {
+		batch := make([]*pendingMessage, count)
+		for i := range batch {
+			batch[i] = &pendingMessage{msg: &Message{Type: "event", Data: data}}
+		}
+		b.Run("unpooled/"+strconv.Itoa(count), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buf := newBatchBuffer()
+				if err := encodeBatch(buf, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("pooled/"+strconv.Itoa(count), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buf := getBatchBuffer()
+				if err := encodeBatch(buf, batch); err != nil {
+					b.Fatal(err)
+				}
+				putBatchBuffer(buf)
+			}
+		})
+	}
+}
+
+func TestBatchBufferReuse(t *testing.T) {
+	b := getBatchBuffer()
+	b.buf.WriteString("stale")
+	b.encoded = append(b.encoded, &pendingMessage{})
+	putBatchBuffer(b)
+	b = getBatchBuffer()
+	defer putBatchBuffer(b)
+	if b.buf.Len() != 0 || len(b.encoded) != 0 {
+		t.Fatalf("reused buffer is not reset: %q %d", b.buf.String(), len(b.encoded))
+	}
+}
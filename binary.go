@@ -0,0 +1,146 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrBinaryUnsupported is returned when sending binary data while the codec is using binary frames
+var ErrBinaryUnsupported = errors.New("Binary frames are used by the codec")
+
+// SendBinary calls SendBinaryContext with context.Background()
+func (w *WebSocket) SendBinary(data []byte) error {
+	return w.SendBinaryContext(context.Background(), data)
+}
+
+// SendBinaryContext queues the data as a binary frame, then wait until it's flushed
+// The data will not be encoded or batched with other messages, but the order between messages is kept
+// The data must not be modified until SendBinaryContext returns
+// It returns ErrBinaryUnsupported if the codec is using binary frames
+func (w *WebSocket) SendBinaryContext(ctx context.Context, data []byte) error {
+	if w.codec.FrameType() == websocket.BinaryMessage {
+		return ErrBinaryUnsupported
+	}
+	p := &pendingMessage{
+		binary: data,
+		done:   make(chan error, 1),
+	}
+	return w.enqueueAndWait(ctx, p)
+}
+
+// readBinaryAuthMessage waits for the auth message of BinaryAuthorizer
+// It's a binary frame, or a $auth message with []byte data if the codec is using binary frames
+func (w *WebSocket) readBinaryAuthMessage(timeout time.Duration) ([]byte, error) {
+	if w.codec.FrameType() == websocket.BinaryMessage {
+		msg, err := w.readAuthMessage(timeout)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if len(msg) > 0 {
+			if err := w.codec.Unmarshal(msg, &data); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+	timer := w.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case data := <-w.authBinaryCh:
+		return data, nil
+	case <-timer.C():
+		return nil, ErrAuthTimeout
+	case <-w.ctx.Done():
+		return nil, context.Cause(w.ctx)
+	}
+}
+
+// writeBinaryAuth queues the auth message for the remote's BinaryAuthorizer
+func (w *WebSocket) writeBinaryAuth(data []byte) error {
+	if w.codec.FrameType() == websocket.BinaryMessage {
+		return w.writeInternal("$auth", data)
+	}
+	return w.enqueue(&pendingMessage{binary: data})
+}
+
+// maxRetainedRawBuffer is the max capacity of the raw frame buffer kept for the next frame
+const maxRetainedRawBuffer = 64 * 1024
+
+// readRawFrame reads the frame into the reused buffer
+// The returned slice is only valid until the next call
+func (w *WebSocket) readRawFrame(r io.Reader) ([]byte, error) {
+	buf := w.rawBuf[:0]
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			if cap(buf) <= maxRetainedRawBuffer {
+				w.rawBuf = buf
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			return buf, err
+		}
+	}
+}
+
+// BinaryReader returns the channel of the received binary frames
+// Binary frames are not delivered if the codec is using binary frames, or OnRawFrame is set
+// At most 8 frames are buffered, the frames received when the channel is full are dropped and counted as DropQueueFull,
+// so the connection is not stalled if the application does not read them
+// The channel is only closed after the read side is closed
+func (w *WebSocket) BinaryReader() <-chan []byte {
+	return w.binaryCh
+}
+
+// ReadBinary calls ReadBinaryContext with context.Background()
+func (w *WebSocket) ReadBinary() ([]byte, error) {
+	return w.ReadBinaryContext(context.Background())
+}
+
+// ReadBinaryContext receive a binary frame from BinaryReader
+func (w *WebSocket) ReadBinaryContext(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-w.binaryCh:
+		if !ok {
+			return nil, ErrReadClosed
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case <-w.ctx.Done():
+		select {
+		case data, ok := <-w.binaryCh:
+			if ok {
+				return data, nil
+			}
+		default:
+		}
+		return nil, w.closedError()
+	}
+}
@@ -0,0 +1,78 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestUnreadBinaryFramesDropped(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	const frames = 20
+	for range frames {
+		if err := c.SendBinary([]byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the read goroutine is not stalled by the unread binary frames
+	c.Send("text", 1)
+	if msg := readWithin(s, time.Second); msg == nil || msg.Type != "text" {
+		t.Fatal("message after the binary frames is not received", msg)
+	}
+	buffered := len(s.BinaryReader())
+	if dropped := s.DroppedByReason()[aws.DropQueueFull]; dropped == 0 || (int)(dropped)+buffered != frames {
+		t.Fatalf("dropped %d and buffered %d of %d frames", dropped, buffered, frames)
+	}
+	if _, err := s.ReadBinary(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnRawFrameSkipsCodecFrames(t *testing.T) {
+	frames := make(chan string, 4)
+	up := &aws.Upgrader{
+		Upgrader: &websocket.Upgrader{},
+		OnRawFrame: func(typ int, data []byte) {
+			frames <- string(data)
+		},
+	}
+	s, c := pair(t, up, &aws.Dialer{})
+	if err := c.WriteMessage("text", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendBinary([]byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readWithin(s, time.Second); msg == nil || msg.Type != "text" {
+		t.Fatal("codec frame is not decoded", msg)
+	}
+	select {
+	case data := <-frames:
+		if data != "raw" {
+			t.Fatalf("OnRawFrame is called with %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnRawFrame is not called")
+	}
+	if len(s.BinaryReader()) != 0 {
+		t.Fatal("binary frame is delivered to BinaryReader")
+	}
+}
@@ -0,0 +1,46 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+)
+
+// requestPeerCertificates returns the client certificates of the upgrade request
+func requestPeerCertificates(req *http.Request) []*x509.Certificate {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return req.TLS.PeerCertificates
+}
+
+// PeerCertificates returns the certificates presented by the opposite over TLS, the first one is the leaf certificate
+// On the server side, they are the client certificates captured during the upgrade
+// It returns nil if the connection is not over TLS or no certificate is presented
+func (w *WebSocket) PeerCertificates() []*x509.Certificate {
+	if w.peerCerts != nil {
+		return w.peerCerts
+	}
+	if conn, ok := unwrapConn(w.ws.NetConn()).(*tls.Conn); ok {
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs
+		}
+	}
+	return nil
+}
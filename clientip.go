@@ -0,0 +1,88 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RemoteAddr returns the address of the opposite
+func (w *WebSocket) RemoteAddr() net.Addr {
+	return w.ws.RemoteAddr()
+}
+
+// ClientIP returns the IP of the client captured during the upgrade
+// X-Forwarded-For and X-Real-IP headers are only respected if the request is sent from Upgrader.TrustedProxies
+// On the client side, it's the IP of RemoteAddr
+func (w *WebSocket) ClientIP() string {
+	if w.clientIP != "" {
+		return w.clientIP
+	}
+	return addrIP(w.ws.RemoteAddr().String())
+}
+
+// addrIP returns the host part of the address
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func isTrustedProxy(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClientIP resolves the client IP of the request
+// The X-Forwarded-For header is walked from right to left, the first untrusted address is the client
+func requestClientIP(req *http.Request, trusted []netip.Prefix) string {
+	ip := addrIP(req.RemoteAddr)
+	if !isTrustedProxy(trusted, ip) {
+		return ip
+	}
+	if values := req.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !isTrustedProxy(trusted, hop) {
+				return hop
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return ip
+}
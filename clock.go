@@ -0,0 +1,80 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"time"
+)
+
+// Clock provides the time to the timers of the connections, such as the ping, pong, batch, auth and idle timers
+// It can be replaced by a fake clock to test the timing-sensitive behaviors deterministically
+// The network deadlines and the close handshake always use the real time
+//
+// The timers only depend on the durations, and the times returned by Now are only compared with each other,
+// so RealClock is not affected by the system clock changes, since time.Now carries the monotonic clock reading
+// If Now goes backward, the negative elapsed durations are ignored, so the pongs are still accepted without updating the latency,
+// the connection is not considered idle, no inbound rate limit token is taken, and the eager first send is not stopped
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by Clock, it has the same semantic as *time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the default Clock which uses the time package
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// since returns the duration since the connection is created by the clock
+func (w *WebSocket) since() time.Duration {
+	return w.clock.Now().Sub(w.createdAt)
+}
@@ -0,0 +1,227 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock is a Clock whose wall time can be changed without affecting its timers,
+// like a system clock adjustment which does not affect the monotonic clock
+type fakeClock struct {
+	mux    sync.Mutex
+	now    time.Time
+	mono   time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c    *fakeClock
+	ch   chan time.Time
+	at   time.Duration
+	live bool
+}
+
+var _ aws.Clock = (*fakeClock)(nil)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) aws.Timer {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t := &fakeTimer{c: c, ch: make(chan time.Time, 1)}
+	t.reset(d)
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves both the wall time and the timers forward
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+	c.mono += d
+	for _, t := range c.timers {
+		t.fire()
+	}
+}
+
+// Jump only changes the wall time, d can be negative
+func (c *fakeClock) Jump(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fire must be called with the clock's mux locked
+func (t *fakeTimer) fire() {
+	if t.live && t.at <= t.c.mono {
+		t.live = false
+		select {
+		case t.ch <- t.c.now:
+		default:
+		}
+	}
+}
+
+// reset must be called with the clock's mux locked
+func (t *fakeTimer) reset(d time.Duration) bool {
+	was := t.live
+	t.live = true
+	t.at = t.c.mono + d
+	t.fire()
+	return was
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mux.Lock()
+	defer t.c.mux.Unlock()
+	was := t.live
+	t.live = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mux.Lock()
+	defer t.c.mux.Unlock()
+	return t.reset(d)
+}
+
+// readWithin reads a message from c, or returns nil if nothing is received within the timeout
+func readWithin(c *aws.WebSocket, timeout time.Duration) *aws.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	msg, err := c.ReadMessageContext(ctx)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func TestClockBackwardBatch(t *testing.T) {
+	clk := newFakeClock()
+	up := &aws.Upgrader{
+		Upgrader:        &websocket.Upgrader{},
+		Clock:           clk,
+		PingInterval:    1000 * time.Hour,
+		MinBatchTimeout: time.Minute,
+		MaxBatchTimeout: time.Hour,
+	}
+	s, c := pair(t, up, &aws.Dialer{})
+	s.WriteMessage("a", 1)
+	if msg := readWithin(c, 100*time.Millisecond); msg != nil {
+		t.Fatal("flushed before MinBatchTimeout", msg)
+	}
+	clk.Jump(-24 * time.Hour)
+	clk.Advance(time.Minute)
+	if msg := readWithin(c, time.Second); msg == nil || msg.Type != "a" {
+		t.Fatal("not flushed after MinBatchTimeout", msg)
+	}
+
+	s.WriteMessage("b", 1)
+	for range 3 {
+		time.Sleep(20 * time.Millisecond)
+		clk.Jump(-time.Hour)
+		s.WriteMessage("b", 1)
+	}
+	if msg := readWithin(c, 100*time.Millisecond); msg != nil {
+		t.Fatal("flushed before MinBatchTimeout", msg)
+	}
+	clk.Advance(time.Minute)
+	for range 4 {
+		if msg := readWithin(c, time.Second); msg == nil || msg.Type != "b" {
+			t.Fatal("not flushed after MinBatchTimeout", msg)
+		}
+	}
+}
+
+func TestClockBackwardEagerFirstSend(t *testing.T) {
+	clk := newFakeClock()
+	up := &aws.Upgrader{
+		Upgrader:        &websocket.Upgrader{},
+		Clock:           clk,
+		PingInterval:    1000 * time.Hour,
+		MinBatchTimeout: time.Minute,
+		MaxBatchTimeout: time.Hour,
+		EagerFirstSend:  true,
+	}
+	s, c := pair(t, up, &aws.Dialer{})
+	clk.Advance(time.Hour)
+	s.WriteMessage("a", 1)
+	if msg := readWithin(c, time.Second); msg == nil || msg.Type != "a" {
+		t.Fatal("first message is not flushed eagerly", msg)
+	}
+	// the quiet duration is negative after the clock went backward, which must not stop the eager send
+	clk.Jump(-24 * time.Hour)
+	clk.Advance(time.Minute)
+	s.WriteMessage("b", 1)
+	if msg := readWithin(c, time.Second); msg == nil || msg.Type != "b" {
+		t.Fatal("message is not flushed eagerly after the clock went backward", msg)
+	}
+}
+
+func TestClockBackwardRateLimit(t *testing.T) {
+	clk := newFakeClock()
+	up := &aws.Upgrader{
+		Upgrader:         &websocket.Upgrader{},
+		Clock:            clk,
+		PingInterval:     1000 * time.Hour,
+		InboundRateLimit: 1,
+		InboundBurst:     1,
+	}
+	s, c := pair(t, up, &aws.Dialer{})
+	c.Send("a", 1)
+	if msg := readWithin(s, time.Second); msg == nil || msg.Type != "a" {
+		t.Fatal(msg)
+	}
+	// going backward must neither refill nor take away the tokens
+	clk.Jump(-time.Hour)
+	c.Send("b", 1)
+	if msg := readWithin(s, 100*time.Millisecond); msg != nil {
+		t.Fatal("rate limit is not applied after the clock went backward", msg)
+	}
+	if n := s.DroppedByReason()[aws.DropRateLimited]; n != 1 {
+		t.Fatal("dropped", n)
+	}
+	clk.Advance(time.Second)
+	c.Send("c", 1)
+	if msg := readWithin(s, time.Second); msg == nil || msg.Type != "c" {
+		t.Fatal("token is not refilled after the clock went backward", msg)
+	}
+}
@@ -0,0 +1,145 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// Encoder writes the encoded values to the underlying writer one by one
+type Encoder interface {
+	Encode(v any) error
+}
+
+// Decoder reads the values encoded by the paired Encoder one by one
+type Decoder interface {
+	Decode(v any) error
+}
+
+// Codec is used to encode and decode the messages
+// Multiple messages may be encoded into one frame by the same Encoder,
+// so the Decoder must be able to read them back one by one
+// When a codec other than JSONCodec is used, Message.Data holds the data encoded by the codec
+type Codec interface {
+	// FrameType returns the websocket frame type, either websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, ptr any) error
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+type jsonCodec struct{}
+
+// JSONCodec encodes messages as newline separated JSON objects
+// It is the default codec
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, ptr any) error {
+	return json.Unmarshal(data, ptr)
+}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder {
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	return e
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return json.NewDecoder(r)
+}
+
+// BatchFraming decides how the messages of a batch are framed
+type BatchFraming int
+
+const (
+	// FramingNDJSON encodes the messages of a batch one after another in one frame,
+	// which is newline delimited JSON if JSONCodec is used
+	FramingNDJSON BatchFraming = iota
+	// FramingJSONArray encodes the messages of a batch as a JSON array in one frame
+	// It can only be used with JSON codecs
+	FramingJSONArray
+	// FramingOneFramePerMessage writes each message of a batch in its own frame
+	// The batch timeouts still decide when the messages are flushed
+	FramingOneFramePerMessage
+)
+
+// arrayDecoder decodes the messages from a frame encoded as an array
+type arrayDecoder struct {
+	codec Codec
+	r     io.Reader
+	read  bool
+	msgs  []*Message
+}
+
+func (d *arrayDecoder) Decode(v any) error {
+	if !d.read {
+		d.read = true
+		data, err := io.ReadAll(d.r)
+		if err != nil {
+			return err
+		}
+		if err := d.codec.Unmarshal(data, &d.msgs); err != nil {
+			return err
+		}
+	}
+	if len(d.msgs) == 0 {
+		return io.EOF
+	}
+	*v.(*Message) = *d.msgs[0]
+	d.msgs = d.msgs[1:]
+	return nil
+}
+
+// newFrameDecoder returns the Decoder reads the messages from a frame
+func (w *WebSocket) newFrameDecoder(r io.Reader) Decoder {
+	if w.batchFraming == FramingJSONArray {
+		return &arrayDecoder{codec: w.codec, r: r}
+	}
+	return w.codec.NewDecoder(r)
+}
+
+// codecSubprotocols returns the sorted subprotocol names of the codecs
+func codecSubprotocols(codecs map[string]Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectCodec returns the codec registered for the subprotocol,
+// or fallback if there is no one matches
+func selectCodec(codecs map[string]Codec, subprotocol string, fallback Codec) Codec {
+	if c, ok := codecs[subprotocol]; ok && subprotocol != "" {
+		return c
+	}
+	return fallback
+}
@@ -0,0 +1,104 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// hasPerMessageDeflate reports whether the Sec-WebSocket-Extensions header contains permessage-deflate
+func hasPerMessageDeflate(header http.Header) bool {
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// initCompression applies the compression level after the connection is established
+func (w *WebSocket) initCompression(level int) error {
+	if !w.compression || level == 0 {
+		return nil
+	}
+	return w.ws.SetCompressionLevel(level)
+}
+
+// CompressionEnabled reports whether permessage-deflate is negotiated with the opposite
+func (w *WebSocket) CompressionEnabled() bool {
+	return w.compression
+}
+
+// SendCompressed is same as Send, but compress overrides whether the message is compressed,
+// regardless of CompressionThreshold, such as disabling it for the data already compressed
+// The message is written in its own frame, since the compression is applied to the whole frame
+// It has no effect if the compression is not negotiated
+func (w *WebSocket) SendCompressed(typ string, data any, compress bool) error {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	return w.enqueueAndWait(context.Background(), &pendingMessage{
+		msg:      msg,
+		compress: compressMode(compress),
+		done:     make(chan error, 1),
+	})
+}
+
+// SendBinaryCompressed is same as SendBinary, but compress overrides whether the frame is compressed
+func (w *WebSocket) SendBinaryCompressed(data []byte, compress bool) error {
+	if w.codec.FrameType() == websocket.BinaryMessage {
+		return ErrBinaryUnsupported
+	}
+	return w.enqueueAndWait(context.Background(), &pendingMessage{
+		binary:   data,
+		compress: compressMode(compress),
+		done:     make(chan error, 1),
+	})
+}
+
+// compressMode returns the pendingMessage.compress value of an override
+func compressMode(compress bool) int8 {
+	if compress {
+		return 1
+	}
+	return -1
+}
+
+// setWriteCompression enables the compression for the next frame if its size reaches the threshold,
+// or as the frame's override says
+func (w *WebSocket) setWriteCompression(size int, compress int8) {
+	if !w.compression {
+		return
+	}
+	switch {
+	case compress != 0:
+		w.ws.EnableWriteCompression(compress > 0)
+	case w.compressionThreshold > 0:
+		w.ws.EnableWriteCompression(size >= w.compressionThreshold)
+	default:
+		// restore it after an override
+		w.ws.EnableWriteCompression(true)
+	}
+}
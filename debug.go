@@ -0,0 +1,86 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// defaultDebugPayloadLimit is the default max bytes of a payload logged in debug mode
+const defaultDebugPayloadLimit = 256
+
+// debugRedacted replaces the payloads of the sensitive internal messages if DebugRedact is nil
+const debugRedacted = "<redacted>"
+
+// SetDebug enables or disables logging every message and binary frame sent or received by this connection,
+// with the type, size and the truncated payload
+// The logs are written to the configured Logger at info level, so they are visible without changing the level of others
+// See DebugPayloadLimit and DebugRedact to limit the logged payloads,
+// the payloads of $auth, $resume and $ready are redacted unless DebugRedact is set
+func (w *WebSocket) SetDebug(enabled bool) {
+	w.debug.Store(enabled)
+}
+
+// Debug reports whether debug logging is enabled
+func (w *WebSocket) Debug() bool {
+	return w.debug.Load()
+}
+
+func (w *WebSocket) debugMessage(dir string, msg *Message) {
+	w.logger.Info("Debug message "+dir, "type", msg.Type, "seq", msg.Seq, "size", len(msg.Data), "data", w.debugPayload(msg.Type, msg.Data))
+}
+
+func (w *WebSocket) debugBinary(dir string, data []byte) {
+	w.logger.Info("Debug binary frame "+dir, "size", len(data), "data", w.debugPayload("", data))
+}
+
+// debugPayload redacts and truncates the payload for logging
+// typ is empty for binary frames
+func (w *WebSocket) debugPayload(typ string, data []byte) string {
+	if w.debugRedact != nil {
+		data = w.debugRedact(typ, data)
+	} else if isSensitiveMessage(typ) {
+		return debugRedacted
+	}
+	limit := w.debugLimit
+	if limit == 0 {
+		limit = defaultDebugPayloadLimit
+	}
+	if limit < 0 {
+		return ""
+	}
+	if len(data) <= limit {
+		if typ == "" && !utf8.Valid(data) {
+			return fmt.Sprintf("%x", data)
+		}
+		return (string)(data)
+	}
+	if typ == "" && !utf8.Valid(data[:limit]) {
+		return fmt.Sprintf("%x...", data[:limit])
+	}
+	return (string)(data[:limit]) + "..."
+}
+
+// isSensitiveMessage reports whether the internal message carries the credentials or the session token
+func isSensitiveMessage(typ string) bool {
+	switch typ {
+	case "$auth", "$resume", "$ready":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"testing"
+)
+
+func TestDebugPayloadRedactsSensitive(t *testing.T) {
+	secret := ([]byte)(`{"token":"secret"}`)
+	w := &WebSocket{}
+	for _, typ := range []string{"$auth", "$resume", "$ready"} {
+		if got := w.debugPayload(typ, secret); got != debugRedacted {
+			t.Errorf("payload of %s is not redacted: %s", typ, got)
+		}
+	}
+	if got := w.debugPayload("token", secret); got != (string)(secret) {
+		t.Error("payload of an application message is redacted:", got)
+	}
+	w.debugRedact = func(typ string, data []byte) []byte {
+		if typ == "$auth" {
+			return ([]byte)("custom")
+		}
+		return data
+	}
+	if got := w.debugPayload("$auth", secret); got != "custom" {
+		t.Error("DebugRedact is not used for $auth:", got)
+	}
+}
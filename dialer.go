@@ -0,0 +1,349 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrAuthRequired = errors.New("Remote requires authorization but AuthProvider is nil")
+
+type Dialer struct {
+	// Dialer should never be nil
+	Dialer *websocket.Dialer
+
+	// The following options have the same meaning as the ones in Upgrader
+	MinBatchTimeout             time.Duration
+	MaxBatchTimeout             time.Duration
+	MaxBatchCount               int
+	MaxBatchBytes               int
+	EagerFirstSend              bool
+	BatchFraming                BatchFraming
+	FlushFailurePolicy          FlushFailurePolicy
+	RawJSONRPC                  bool
+	Codec                       Codec
+	Codecs                      map[string]Codec
+	MaxMessageSize              int64
+	OnLargeMessage              func(size int)
+	LargeMessageThreshold       int
+	OnRawFrame                  func(messageType int, data []byte)
+	OnDecodeError               func(raw []byte, err error) (drop bool)
+	OnSend                      func(typ string, data any) (any, error)
+	OnReceive                   func(msg *Message) error
+	OnSendSpan                  func(ctx context.Context, typ string) (traceparent string, end func(err error))
+	OnReceiveSpan               func(msg *Message) (end func())
+	DispatchWorkers             int
+	DispatchQueueSize           int
+	MaxPendingMessages          int
+	MaxPendingBytes             int
+	OnQueueHighWater            func(count int, bytes int)
+	QueueHighWaterMessages      int
+	QueueHighWaterBytes         int
+	SendQueueSize               int
+	EnableCompression           bool
+	CompressionLevel            int
+	CompressionThreshold        int
+	InboundRateLimit            float64
+	InboundBurst                int
+	RateLimitAction             RateLimitAction
+	MaxControlFramesPerSec      float64
+	OutboundRateLimit           float64
+	OutboundBurst               int
+	MaxConsecutiveControlFrames int
+	MaxStreams                  int
+	Metrics                     Metrics
+	Logger                      *slog.Logger
+	DebugPayloadLimit           int
+	DebugRedact                 func(typ string, data []byte) []byte
+	IdleTimeout                 time.Duration
+	WriteTimeout                time.Duration
+	ReadTimeout                 time.Duration
+	CloseFlushTimeout           time.Duration
+	CloseHandshakeTimeout       time.Duration
+	OnPanic                     func(recovered any, stack []byte)
+	OnPong                      func(rtt time.Duration)
+	OnPingTimeout               func()
+	OnPeerClose                 func(code int, text string)
+	NoCloseEcho                 bool
+	PingMessage                 []byte
+	ValidatePong                bool
+	KeepaliveMatcher            func(json.RawMessage) bool
+	AutoPongAppMessages         *AppPing
+	AckInterval                 time.Duration
+	MaxUnackedMessages          int
+	Clock                       Clock
+	TCPNoDelay                  bool
+	TCPKeepAlive                time.Duration
+
+	AuthProvider func(context.Context) (json.RawMessage, error)
+	AuthTimeout  time.Duration
+	// BinaryAuthProvider provides the raw auth message if the remote is using Upgrader.BinaryAuthorizer
+	// It's sent as a binary frame, or a []byte encoded by the codec if the codec is using binary frames
+	// Re-authorization still uses AuthProvider
+	BinaryAuthProvider func(context.Context) ([]byte, error)
+}
+
+// Dial calls DialContext with context.Background()
+func (d *Dialer) Dial(url string, header http.Header) (*WebSocket, *http.Response, error) {
+	return d.DialContext(context.Background(), url, header)
+}
+
+// DialContext will dial a websocket connection to the url and do the authorization handshake
+// The ping interval and pong timeout are provided by the remote
+// ctx only controls the dial and handshake process, it will not affect the returned connection
+func (d *Dialer) DialContext(ctx context.Context, url string, header http.Header) (*WebSocket, *http.Response, error) {
+	return d.dial(ctx, url, header, nil)
+}
+
+// Resume calls ResumeContext with context.Background()
+func (d *Dialer) Resume(url string, header http.Header, state SessionState) (*WebSocket, *http.Response, error) {
+	return d.ResumeContext(context.Background(), url, header, state)
+}
+
+// ResumeContext is same as DialContext, but it will try to resume the session of a previous connection
+// state is usually got by calling Session on the previous connection after it's closed
+// The messages that are not received by the previous connection will be replayed if the remote still has them,
+// otherwise a new session is started, use Resumed to check the result
+func (d *Dialer) ResumeContext(ctx context.Context, url string, header http.Header, state SessionState) (*WebSocket, *http.Response, error) {
+	return d.dial(ctx, url, header, &state)
+}
+
+func (d *Dialer) dial(ctx context.Context, url string, header http.Header, resume *SessionState) (*WebSocket, *http.Response, error) {
+	counter := new(byteCounter)
+	dialer := new(websocket.Dialer)
+	*dialer = *d.Dialer
+	if d.EnableCompression {
+		dialer.EnableCompression = true
+	}
+	if len(dialer.Subprotocols) == 0 && len(d.Codecs) > 0 {
+		dialer.Subprotocols = codecSubprotocols(d.Codecs)
+	}
+	if dialer.NetDialContext == nil && dialer.NetDial != nil {
+		netDial := dialer.NetDial
+		dialer.NetDialContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return netDial(network, addr)
+		}
+	}
+	dialer.NetDialContext = countDial(dialer.NetDialContext, counter)
+	if dialer.NetDialTLSContext != nil {
+		dialer.NetDialTLSContext = countDial(dialer.NetDialTLSContext, counter)
+	}
+	ws, resp, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	w := &WebSocket{
+		ws:              ws,
+		counter:         counter,
+		codec:           selectCodec(d.Codecs, ws.Subprotocol(), d.Codec),
+		metrics:         d.Metrics,
+		logger:          d.Logger,
+		idleTimeout:     d.IdleTimeout,
+		writeTimeout:    d.WriteTimeout,
+		readTimeout:     d.ReadTimeout,
+		onPanic:         d.OnPanic,
+		onPong:          d.OnPong,
+		onPingTimeout:   d.OnPingTimeout,
+		onPeerClose:     d.OnPeerClose,
+		noCloseEcho:     d.NoCloseEcho,
+		batchFraming:    d.BatchFraming,
+		rawJSONRPC:      d.RawJSONRPC,
+		flushPolicy:     d.FlushFailurePolicy,
+		onRawFrame:      d.OnRawFrame,
+		onDecodeError:   d.OnDecodeError,
+		onSend:          d.OnSend,
+		onReceive:       d.OnReceive,
+		onSendSpan:      d.OnSendSpan,
+		onReceiveSpan:   d.OnReceiveSpan,
+		dispatchWorkers: d.DispatchWorkers,
+		dispatchQueue:   d.DispatchQueueSize,
+		debugLimit:      d.DebugPayloadLimit,
+		debugRedact:     d.DebugRedact,
+		pingMessage:     d.PingMessage,
+		validatePong:    d.ValidatePong,
+		maxBatchCount:   d.MaxBatchCount,
+		maxBatchBytes:   d.MaxBatchBytes,
+		maxMessageSize:  d.MaxMessageSize,
+		onLargeMessage:  d.OnLargeMessage,
+		largeThreshold:  d.LargeMessageThreshold,
+		maxPendingMsgs:  d.MaxPendingMessages,
+		maxPendingBytes: d.MaxPendingBytes,
+		sendQueueSize:   d.SendQueueSize,
+
+		onQueueHighWater: d.OnQueueHighWater,
+		highWaterMsgs:    d.QueueHighWaterMessages,
+		highWaterBytes:   d.QueueHighWaterBytes,
+
+		compression:          dialer.EnableCompression && hasPerMessageDeflate(resp.Header),
+		compressionThreshold: d.CompressionThreshold,
+
+		inboundRateLimit: d.InboundRateLimit,
+		inboundBurst:     d.InboundBurst,
+		rateLimitAction:  d.RateLimitAction,
+
+		controlRateLimit:  d.MaxControlFramesPerSec,
+		outboundRateLimit: d.OutboundRateLimit,
+		outboundBurst:     d.OutboundBurst,
+		maxControlFrames:  d.MaxConsecutiveControlFrames,
+		maxStreams:        d.MaxStreams,
+
+		closeFlushTimeout: d.CloseFlushTimeout,
+		closeTimeout:      d.CloseHandshakeTimeout,
+		keepaliveMatcher:  d.KeepaliveMatcher,
+		appPing:           d.AutoPongAppMessages.normalized(),
+		ackInterval:       d.AckInterval,
+		maxUnacked:        d.MaxUnackedMessages,
+		eagerFirstSend:    d.EagerFirstSend,
+		clock:             d.Clock,
+	}
+	w.minBatchTimeout.Store((int64)(d.MinBatchTimeout))
+	w.maxBatchTimeout.Store((int64)(d.MaxBatchTimeout))
+	w.ctx, w.cancel = context.WithCancelCause(context.Background())
+	context.AfterFunc(w.ctx, func() {
+		ws.Close()
+	})
+	if err := w.initCompression(d.CompressionLevel); err != nil {
+		w.Abort()
+		return nil, resp, err
+	}
+	w.init()
+	w.applyTCPOptions(d.TCPNoDelay, d.TCPKeepAlive)
+	if d.RawJSONRPC {
+		// a plain JSON-RPC server does not send the ready message
+		go w.pingHelper()
+		w.ready()
+		return w, resp, nil
+	}
+	authTimeout := d.AuthTimeout
+	if authTimeout <= 0 {
+		authTimeout = time.Second * 10
+	}
+	msg, err := w.readReadyMessage(ctx, authTimeout)
+	if err != nil {
+		w.Abort()
+		return nil, resp, err
+	}
+	if msg.Type == "$auth_ready" {
+		w.setState(WSAuthenticating)
+		var authReady authReadyMessage
+		// the remote may not send any options
+		w.ParseMessage(msg, &authReady)
+		hasProvider := d.AuthProvider != nil
+		if authReady.Binary {
+			hasProvider = d.BinaryAuthProvider != nil
+		}
+		if !hasProvider && !authReady.Optional {
+			w.Abort()
+			return nil, resp, ErrAuthRequired
+		}
+		if resume != nil && authReady.Session {
+			if err := w.writeInternal("$resume", &resumeMessage{
+				Token: resume.Token,
+				Seq:   resume.Seq,
+			}); err != nil {
+				w.Abort()
+				return nil, resp, err
+			}
+		}
+		if authReady.Binary {
+			var authData []byte
+			if d.BinaryAuthProvider != nil {
+				if authData, err = d.BinaryAuthProvider(ctx); err != nil {
+					w.metrics.OnAuthFailure(err)
+					w.Abort()
+					return nil, resp, err
+				}
+			}
+			err = w.writeBinaryAuth(authData)
+		} else {
+			var authMsg json.RawMessage
+			if d.AuthProvider != nil {
+				if authMsg, err = d.AuthProvider(ctx); err != nil {
+					w.metrics.OnAuthFailure(err)
+					w.Abort()
+					return nil, resp, err
+				}
+			}
+			err = w.writeInternal("$auth", authMsg)
+		}
+		if err != nil {
+			w.Abort()
+			return nil, resp, err
+		}
+		w.Flush()
+		if msg, err = w.readReadyMessage(ctx, authTimeout); err != nil {
+			w.metrics.OnAuthFailure(err)
+			w.Abort()
+			return nil, resp, err
+		}
+	}
+	var ready ReadyMessage
+	if err := w.ParseMessage(msg, &ready); err != nil {
+		w.Abort()
+		return nil, resp, err
+	}
+	if ready.PingInterval > 0 {
+		w.pingInterval.Store((int64)((time.Duration)(ready.PingInterval) * time.Millisecond))
+	}
+	if ready.PongTimeout > 0 {
+		w.pongTimeout.Store((int64)((time.Duration)(ready.PongTimeout) * time.Millisecond))
+	}
+	w.sessionToken = ready.Session
+	if ready.Resumed && resume != nil {
+		w.resumed = true
+		if w.recvSeq.Load() < resume.Seq {
+			w.recvSeq.Store(resume.Seq)
+		}
+	}
+	go w.pingHelper()
+	w.ready()
+	if d.AuthProvider != nil {
+		go w.reauthResponder(d.AuthProvider)
+	}
+	return w, resp, nil
+}
+
+// reauthResponder answers the re-authorize requests from the opposite
+func (w *WebSocket) reauthResponder(authProvider func(context.Context) (json.RawMessage, error)) {
+	for {
+		select {
+		case msg := <-w.readyCh:
+			if msg.Type != "$auth_ready" {
+				continue
+			}
+			authMsg, err := authProvider(w.ctx)
+			if err != nil {
+				w.cancel(err)
+				return
+			}
+			if err := w.writeInternal("$auth", authMsg); err != nil {
+				return
+			}
+			w.Flush()
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrDraining is returned when sending an application message after Drain is called
+var ErrDraining = errors.New("Connection is draining")
+
+// Drain gracefully closes the connection, such as when migrating the opposite to another node
+// It rejects the new application messages with ErrDraining, waits until the queued messages are written,
+// then closes the connection with code 1001 (going away) and waits for the close handshake
+// If ctx is done before that, the connection is aborted and the cause of ctx is returned
+// The connection's cause will be ErrClosed
+func (w *WebSocket) Drain(ctx context.Context) error {
+	if w.ctx.Err() != nil {
+		return w.closedError()
+	}
+	w.draining.Store(true)
+	w.setState(WSDraining)
+	p := &pendingMessage{
+		barrier: true,
+		done:    make(chan error, 1),
+	}
+	if err := w.enqueue(p); err != nil {
+		return err
+	}
+	w.Flush()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		w.Abort()
+		return context.Cause(ctx)
+	case <-w.ctx.Done():
+		return w.closedError()
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- w.closeWithCause(websocket.CloseGoingAway, "draining", ErrClosed)
+	}()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		w.Abort()
+		return context.Cause(ctx)
+	}
+}
+
+// IsDraining reports whether Drain is called and the connection is not closed yet
+func (w *WebSocket) IsDraining() bool {
+	return w.draining.Load() && w.ctx.Err() == nil
+}
@@ -0,0 +1,102 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+// The reasons of the dropped messages, which are the keys of DroppedByReason
+const (
+	// DropExpired is for the messages of SendWithTTL which are not flushed within the TTL
+	DropExpired = "expired"
+	// DropReplaced is for the messages of SendKeyed which are replaced by a newer one before flushed
+	DropReplaced = "replaced"
+	// DropQueueFull is for the messages not queued because the bounded queue is full, such as by TrySend or Hub.Broadcast,
+	// and the inbound binary frames not delivered because BinaryReader is full
+	DropQueueFull = "queue_full"
+	// DropSlowConsumer is for the messages not queued because MaxPendingMessages or MaxPendingBytes is exceeded
+	DropSlowConsumer = "slow_consumer"
+	// DropClosed is for the queued messages which are not waited by any sender, and are discarded when the connection is closed
+	DropClosed = "closed"
+	// DropRateLimited is for the inbound messages exceeded InboundRateLimit
+	DropRateLimited = "rate_limited"
+	// DropDecodeError is for the inbound frames which cannot be decoded and are dropped by OnDecodeError
+	DropDecodeError = "decode_error"
+	// DropRejected is for the inbound messages rejected by OnReceive
+	DropRejected = "rejected"
+)
+
+// DropMetrics can be implemented by Metrics to receive the dropped messages
+type DropMetrics interface {
+	// OnMessageDropped is called when n messages are dropped for the reason, which is one of the Drop constants
+	OnMessageDropped(reason string, n int)
+}
+
+type dropReason int
+
+const (
+	dropExpired dropReason = iota
+	dropReplaced
+	dropQueueFull
+	dropSlowConsumer
+	dropClosed
+	dropRateLimited
+	dropDecodeError
+	dropRejected
+	dropReasonCount
+)
+
+var dropReasonNames = [dropReasonCount]string{
+	dropExpired:      DropExpired,
+	dropReplaced:     DropReplaced,
+	dropQueueFull:    DropQueueFull,
+	dropSlowConsumer: DropSlowConsumer,
+	dropClosed:       DropClosed,
+	dropRateLimited:  DropRateLimited,
+	dropDecodeError:  DropDecodeError,
+	dropRejected:     DropRejected,
+}
+
+// countDrop counts n dropped messages, it must not be called with any internal lock held
+func (w *WebSocket) countDrop(reason dropReason, n int) {
+	if n <= 0 {
+		return
+	}
+	w.dropped[reason].Add((uint64)(n))
+	if m, ok := w.metrics.(DropMetrics); ok {
+		m.OnMessageDropped(dropReasonNames[reason], n)
+	}
+}
+
+// DroppedCount returns the total count of the messages dropped by the connection, see DroppedByReason
+func (w *WebSocket) DroppedCount() uint64 {
+	var total uint64
+	for i := range w.dropped {
+		total += w.dropped[i].Load()
+	}
+	return total
+}
+
+// DroppedByReason returns the counts of the dropped messages keyed by the reasons, such as DropExpired
+// The reasons which never happened are not included
+// The counters are not read atomically as a whole
+func (w *WebSocket) DroppedByReason() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for i := range w.dropped {
+		if n := w.dropped[i].Load(); n > 0 {
+			counts[dropReasonNames[i]] = n
+		}
+	}
+	return counts
+}
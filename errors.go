@@ -0,0 +1,107 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// The errors below, together with ErrPongTimeout, ErrSlowConsumer, ErrWriteTimeout, ErrReadTimeout and ErrIdleTimeout,
+// are returned by Upgrade and Dial or used as the connection's cause, use errors.Is to check them
+
+// ErrClosed is the cause when the connection is closed by Close
+// It's matched by the errors returned when using a closed connection, see ClosedError
+// It's the same as net.ErrClosed
+var ErrClosed = net.ErrClosed
+
+// ErrAuthTimeout is returned when the opposite did not finish the auth handshake within the auth timeout,
+// or the authorizer did not return within it and AuthTimeoutReject is used
+// It also matches os.ErrDeadlineExceeded
+var ErrAuthTimeout = fmt.Errorf("Auth timeout: %w", os.ErrDeadlineExceeded)
+
+// ErrUpgradeTimeout is returned when Upgrade did not finish within the upgrade timeout
+// It also matches os.ErrDeadlineExceeded
+var ErrUpgradeTimeout = fmt.Errorf("Upgrade timeout: %w", os.ErrDeadlineExceeded)
+
+// ErrCloseTimeout is the cause when the opposite did not echo the close frame within the close handshake timeout
+// It also matches os.ErrDeadlineExceeded
+var ErrCloseTimeout = fmt.Errorf("Close handshake timeout: %w", os.ErrDeadlineExceeded)
+
+// ErrAuthExpired is the cause when the expiry returned by ExpiringAuthorizer is reached and the opposite is not re-authorized
+var ErrAuthExpired = errors.New("Auth expired")
+
+// ErrAuthPending is returned when sending a message before the auth of UpgradeAsync completes, if RejectBeforeAuth is true
+var ErrAuthPending = errors.New("Auth pending")
+
+// ErrAuthRejected is matched by the errors returned when PreAuthorize, Authorizer or Reauthorizer rejected the opposite
+// The original error is still accessible with errors.As, such as *AuthError and *HTTPError
+var ErrAuthRejected = errors.New("Auth rejected")
+
+// ErrInvalidAuthMessage is matched by the error when the auth message is rejected by AuthValidator
+// It also matches ErrAuthRejected
+var ErrInvalidAuthMessage = errors.New("Invalid auth message")
+
+// ErrInvalidMessage is matched by the cause when a frame cannot be decoded and OnDecodeError did not drop it
+// The decode error is still accessible with errors.Is and errors.As
+var ErrInvalidMessage = errors.New("Invalid message")
+
+// ErrUnexpectedAuth is the cause when the opposite sent an auth message which is not requested and DuplicateAuthClose is used
+var ErrUnexpectedAuth = errors.New("Unexpected auth message")
+
+// ErrPingFailed is matched by the cause when a ping cannot be written
+// The error which failed the write is still accessible with errors.Is and errors.As
+var ErrPingFailed = errors.New("Ping failed")
+
+// rejectAuth makes err match ErrAuthRejected
+// Panics are not considered as rejections
+func rejectAuth(err error) error {
+	if errors.Is(err, ErrAuthRejected) || errors.Is(err, ErrHandlerPanic) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrAuthRejected, err)
+}
+
+// ClosedError is returned when using a closed connection, it matches ErrClosed
+// Cause is the reason why the connection is closed, which is same as the context.Cause of the connection's context,
+// such as a *websocket.CloseError carrying the code and reason sent by the opposite
+type ClosedError struct {
+	Cause error
+}
+
+func (e *ClosedError) Error() string {
+	if e.Cause == ErrClosed {
+		return ErrClosed.Error()
+	}
+	return "closed: " + e.Cause.Error()
+}
+
+func (e *ClosedError) Unwrap() []error {
+	return []error{ErrClosed, e.Cause}
+}
+
+// closedError returns the error for using the closed connection
+func (w *WebSocket) closedError() error {
+	cause := context.Cause(w.ctx)
+	if cause == nil {
+		cause = ErrClosed
+	}
+	return &ClosedError{Cause: cause}
+}
@@ -0,0 +1,103 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestSendEveryNoGoroutines(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	before := runtime.NumGoroutine()
+	var calls atomic.Int32
+	stops := make([]func(), 100)
+	for i := range stops {
+		stops[i] = s.SendEvery("tick", 10*time.Millisecond, func() (any, bool) {
+			calls.Add(1)
+			return i, true
+		})
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines are started by SendEvery", n-before)
+	}
+	for range 200 {
+		if _, err := c.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stop := range stops {
+		stop()
+	}
+	got := calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := calls.Load(); n != got {
+		t.Fatalf("generators are called %d times after stopped", n-got)
+	}
+}
+
+func TestSendEveryUntilFalse(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	n := 0
+	s.SendEvery("tick", 5*time.Millisecond, func() (any, bool) {
+		n++
+		return n, n <= 3
+	})
+	for i := 1; i <= 3; i++ {
+		m, err := c.ReadMessage()
+		if err != nil || m.Type != "tick" || string(m.Data) != string(rune('0'+i)) {
+			t.Fatal(m, err)
+		}
+	}
+	select {
+	case m := <-c.MessageReader():
+		t.Fatalf("unexpected message %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendEveryClosed(t *testing.T) {
+	s, _ := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	var calls atomic.Int32
+	stop := s.SendEvery("tick", 5*time.Millisecond, func() (any, bool) {
+		calls.Add(1)
+		return nil, true
+	})
+	time.Sleep(30 * time.Millisecond)
+	s.Close()
+	got := calls.Load()
+	time.Sleep(30 * time.Millisecond)
+	if n := calls.Load(); n != got {
+		t.Fatalf("generator is called %d times after the connection is closed", n-got)
+	}
+	// stop does not block after the connection is closed
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stop is blocked")
+	}
+}
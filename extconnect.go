@@ -0,0 +1,216 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// isExtendedConnect reports whether the request is a WebSocket handshake of RFC 8441, which is an extended CONNECT over HTTP/2
+func isExtendedConnect(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect && strings.EqualFold(req.Header.Get(":protocol"), "websocket")
+}
+
+// extendedConnectRequest converts the extended CONNECT request to the HTTP/1.1 upgrade request expected by the websocket upgrader
+func extendedConnectRequest(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	r.Method = http.MethodGet
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	r.Header.Del(":protocol")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	// any valid key, RFC 8441 does not use the accept key
+	r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	return r
+}
+
+// extendedConnectWriter is the http.ResponseWriter which hijacks to the stream of the extended CONNECT request
+// The errors before the hijack are still written to the HTTP/2 response
+type extendedConnectWriter struct {
+	http.ResponseWriter
+	req  *http.Request
+	conn *streamConn
+}
+
+func (w *extendedConnectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	local, _ := w.req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		local = streamAddr(w.req.Host)
+	}
+	var remote net.Addr = streamAddr(w.req.RemoteAddr)
+	if addr, err := netip.ParseAddrPort(w.req.RemoteAddr); err == nil {
+		remote = net.TCPAddrFromAddrPort(addr)
+	}
+	w.conn = &streamConn{
+		rw:     w.ResponseWriter,
+		rc:     http.NewResponseController(w.ResponseWriter),
+		body:   w.req.Body,
+		local:  local,
+		remote: remote,
+	}
+	// the buffers are small enough to not be reused, so all reads and writes go through the returned connection
+	return w.conn, bufio.NewReadWriter(bufio.NewReaderSize(w.conn, 16), bufio.NewWriterSize(w.conn, 16)), nil
+}
+
+// streamConn is the net.Conn over the stream of an extended CONNECT request
+// The first write is the handshake response of the websocket upgrader, which is translated to the 200 (OK) response
+type streamConn struct {
+	rw     http.ResponseWriter
+	rc     *http.ResponseController
+	body   io.ReadCloser
+	local  net.Addr
+	remote net.Addr
+
+	closed atomic.Bool
+	// mux is held while writing, so the stream is not written after Close returned
+	mux       sync.Mutex
+	handshook bool
+}
+
+var _ net.Conn = (*streamConn)(nil)
+
+func (c *streamConn) Read(buf []byte) (int, error) {
+	return c.body.Read(buf)
+}
+
+func (c *streamConn) Write(buf []byte) (int, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if !c.handshook {
+		c.handshook = true
+		if err := c.writeHandshake(buf); err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+	n, err := c.rw.Write(buf)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	return n, err
+}
+
+// writeHandshake sends the headers negotiated by the websocket upgrader with the 200 (OK) response
+func (c *streamConn) writeHandshake(buf []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+	if err != nil {
+		return err
+	}
+	header := c.rw.Header()
+	for k, vs := range resp.Header {
+		switch k {
+		case "Upgrade", "Connection", "Sec-Websocket-Accept":
+			continue
+		}
+		header[k] = vs
+	}
+	c.rw.WriteHeader(http.StatusOK)
+	return c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	// unblock the pending write, then wait for it
+	c.rc.SetWriteDeadline(time.Now())
+	c.mux.Lock()
+	c.mux.Unlock()
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+// bind returns the connection's context which is done only after the stream is closed,
+// since the HTTP handler may return as soon as the context is done, and the stream must not be used after that
+// The returned cancel closes the stream before cancelling the context
+func (c *streamConn) bind(ctx context.Context, cancel context.CancelCauseFunc) (context.Context, context.CancelCauseFunc) {
+	outer, cancelOuter := context.WithCancelCause(detachedContext{ctx})
+	stop := func(cause error) {
+		c.Close()
+		cancel(cause)
+		cancelOuter(context.Cause(ctx))
+	}
+	context.AfterFunc(ctx, func() {
+		stop(context.Cause(ctx))
+	})
+	return outer, stop
+}
+
+// detachedContext keeps the values and the deadline of the parent, but it's never done
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// streamAddr is the address of an HTTP/2 stream which cannot be parsed
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "tcp"
+}
+
+func (a streamAddr) String() string {
+	return (string)(a)
+}
@@ -0,0 +1,341 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+// writeClientFrame writes a masked text frame
+func writeClientFrame(w io.Writer, payload string) error {
+	if len(payload) > 125 {
+		return errors.New("payload is too long")
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | (byte)(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readServerFrame reads an unmasked frame which is not fragmented
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := (uint64)(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = (uint64)(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return head[0] & 0x0f, payload, err
+}
+
+// h2Conn is a minimal HTTP/2 client with only one stream, since net/http cannot send an extended CONNECT request
+type h2Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	data chan []byte
+	buf  []byte
+}
+
+func newH2Conn(conn net.Conn) *h2Conn {
+	return &h2Conn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *h2Conn) writeFrame(typ, flags byte, stream uint32, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0], frame[1], frame[2] = (byte)(len(payload)>>16), (byte)(len(payload)>>8), (byte)(len(payload))
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:], stream)
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+func (c *h2Conn) readFrame() (typ, flags byte, stream uint32, payload []byte, err error) {
+	var head [9]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	payload = make([]byte, (int)(head[0])<<16|(int)(head[1])<<8|(int)(head[2]))
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	return head[3], head[4], binary.BigEndian.Uint32(head[5:]) & 0x7fffffff, payload, nil
+}
+
+// handshake exchanges the settings, and checks SETTINGS_ENABLE_CONNECT_PROTOCOL
+func (c *h2Conn) handshake() error {
+	if _, err := io.WriteString(c.conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"); err != nil {
+		return err
+	}
+	if err := c.writeFrame(0x4, 0, 0, nil); err != nil {
+		return err
+	}
+	typ, _, _, payload, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if typ != 0x4 {
+		return errors.New("Settings frame expected")
+	}
+	enabled := false
+	for i := 0; i+6 <= len(payload); i += 6 {
+		if binary.BigEndian.Uint16(payload[i:]) == 0x8 && binary.BigEndian.Uint32(payload[i+2:]) == 1 {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return errors.New("Extended CONNECT is not enabled")
+	}
+	return c.writeFrame(0x4, 0x1, 0, nil)
+}
+
+// connect sends the request headers on stream 1 as the literal fields without indexing
+func (c *h2Conn) connect(authority, protocol string) error {
+	var block []byte
+	for _, f := range [][2]string{
+		{":method", "CONNECT"},
+		{":protocol", protocol},
+		{":scheme", "https"},
+		{":path", "/"},
+		{":authority", authority},
+		{"sec-websocket-version", "13"},
+	} {
+		block = append(block, 0x00, (byte)(len(f[0])))
+		block = append(block, f[0]...)
+		block = append(block, (byte)(len(f[1])))
+		block = append(block, f[1]...)
+	}
+	return c.writeFrame(0x1, 0x4, 1, block)
+}
+
+// readHeaders returns the first byte of the response header block, which is 0x88 for the indexed ":status: 200"
+func (c *h2Conn) readHeaders() (byte, error) {
+	for {
+		typ, _, stream, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case typ == 0x1 && stream == 1 && len(payload) > 0:
+			c.data = make(chan []byte, 16)
+			go c.readData()
+			return payload[0], nil
+		case typ == 0x3 && stream == 1:
+			return 0, errors.New("Stream is reset")
+		case typ == 0x7:
+			return 0, errors.New("Connection is closed")
+		}
+	}
+}
+
+func (c *h2Conn) readData() {
+	defer close(c.data)
+	for {
+		typ, flags, stream, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		if stream != 1 {
+			continue
+		}
+		if typ == 0x0 && len(payload) > 0 {
+			c.data <- payload
+		}
+		if typ == 0x3 || flags&0x1 != 0 && (typ == 0x0 || typ == 0x1) {
+			return
+		}
+	}
+}
+
+type h2DataReader struct{ c *h2Conn }
+
+func (r h2DataReader) Read(buf []byte) (int, error) {
+	if len(r.c.buf) == 0 {
+		data, ok := <-r.c.data
+		if !ok {
+			return 0, io.EOF
+		}
+		r.c.buf = data
+	}
+	n := copy(buf, r.c.buf)
+	r.c.buf = r.c.buf[n:]
+	return n, nil
+}
+
+func (c *h2Conn) dataReader() io.Reader {
+	return h2DataReader{c}
+}
+
+type h2DataWriter struct{ c *h2Conn }
+
+func (w h2DataWriter) Write(buf []byte) (int, error) {
+	if err := w.c.writeFrame(0x0, 0, 1, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *h2Conn) dataWriter() io.Writer {
+	return h2DataWriter{c}
+}
+
+func TestExtendedConnect(t *testing.T) {
+	// the extended CONNECT of net/http is only enabled by the environment variable, which is read at the start
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		if !strings.Contains((string)(out), "--- PASS: TestExtendedConnect") {
+			t.Fatalf("test is not passed\n%s", out)
+		}
+		return
+	}
+	up := &aws.Upgrader{Upgrader: &websocket.Upgrader{}, MinBatchTimeout: time.Millisecond, MaxBatchTimeout: time.Millisecond}
+	ch := make(chan *aws.WebSocket, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w, err := up.Upgrade(rw, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- w
+		<-w.Context().Done()
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+		RootCAs:    srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		NextProtos: []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h2 := newH2Conn(conn)
+	if err := h2.handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.connect(srv.Listener.Addr().String(), "websocket"); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := h2.readHeaders(); err != nil || status != 0x88 {
+		t.Fatalf("unexpected response %#x: %v", status, err)
+	}
+	pw := h2.dataWriter()
+	r := bufio.NewReader(h2.dataReader())
+	s := <-ch
+	op, payload, err := readServerFrame(r)
+	if err != nil || op != websocket.TextMessage || !strings.Contains((string)(payload), `"$ready"`) {
+		t.Fatalf("unexpected ready frame %d %s: %v", op, payload, err)
+	}
+	if err := writeClientFrame(pw, `{"t":"hello","d":1}`+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.ReadMessage()
+	if err != nil || msg.Type != "hello" {
+		t.Fatal(msg, err)
+	}
+	if err := s.WriteMessage("world", 2); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload, err = readServerFrame(r); err != nil || !strings.Contains((string)(payload), `"world"`) {
+		t.Fatalf("unexpected frame %d %s: %v", op, payload, err)
+	}
+	s.Abort()
+	select {
+	case <-s.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+	eof := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, r)
+		eof <- err
+	}()
+	select {
+	case err := <-eof:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream is not ended")
+	}
+}
+
+func TestHTTP2WithoutExtendedConnect(t *testing.T) {
+	up := &aws.Upgrader{Upgrader: &websocket.Upgrader{}}
+	errCh := make(chan error, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, err := up.Upgrade(rw, req, nil)
+		errCh <- err
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Fatal(resp.Status)
+	}
+	if err := <-errCh; !errors.Is(err, aws.ErrUnsupportedProtocol) {
+		t.Fatal(err)
+	}
+}
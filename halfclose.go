@@ -0,0 +1,141 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrReadClosed is returned when reading after the read side is closed by CloseRead or the opposite's CloseWrite
+var ErrReadClosed = errors.New("Read side is closed")
+
+// ErrWriteClosed is returned when writing after the write side is closed by CloseWrite or the opposite's CloseRead
+var ErrWriteClosed = errors.New("Write side is closed")
+
+// halfCloseState is the state of the half closed sides
+type halfCloseState struct {
+	// readClosed is true if the read side is closed, readStop is closed at the same time
+	readClosed atomic.Bool
+	readStop   chan struct{}
+	// readHalted is true if the read goroutine should exit
+	readHalted atomic.Bool
+	// writeClosed is true if no application messages can be queued,
+	// writeStop is closed when the write goroutine should exit
+	writeClosed   atomic.Bool
+	writeStop     chan struct{}
+	writeStopOnce sync.Once
+	// keepaliveStop is closed when any side is closed
+	keepaliveStop chan struct{}
+	keepaliveOnce sync.Once
+}
+
+type shutdownMessage struct {
+	// Read is true if the sender will not read any message
+	Read bool `json:"read,omitempty"`
+	// Write is true if the sender will not write any message
+	Write bool `json:"write,omitempty"`
+}
+
+// CloseRead stops the read goroutine, MessageReader and BinaryReader will be closed after the buffered messages
+// The opposite is notified to close its write side
+// Since pongs cannot be received anymore, the ping and pong timeout are stopped on both sides,
+// and the close frame sent by the opposite will not be noticed
+// The connection is closed when both sides are closed
+func (w *WebSocket) CloseRead() error {
+	if w.ctx.Err() != nil {
+		return w.closedError()
+	}
+	if w.readClosed.Load() {
+		return nil
+	}
+	if err := w.writeInternal("$shutdown", &shutdownMessage{Read: true}); err == nil {
+		w.Flush()
+	}
+	w.readHalted.Store(true)
+	w.shutRead()
+	w.ws.SetReadDeadline(time.Now())
+	return nil
+}
+
+// CloseWrite flushes the queued messages within the close flush timeout, then stops the write goroutine
+// The opposite is notified to close its read side
+// Since pongs cannot be sent anymore, the ping and pong timeout are stopped on both sides
+// The connection is closed when both sides are closed
+func (w *WebSocket) CloseWrite() error {
+	if w.ctx.Err() != nil {
+		return w.closedError()
+	}
+	if !w.writeClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	// internal messages can still be queued until the write goroutine is stopped
+	if err := w.writeInternal("$shutdown", &shutdownMessage{Write: true}); err == nil {
+		timeout := w.closeFlushTimeout
+		if timeout <= 0 {
+			timeout = closeHandshakeTimeout
+		}
+		w.waitFlushed(timeout)
+	}
+	w.shutWrite()
+	return nil
+}
+
+// shutRead marks the read side is closed
+func (w *WebSocket) shutRead() {
+	if !w.readClosed.CompareAndSwap(false, true) {
+		return
+	}
+	close(w.readStop)
+	w.halfClosed()
+}
+
+// shutWrite marks the write side is closed and stops the write goroutine
+func (w *WebSocket) shutWrite() {
+	w.writeClosed.Store(true)
+	w.writeStopOnce.Do(func() {
+		close(w.writeStop)
+	})
+	w.halfClosed()
+}
+
+// halfClosed stops the keepalive, and closes the connection if both sides are closed
+func (w *WebSocket) halfClosed() {
+	w.keepaliveOnce.Do(func() {
+		close(w.keepaliveStop)
+	})
+	if w.readClosed.Load() && w.writeClosed.Load() {
+		go w.closeWithCause(websocket.CloseNormalClosure, "", ErrClosed)
+	}
+}
+
+func (w *WebSocket) handleShutdown(msg *Message) {
+	var shutdown shutdownMessage
+	if err := w.ParseMessage(msg, &shutdown); err != nil {
+		return
+	}
+	if shutdown.Write {
+		w.shutRead()
+	}
+	if shutdown.Read {
+		w.shutWrite()
+	}
+}
@@ -0,0 +1,73 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"net/http"
+)
+
+// UpgradeHandler is an http.Handler upgrades the requests and passes the authorized connections to OnConnect
+type UpgradeHandler struct {
+	Upgrader  *Upgrader
+	OnConnect func(*WebSocket)
+	// Detach calls OnConnect in a new goroutine, and the connection is kept until it's closed
+	// ServeHTTP still blocks until the connection is done, since the connection's context is derived from the request's context,
+	// so the connection also ends when the request's context is cancelled, such as when the server is shut down
+	// Otherwise, OnConnect is called in the request's goroutine, and the connection is closed after OnConnect returned
+	Detach bool
+	// OnError is called when Upgrade failed, the response is already written if the request is not upgraded yet
+	// Default logs the error with Upgrader.Logger
+	OnError func(req *http.Request, err error)
+}
+
+var _ http.Handler = (*UpgradeHandler)(nil)
+
+// Handler returns an UpgradeHandler calls onConnect with the authorized connections
+// The returned handler can be used with http.ServeMux and middlewares directly
+// It returns the concrete *UpgradeHandler instead of http.Handler on purpose, so Detach and OnError can be set before serving
+func (u *Upgrader) Handler(onConnect func(*WebSocket)) *UpgradeHandler {
+	return &UpgradeHandler{
+		Upgrader:  u,
+		OnConnect: onConnect,
+	}
+}
+
+func (h *UpgradeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w, err := h.Upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		if h.OnError != nil {
+			h.OnError(req, err)
+		} else if logger := h.Upgrader.current().Logger; logger != nil {
+			logger.Debug("Upgrade failed", "remote", req.RemoteAddr, "err", err)
+		}
+		return
+	}
+	if h.Detach {
+		go h.serve(w)
+		// the connection's context is derived from the request's context, which is cancelled after the handler returned,
+		// so the handler must not return before the connection is done, and the connection ends if the request is cancelled
+		<-w.Done()
+		return
+	}
+	h.serve(w)
+	w.Close()
+}
+
+func (h *UpgradeHandler) serve(w *WebSocket) {
+	defer w.recoverPanic()
+	h.OnConnect(w)
+}
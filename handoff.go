@@ -0,0 +1,138 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrHandoffCompression is returned by FromConn when the adopted connection is using compression but the Upgrader does not enable it
+var ErrHandoffCompression = errors.New("Compression is not enabled for the adopted connection")
+
+// HandoffState is the negotiated state of a connection which is needed to adopt it with FromConn,
+// such as when handing the connection's file descriptor to a new process during a graceful restart
+type HandoffState struct {
+	Subprotocol string
+	// Compression reports whether permessage-deflate is negotiated
+	Compression bool
+	// AuthData becomes the adopted connection's auth data, it's not serializable in general,
+	// so it's usually rebuilt by the new process
+	AuthData any
+}
+
+// Handoff returns the state should be passed to FromConn together with UnderlyingConn
+// For a TCP connection, the file descriptor can be duplicated by (*net.TCPConn).File,
+// then Abort releases the connection without sending a close frame, since the socket is kept open by the duplicate
+func (w *WebSocket) Handoff() HandoffState {
+	return HandoffState{
+		Subprotocol: w.Subprotocol(),
+		Compression: w.compression,
+		AuthData:    w.AuthData(),
+	}
+}
+
+// UnderlyingConn returns the network connection under the WebSocket, such as a *net.TCPConn or a *tls.Conn
+// Reading from or writing to it directly will break the connection
+func (w *WebSocket) UnderlyingConn() net.Conn {
+	return unwrapConn(w.ws.UnderlyingConn())
+}
+
+// FromConn adopts an established WebSocket connection which is not from an HTTP request,
+// such as the one handed off by another process, as a server side connection
+// conn must be at a frame boundary, so the previous owner must stop reading and writing it before the handoff,
+// and the data it already read but not processed cannot be recovered
+// The HTTP handshake and the auth handshake are skipped, PreAuthorize and the authorizers are not called,
+// and the connection is ready once FromConn returns
+// The other options of the Upgrader are applied as Upgrade does, and the Upgrader must enable the compression if state.Compression is true
+func (u *Upgrader) FromConn(conn net.Conn, state HandoffState) (*WebSocket, error) {
+	req := &http.Request{
+		Method:     http.MethodGet,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Connection":            {"Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+			// any valid key, the accept key is discarded
+			"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="},
+		},
+		RemoteAddr: conn.RemoteAddr().String(),
+		Host:       conn.LocalAddr().String(),
+	}
+	var respHeader http.Header
+	if state.Subprotocol != "" {
+		req.Header.Set("Sec-Websocket-Protocol", state.Subprotocol)
+		respHeader = http.Header{"Sec-Websocket-Protocol": {state.Subprotocol}}
+	}
+	if state.Compression {
+		if c := u.current(); !c.EnableCompression && !c.Upgrader.EnableCompression {
+			return nil, ErrHandoffCompression
+		}
+		req.Header.Set("Sec-Websocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+	w, err := u.upgrade(&handoffWriter{conn: conn}, req, respHeader, upgradeHandoff)
+	if err != nil {
+		return nil, err
+	}
+	if state.AuthData != nil {
+		w.setAuthData(state.AuthData)
+	}
+	return w, nil
+}
+
+// handoffConn discards the handshake response written by the websocket upgrader
+type handoffConn struct {
+	net.Conn
+	handshook bool
+}
+
+func (c *handoffConn) Write(buf []byte) (int, error) {
+	if !c.handshook {
+		c.handshook = true
+		return len(buf), nil
+	}
+	return c.Conn.Write(buf)
+}
+
+// handoffWriter is the http.ResponseWriter which hijacks to the adopted connection
+type handoffWriter struct {
+	conn   net.Conn
+	header http.Header
+}
+
+func (w *handoffWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *handoffWriter) Write(buf []byte) (int, error) {
+	return 0, http.ErrHijacked
+}
+
+func (w *handoffWriter) WriteHeader(int) {}
+
+func (w *handoffWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn := &handoffConn{Conn: w.conn}
+	// the buffers are small enough to not be reused, so all reads and writes go through the returned connection
+	return conn, bufio.NewReadWriter(bufio.NewReaderSize(conn, 16), bufio.NewWriterSize(conn, 16)), nil
+}
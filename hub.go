@@ -0,0 +1,254 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub is a set of WebSockets which can broadcast messages to all of them
+// Closed connections will be removed automatically
+// The zero value is ready to use
+type Hub struct {
+	mux   sync.RWMutex
+	conns map[*WebSocket]func() bool
+	// tagged indexes the connections by their tags
+	tagged map[string]map[*WebSocket]struct{}
+}
+
+// Add adds a WebSocket to the hub
+// It will be removed when the connection is closed
+func (h *Hub) Add(w *WebSocket) {
+	// the connection's tagMux is always locked before the hub's
+	w.tagMux.Lock()
+	defer w.tagMux.Unlock()
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if _, ok := h.conns[w]; ok {
+		return
+	}
+	if h.conns == nil {
+		h.conns = make(map[*WebSocket]func() bool)
+	}
+	h.conns[w] = context.AfterFunc(w.ctx, func() {
+		h.Remove(w)
+	})
+	for tag := range w.tags {
+		h.indexTag(w, tag)
+	}
+	if w.hubs == nil {
+		w.hubs = make(map[*Hub]struct{})
+	}
+	w.hubs[h] = struct{}{}
+}
+
+// Remove removes a WebSocket from the hub
+func (h *Hub) Remove(w *WebSocket) {
+	w.tagMux.Lock()
+	defer w.tagMux.Unlock()
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if stop, ok := h.conns[w]; ok {
+		delete(h.conns, w)
+		stop()
+		for tag := range w.tags {
+			h.unindexTag(w, tag)
+		}
+		delete(w.hubs, h)
+	}
+}
+
+// indexTag must be called with mux locked
+func (h *Hub) indexTag(w *WebSocket, tag string) {
+	conns := h.tagged[tag]
+	if conns == nil {
+		if h.tagged == nil {
+			h.tagged = make(map[string]map[*WebSocket]struct{})
+		}
+		conns = make(map[*WebSocket]struct{})
+		h.tagged[tag] = conns
+	}
+	conns[w] = struct{}{}
+}
+
+// unindexTag must be called with mux locked
+func (h *Hub) unindexTag(w *WebSocket, tag string) {
+	if conns := h.tagged[tag]; conns != nil {
+		delete(conns, w)
+		if len(conns) == 0 {
+			delete(h.tagged, tag)
+		}
+	}
+}
+
+// CountTag returns the count of connections in the hub which have the tag
+func (h *Hub) CountTag(tag string) int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.tagged[tag])
+}
+
+// Len returns the count of connections in the hub
+func (h *Hub) Len() int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.conns)
+}
+
+// Range calls fn for each live connection until fn returns false
+// The connections are copied before iterating, so fn can modify the hub
+func (h *Hub) Range(fn func(*WebSocket) bool) {
+	for _, w := range h.snapshot() {
+		if w.IsClosed() {
+			continue
+		}
+		if !fn(w) {
+			return
+		}
+	}
+}
+
+// Connections returns the live connections in the hub, in no particular order
+func (h *Hub) Connections() []*WebSocket {
+	conns := h.snapshot()
+	live := conns[:0]
+	for _, w := range conns {
+		if !w.IsClosed() {
+			live = append(live, w)
+		}
+	}
+	return live
+}
+
+func (h *Hub) snapshot() []*WebSocket {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	conns := make([]*WebSocket, 0, len(h.conns))
+	for w := range h.conns {
+		conns = append(conns, w)
+	}
+	return conns
+}
+
+// Broadcast queues a message to all live connections in the hub
+// It will not wait for the messages to be flushed, so a slow connection will not block others
+// If a connection's bounded queue is full, the message is dropped for it and ErrQueueFull is included in the returned error
+// Messages are batched with each connection's own batch timeouts
+// The data is only marshalled once for each codec
+func (h *Hub) Broadcast(typ string, data any) error {
+	return h.BroadcastPrepared(NewPreparedMessage(typ, data))
+}
+
+// BroadcastPrepared is same as Broadcast, but sends a PreparedMessage
+func (h *Hub) BroadcastPrepared(m *PreparedMessage) error {
+	var errs []error
+	h.Range(func(w *WebSocket) bool {
+		if err := broadcastTo(w, m); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// BroadcastTo is same as Broadcast, but only sends to the connections which have the tag
+// Only the connections with the tag are copied, and the messages are sent after the hub is unlocked,
+// so the callbacks such as OnQueueHighWater can modify the hub
+func (h *Hub) BroadcastTo(tag string, typ string, data any) error {
+	m := NewPreparedMessage(typ, data)
+	var errs []error
+	for _, w := range h.snapshotTag(tag) {
+		if w.IsClosed() {
+			continue
+		}
+		if err := broadcastTo(w, m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *Hub) snapshotTag(tag string) []*WebSocket {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	tagged := h.tagged[tag]
+	conns := make([]*WebSocket, 0, len(tagged))
+	for w := range tagged {
+		conns = append(conns, w)
+	}
+	return conns
+}
+
+// BroadcastFunc is same as Broadcast, but only sends to the connections which filter returns true
+func (h *Hub) BroadcastFunc(filter func(*WebSocket) bool, typ string, data any) error {
+	m := NewPreparedMessage(typ, data)
+	var errs []error
+	h.Range(func(w *WebSocket) bool {
+		if filter(w) {
+			if err := broadcastTo(w, m); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// broadcastTo queues the message without blocking, ErrClosed is ignored
+func broadcastTo(w *WebSocket, m *PreparedMessage) error {
+	p, err := w.preparedPending(m)
+	if err == nil {
+		err = w.tryEnqueue(p)
+	}
+	if err != nil && !errors.Is(err, ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown closes all connections in the hub with code 1001 (going away),
+// and waits until all of them are closed or ctx is done
+// Connections which are still alive after ctx is done will be closed immediately
+func (h *Hub) Shutdown(ctx context.Context) error {
+	conns := h.snapshot()
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	for _, w := range conns {
+		go func(w *WebSocket) {
+			defer wg.Done()
+			w.CloseWithCode(websocket.CloseGoingAway, "shutdown")
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, w := range conns {
+			w.Abort()
+		}
+		return context.Cause(ctx)
+	}
+}
@@ -0,0 +1,65 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestBroadcastToCallbackModifiesHub(t *testing.T) {
+	var hub aws.Hub
+	var s *aws.WebSocket
+	var armed atomic.Bool
+	up := &aws.Upgrader{
+		Upgrader:               &websocket.Upgrader{},
+		MinBatchTimeout:        time.Second,
+		MaxBatchTimeout:        time.Second,
+		QueueHighWaterMessages: 1,
+		OnQueueHighWater: func(count int, bytes int) {
+			if !armed.Load() {
+				return
+			}
+			// the hub must not be locked when the callback is called
+			s.RemoveTag("room")
+			hub.Remove(s)
+		},
+	}
+	s, _ = pair(t, up, &aws.Dialer{})
+	s.AddTag("room")
+	hub.Add(s)
+	armed.Store(true)
+	done := make(chan error, 1)
+	go func() {
+		done <- hub.BroadcastTo("room", "hello", 1)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BroadcastTo is deadlocked")
+	}
+	if hub.Len() != 0 || hub.CountTag("room") != 0 {
+		t.Fatal("connection is not removed", hub.Len(), hub.CountTag("room"))
+	}
+}
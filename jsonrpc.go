@@ -0,0 +1,344 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The error codes defined by JSON-RPC 2.0
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+)
+
+// JSONRPCError is the error object of JSON-RPC 2.0
+// A handler registered by RegisterRPC can return it to reply a specific error, such as JSONRPCInvalidParams,
+// other errors are replied with JSONRPCInternalError and the error message
+// It's also returned by CallRPC when the opposite replied an error
+type JSONRPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return "jsonrpc error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+type jsonrpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Id is empty if the request is a notification
+	Id json.RawMessage `json:"id,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// jsonrpcMessage is either a request or a response
+type jsonrpcMessage struct {
+	jsonrpcRequest
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *JSONRPCError   `json:"error,omitempty"`
+}
+
+var jsonrpcNull = (json.RawMessage)("null")
+
+// ErrRawJSONRPC is returned when sending a message other than JSON-RPC while RawJSONRPC is set
+var ErrRawJSONRPC = errors.New("Only JSON-RPC messages can be sent in raw JSON-RPC mode")
+
+// RegisterRPC registers a JSON-RPC 2.0 method which can be invoked by the opposite
+// The JSON-RPC messages are carried as the data of the $jsonrpc messages, or as bare text frames if RawJSONRPC is set,
+// a batch is a JSON array as the spec defines, and the responses of a batch are sent together in one message
+// The handlers are called like the handlers registered by On, in the read goroutine or by the workers if DispatchWorkers is set,
+// so without workers a handler must not wait for the opposite, such as by CallRPC
+// The requests of a batch are served one by one, and the handler's context is cancelled when the connection is closed
+// No response is sent for the notifications, which are the requests without an id
+// The JSON-RPC layer decodes the data as JSON, so it requires a codec which encodes as JSON, such as JSONCodec
+// A nil handler removes the registered one
+func (w *WebSocket) RegisterRPC(method string, handler CallHandler) {
+	w.handlerMux.Lock()
+	defer w.handlerMux.Unlock()
+	if handler == nil {
+		delete(w.rpcMethods, method)
+		return
+	}
+	if w.rpcMethods == nil {
+		w.rpcMethods = make(map[string]CallHandler)
+	}
+	w.rpcMethods[method] = handler
+}
+
+// CallRPC invokes the JSON-RPC method registered by RegisterRPC on the opposite, and waits for the result
+// A *JSONRPCError is returned if the opposite replied an error
+func (w *WebSocket) CallRPC(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	resCh := make(chan *jsonrpcResponse, 1)
+	w.callMux.Lock()
+	w.rpcId++
+	id := w.rpcId
+	if w.rpcCalls == nil {
+		w.rpcCalls = make(map[uint64]chan<- *jsonrpcResponse)
+	}
+	w.rpcCalls[id] = resCh
+	w.callMux.Unlock()
+	defer func() {
+		w.callMux.Lock()
+		delete(w.rpcCalls, id)
+		w.callMux.Unlock()
+	}()
+
+	if err := w.writeJSONRPC(ctx, &jsonrpcRequest{
+		Version: "2.0",
+		Method:  method,
+		Params:  (json.RawMessage)(buf),
+		Id:      (json.RawMessage)(strconv.FormatUint(id, 10)),
+	}); err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-resCh:
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return res.Result, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case <-w.ctx.Done():
+		return nil, w.closedError()
+	}
+}
+
+// NotifyRPC sends a JSON-RPC notification, which does not have a response
+func (w *WebSocket) NotifyRPC(method string, params any) error {
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return w.writeJSONRPC(context.Background(), &jsonrpcRequest{
+		Version: "2.0",
+		Method:  method,
+		Params:  (json.RawMessage)(buf),
+	})
+}
+
+func (w *WebSocket) handleJSONRPC(msg *Message) {
+	data := bytes.TrimSpace(msg.Data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			w.replyJSONRPC(jsonrpcErrorResponse(nil, JSONRPCParseError, "Parse error"))
+			return
+		}
+		if len(batch) == 0 {
+			w.replyJSONRPC(jsonrpcErrorResponse(nil, JSONRPCInvalidRequest, "Invalid Request"))
+			return
+		}
+		w.dispatch(func() {
+			w.serveJSONRPCBatch(batch)
+		})
+		return
+	}
+	var m jsonrpcMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		w.replyJSONRPC(jsonrpcErrorResponse(nil, JSONRPCParseError, "Parse error"))
+		return
+	}
+	if m.Method == "" && (m.Result != nil || m.Error != nil) {
+		w.handleJSONRPCResponse(&m)
+		return
+	}
+	w.dispatch(func() {
+		if res := w.serveJSONRPC(&m.jsonrpcRequest); res != nil {
+			w.replyJSONRPC(res)
+		}
+	})
+}
+
+func (w *WebSocket) serveJSONRPCBatch(batch []json.RawMessage) {
+	responses := make([]*jsonrpcResponse, len(batch))
+	for i, data := range batch {
+		var m jsonrpcMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			responses[i] = jsonrpcErrorResponse(nil, JSONRPCInvalidRequest, "Invalid Request")
+			continue
+		}
+		if m.Method == "" && (m.Result != nil || m.Error != nil) {
+			w.handleJSONRPCResponse(&m)
+			continue
+		}
+		responses[i] = w.serveJSONRPC(&m.jsonrpcRequest)
+	}
+	replies := responses[:0]
+	for _, res := range responses {
+		if res != nil {
+			replies = append(replies, res)
+		}
+	}
+	// nothing is replied if all of them are notifications
+	if len(replies) > 0 {
+		w.replyJSONRPC(replies)
+	}
+}
+
+// serveJSONRPC calls the handler of the request, it returns nil if the request is a notification
+func (w *WebSocket) serveJSONRPC(req *jsonrpcRequest) *jsonrpcResponse {
+	notification := len(req.Id) == 0
+	if req.Version != "2.0" || req.Method == "" {
+		return jsonrpcErrorResponse(req.Id, JSONRPCInvalidRequest, "Invalid Request")
+	}
+	w.handlerMux.RLock()
+	handler := w.rpcMethods[req.Method]
+	w.handlerMux.RUnlock()
+	if handler == nil {
+		if notification {
+			return nil
+		}
+		return jsonrpcErrorResponse(req.Id, JSONRPCMethodNotFound, "Method not found")
+	}
+	result, err := handler(w.ctx, req.Params)
+	if notification {
+		return nil
+	}
+	if err == nil {
+		var buf []byte
+		if buf, err = json.Marshal(result); err == nil {
+			return &jsonrpcResponse{
+				Version: "2.0",
+				Result:  (json.RawMessage)(buf),
+				Id:      req.Id,
+			}
+		}
+	}
+	var rpcErr *JSONRPCError
+	if !errors.As(err, &rpcErr) {
+		rpcErr = &JSONRPCError{Code: JSONRPCInternalError, Message: err.Error()}
+	}
+	return &jsonrpcResponse{
+		Version: "2.0",
+		Error:   rpcErr,
+		Id:      req.Id,
+	}
+}
+
+func (w *WebSocket) handleJSONRPCResponse(m *jsonrpcMessage) {
+	id, err := strconv.ParseUint(string(m.Id), 10, 64)
+	if err != nil {
+		return
+	}
+	w.callMux.Lock()
+	resCh := w.rpcCalls[id]
+	w.callMux.Unlock()
+	if resCh != nil {
+		select {
+		case resCh <- &jsonrpcResponse{Version: m.Version, Result: m.Result, Error: m.Error, Id: m.Id}:
+		default:
+		}
+	}
+}
+
+func (w *WebSocket) replyJSONRPC(res any) {
+	w.writeInternal("$jsonrpc", res)
+}
+
+// writeJSONRPC queues a JSON-RPC message, then wait until it's flushed
+func (w *WebSocket) writeJSONRPC(ctx context.Context, v any) error {
+	if !w.rawJSONRPC {
+		return w.WriteMessageContext(ctx, "$jsonrpc", v)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.enqueueAndWait(ctx, &pendingMessage{
+		binary: buf,
+		text:   true,
+		done:   make(chan error, 1),
+	})
+}
+
+// writeRawInternal queues an internal message when RawJSONRPC is set
+// The JSON-RPC messages are written as bare text frames, the pings are written as control frames,
+// and the others are discarded since the opposite does not understand them
+func (w *WebSocket) writeRawInternal(typ string, data any) error {
+	switch typ {
+	case "$jsonrpc":
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return w.enqueue(&pendingMessage{binary: buf, text: true})
+	case "$ping":
+		err := w.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return ErrWriteClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// readRawJSONRPC handles a text frame when RawJSONRPC is set
+// It must only be called from the read goroutine
+func (w *WebSocket) readRawJSONRPC(r io.Reader) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		// the read errors are returned by the next NextReader
+		return
+	}
+	msg := &Message{Type: "$jsonrpc", Data: data}
+	if w.debug.Load() {
+		w.debugMessage("received", msg)
+	}
+	if !w.allowInbound() || !w.waitAuthDone() {
+		return
+	}
+	w.activeAt.Store((int64)(w.since()))
+	w.countReceived(len(data))
+	w.handleJSONRPC(msg)
+}
+
+func jsonrpcErrorResponse(id json.RawMessage, code int, message string) *jsonrpcResponse {
+	if len(id) == 0 {
+		id = jsonrpcNull
+	}
+	return &jsonrpcResponse{
+		Version: "2.0",
+		Error:   &JSONRPCError{Code: code, Message: message},
+		Id:      id,
+	}
+}
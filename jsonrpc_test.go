@@ -0,0 +1,137 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func addRPC(ctx context.Context, params json.RawMessage) (any, error) {
+	var args []int
+	if err := json.Unmarshal(params, &args); err != nil {
+		return nil, &aws.JSONRPCError{Code: aws.JSONRPCInvalidParams, Message: "Invalid params"}
+	}
+	sum := 0
+	for _, n := range args {
+		sum += n
+	}
+	return sum, nil
+}
+
+func TestRawJSONRPC(t *testing.T) {
+	url, ch := serve(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}, RawJSONRPC: true})
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-ch
+	s.RegisterRPC("add", addRPC)
+	if err := s.Send("x", 1); !errors.Is(err, aws.ErrRawJSONRPC) {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := c.WriteMessage(websocket.TextMessage, ([]byte)(`{"jsonrpc":"2.0","method":"add","params":[1,2],"id":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	// the ready message is not sent, so the first frame is the response
+	typ, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Version string `json:"jsonrpc"`
+		Result  int    `json:"result"`
+		Id      int    `json:"id"`
+	}
+	if err := json.Unmarshal(data, &res); typ != websocket.TextMessage || err != nil || res.Version != "2.0" || res.Result != 3 || res.Id != 1 {
+		t.Fatalf("unexpected response %d %s: %v", typ, data, err)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, ([]byte)(`[{"jsonrpc":"2.0","method":"add","params":[1],"id":2},{"jsonrpc":"2.0","method":"add","params":[2]},{"jsonrpc":"2.0","method":"nope","id":3}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err = c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	var batch []struct {
+		Result int               `json:"result"`
+		Error  *aws.JSONRPCError `json:"error"`
+		Id     int               `json:"id"`
+	}
+	if err := json.Unmarshal(data, &batch); err != nil || len(batch) != 2 {
+		t.Fatalf("unexpected batch response %s: %v", data, err)
+	}
+	if batch[0].Id != 2 || batch[0].Result != 1 || batch[1].Id != 3 || batch[1].Error == nil || batch[1].Error.Code != aws.JSONRPCMethodNotFound {
+		t.Fatalf("unexpected batch response %s", data)
+	}
+}
+
+func TestRawJSONRPCDialer(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}, RawJSONRPC: true}, &aws.Dialer{RawJSONRPC: true})
+	s.RegisterRPC("add", addRPC)
+	c.RegisterRPC("add", addRPC)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := c.CallRPC(ctx, "add", []int{1, 2, 3})
+	if err != nil || string(res) != "6" {
+		t.Fatal(string(res), err)
+	}
+	res, err = s.CallRPC(ctx, "add", []int{4, 5})
+	if err != nil || string(res) != "9" {
+		t.Fatal(string(res), err)
+	}
+}
+
+func TestJSONRPCDispatchWorkers(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}, DispatchWorkers: 2, DispatchQueueSize: 32}, &aws.Dialer{})
+	var (
+		running, peak atomic.Int32
+		wg            sync.WaitGroup
+	)
+	wg.Add(20)
+	s.RegisterRPC("work", func(ctx context.Context, params json.RawMessage) (any, error) {
+		defer wg.Done()
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	})
+	for i := range 20 {
+		if err := c.NotifyRPC("work", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if p := peak.Load(); p > 2 {
+		t.Fatalf("%d handlers are running concurrently, expect at most 2", p)
+	}
+}
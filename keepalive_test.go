@@ -0,0 +1,87 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestKeepaliveMatcherRawFrame(t *testing.T) {
+	for _, hb := range []bool{true, false} {
+		up := &aws.Upgrader{
+			Upgrader:     &websocket.Upgrader{},
+			PingInterval: 30 * time.Millisecond,
+			PongTimeout:  60 * time.Millisecond,
+			IdleTimeout:  250 * time.Millisecond,
+			KeepaliveMatcher: func(raw json.RawMessage) bool {
+				return bytes.Equal(raw, ([]byte)(`{"type":"heartbeat"}`))
+			},
+		}
+		url, ch := serve(t, up)
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the pongs of the client cannot get through
+		c.SetPingHandler(func(string) error { return nil })
+		go func() {
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		s := <-ch
+		start := time.Now()
+		deadline := time.After(2 * time.Second)
+	loop:
+		for {
+			select {
+			case <-s.Context().Done():
+				break loop
+			case <-deadline:
+				t.Fatal("connection is not closed")
+			case msg := <-s.MessageReader():
+				t.Fatal("heartbeat is delivered", msg)
+			case <-time.After(20 * time.Millisecond):
+				if hb {
+					c.WriteMessage(websocket.TextMessage, ([]byte)(`{"type":"heartbeat"}`))
+				}
+			}
+		}
+		// the heartbeats keep the pong timeout from firing, but they are not application messages for the idle timeout
+		want := aws.ErrPongTimeout
+		if hb {
+			want = aws.ErrIdleTimeout
+		}
+		if cause := context.Cause(s.Context()); !errors.Is(cause, want) {
+			t.Errorf("heartbeat %v, closed after %v by %v", hb, time.Since(start), cause)
+		}
+		if n := s.DroppedCount(); n != 0 {
+			t.Error("heartbeats are dropped", n)
+		}
+		c.Close()
+	}
+}
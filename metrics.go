@@ -0,0 +1,286 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"math"
+	"math/bits"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics receives the events of connections
+// The methods may be called from multiple goroutines concurrently,
+// but they will never be called while holding any internal lock
+// It can also implement DropMetrics to receive the dropped messages
+type Metrics interface {
+	// OnConnect is called after a connection is ready
+	OnConnect()
+	// OnDisconnect is called after a ready connection is closed
+	OnDisconnect(cause error)
+	// OnMessageSent is called for each application message written, n is the size of the message's type and data
+	OnMessageSent(n int)
+	// OnMessageReceived is called for each application message received, n is the size of the message's type and data
+	OnMessageReceived(n int)
+	// OnBatchFlush is called for each frame written, with the count of messages and the size of the frame
+	OnBatchFlush(count int, bytes int)
+	// OnAuthFailure is called when the authorization or re-authorization failed
+	OnAuthFailure(err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) OnConnect()                        {}
+func (nopMetrics) OnDisconnect(cause error)          {}
+func (nopMetrics) OnMessageSent(n int)               {}
+func (nopMetrics) OnMessageReceived(n int)           {}
+func (nopMetrics) OnBatchFlush(count int, bytes int) {}
+func (nopMetrics) OnAuthFailure(err error)           {}
+
+// BatchStats is the statistics of the frames written by a connection, it can be used to tune the batch options
+type BatchStats struct {
+	// Frames is the count of frames written, Messages and Bytes are the total messages and bytes of them
+	// Internal messages are included
+	Frames   int64
+	Messages int64
+	Bytes    int64
+	// The following are the counts of non-empty flushes by each trigger
+	// A flush may write multiple frames if the batch is split by MaxBatchCount or MaxBatchBytes
+	MinTimeoutFlushes int64
+	MaxTimeoutFlushes int64
+	// SizeFlushes are triggered by MaxBatchCount, MaxBatchBytes or a full SendQueueSize
+	SizeFlushes int64
+	// DeadlineFlushes are triggered by the max delay of SendWithin, or the deadline of the connection's context
+	DeadlineFlushes int64
+	// ManualFlushes are triggered by Flush, including the internal flushes such as pings
+	ManualFlushes int64
+	// ImmediateFlushes are written without waiting, because batching is disabled or by EagerFirstSend
+	ImmediateFlushes int64
+}
+
+// AvgMessages returns the average count of messages per frame
+func (s BatchStats) AvgMessages() float64 {
+	if s.Frames == 0 {
+		return 0
+	}
+	return (float64)(s.Messages) / (float64)(s.Frames)
+}
+
+// AvgBytes returns the average size of frames
+func (s BatchStats) AvgBytes() float64 {
+	if s.Frames == 0 {
+		return 0
+	}
+	return (float64)(s.Bytes) / (float64)(s.Frames)
+}
+
+type flushTrigger int
+
+const (
+	flushImmediate flushTrigger = iota
+	flushMinTimeout
+	flushMaxTimeout
+	flushSize
+	flushDeadline
+	flushManual
+	flushTriggerCount
+)
+
+type batchCounters struct {
+	frames   atomic.Int64
+	messages atomic.Int64
+	bytes    atomic.Int64
+	flushes  [flushTriggerCount]atomic.Int64
+}
+
+func (c *batchCounters) countFrame(messages int, bytes int) {
+	c.frames.Add(1)
+	c.messages.Add((int64)(messages))
+	c.bytes.Add((int64)(bytes))
+}
+
+// BatchStats returns the statistics of the frames written so far
+// It is safe to call BatchStats while the connection is live, but the counters are not read atomically as a whole
+func (w *WebSocket) BatchStats() BatchStats {
+	c := &w.batchStats
+	return BatchStats{
+		Frames:            c.frames.Load(),
+		Messages:          c.messages.Load(),
+		Bytes:             c.bytes.Load(),
+		MinTimeoutFlushes: c.flushes[flushMinTimeout].Load(),
+		MaxTimeoutFlushes: c.flushes[flushMaxTimeout].Load(),
+		SizeFlushes:       c.flushes[flushSize].Load(),
+		DeadlineFlushes:   c.flushes[flushDeadline].Load(),
+		ManualFlushes:     c.flushes[flushManual].Load(),
+		ImmediateFlushes:  c.flushes[flushImmediate].Load(),
+	}
+}
+
+// sizeBuckets is the count of the buckets of SizeHistogram
+const sizeBuckets = 32
+
+// SizeHistogram is the distribution of the inbound message sizes, it can be used to tune MaxMessageSize and the buffers
+// The sizes are counted in power of two buckets, Buckets[0] counts the empty messages,
+// and Buckets[i] counts the sizes in [2^(i-1), 2^i), except the last one which also counts the larger sizes
+type SizeHistogram struct {
+	Count   int64
+	Sum     int64
+	Max     int64
+	Buckets [sizeBuckets]int64
+}
+
+// Avg returns the average size
+func (h SizeHistogram) Avg() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return (float64)(h.Sum) / (float64)(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket where the quantile q (between 0 and 1) falls,
+// for example Quantile(0.99) is the size which at least 99% of the messages are smaller than or equal to
+// It returns Max if the quantile falls in the last bucket
+func (h SizeHistogram) Quantile(q float64) int64 {
+	if h.Count == 0 {
+		return 0
+	}
+	target := (int64)(math.Ceil(q * (float64)(h.Count)))
+	var n int64
+	for i, c := range h.Buckets {
+		n += c
+		if n >= target && c > 0 {
+			if i == 0 {
+				return 0
+			}
+			if i == sizeBuckets-1 {
+				break
+			}
+			return min((int64)(1)<<i-1, h.Max)
+		}
+	}
+	return h.Max
+}
+
+type sizeCounters struct {
+	count   atomic.Int64
+	sum     atomic.Int64
+	max     atomic.Int64
+	buckets [sizeBuckets]atomic.Int64
+}
+
+// add counts a size, it's only called by the read goroutine
+func (c *sizeCounters) add(n int) {
+	c.count.Add(1)
+	c.sum.Add((int64)(n))
+	if (int64)(n) > c.max.Load() {
+		c.max.Store((int64)(n))
+	}
+	c.buckets[min(bits.Len((uint)(n)), sizeBuckets-1)].Add(1)
+}
+
+// countReceived counts an inbound application message of n bytes, and reports it if it's large
+func (w *WebSocket) countReceived(n int) {
+	w.metrics.OnMessageReceived(n)
+	w.inboundSizes.add(n)
+	if w.largeThreshold > 0 && n > w.largeThreshold && w.onLargeMessage != nil {
+		w.onLargeMessage(n)
+	}
+}
+
+// InboundSizes returns the distribution of the inbound application message sizes so far
+// The counters are not read atomically as a whole
+func (w *WebSocket) InboundSizes() SizeHistogram {
+	c := &w.inboundSizes
+	h := SizeHistogram{
+		Count: c.count.Load(),
+		Sum:   c.sum.Load(),
+		Max:   c.max.Load(),
+	}
+	for i := range c.buckets {
+		h.Buckets[i] = c.buckets[i].Load()
+	}
+	return h
+}
+
+// nopHandler is a slog.Handler discards all records
+type nopHandler struct{}
+
+func (nopHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (nopHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h nopHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h nopHandler) WithGroup(string) slog.Handler           { return h }
+
+// byteCounter counts the bytes read from and written to a connection
+type byteCounter struct {
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+type countConn struct {
+	net.Conn
+	counter *byteCounter
+}
+
+func (c *countConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	c.counter.received.Add((int64)(n))
+	return n, err
+}
+
+func (c *countConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	c.counter.sent.Add((int64)(n))
+	return n, err
+}
+
+// countHijacker wraps the hijacked connection with countConn
+type countHijacker struct {
+	http.ResponseWriter
+	counter *byteCounter
+}
+
+func (h *countHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countConn{Conn: conn, counter: h.counter}, brw, nil
+}
+
+// countDial wraps the dial function to count the bytes of the dialed connections
+// If dial is nil, net.Dialer will be used
+func countDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), counter *byteCounter) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countConn{Conn: conn, counter: counter}, nil
+	}
+}
@@ -0,0 +1,70 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type originPattern struct {
+	scheme string
+	host   string
+}
+
+// AllowOrigins returns a function which can be used as websocket.Upgrader.CheckOrigin
+// Each origin can be in the form of "scheme://host[:port]" or "host[:port]", the scheme is not checked if it's omitted
+// The host can contain "*" wildcards, for example "https://*.example.com", and a single "*" allows any origin
+// Requests without the Origin header are allowed since they are not sent by browsers, and same origin requests are always allowed
+func AllowOrigins(origins ...string) func(*http.Request) bool {
+	patterns := make([]originPattern, 0, len(origins))
+	for _, o := range origins {
+		o = strings.ToLower(o)
+		var p originPattern
+		if scheme, host, ok := strings.Cut(o, "://"); ok {
+			p.scheme, p.host = scheme, host
+		} else {
+			p.host = o
+		}
+		patterns = append(patterns, p)
+	}
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+		if host == strings.ToLower(req.Host) {
+			return true
+		}
+		for _, p := range patterns {
+			if p.scheme != "" && p.scheme != "*" && p.scheme != scheme {
+				continue
+			}
+			if ok, _ := path.Match(p.host, host); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,123 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewPipe creates a pair of connected WebSockets backed by an in-memory net.Pipe
+// The server side is upgraded by u and the client side is dialed by d,
+// so the authorization, ping/pong and batching work the same as real connections
+// If u or d is nil, a zero config without authorization will be used
+// ctx only controls the handshake process
+// It's useful for testing the code built on top of WebSocket without the network
+func NewPipe(ctx context.Context, u *Upgrader, d *Dialer) (server, client *WebSocket, err error) {
+	if u == nil {
+		u = &Upgrader{Upgrader: new(websocket.Upgrader)}
+	}
+	var dialer Dialer
+	if d != nil {
+		dialer = *d
+	}
+	sconn, cconn := net.Pipe()
+	if dialer.Dialer != nil {
+		copied := *dialer.Dialer
+		dialer.Dialer = &copied
+	} else {
+		dialer.Dialer = new(websocket.Dialer)
+	}
+	dialer.Dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+		return cconn, nil
+	}
+	dialer.Dialer.NetDialTLSContext = nil
+	dialer.Dialer.Proxy = nil
+
+	type upgradeResult struct {
+		w   *WebSocket
+		err error
+	}
+	resCh := make(chan upgradeResult, 1)
+	go func() {
+		br := bufio.NewReader(sconn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			sconn.Close()
+			resCh <- upgradeResult{nil, err}
+			return
+		}
+		rw := &pipeResponseWriter{conn: sconn, br: br, header: make(http.Header)}
+		w, err := u.Upgrade(rw, req.WithContext(context.Background()), nil)
+		if err != nil {
+			sconn.Close()
+		}
+		resCh <- upgradeResult{w, err}
+	}()
+	client, _, err = dialer.DialContext(ctx, "ws://pipe/", nil)
+	res := <-resCh
+	if err != nil {
+		if res.w != nil {
+			res.w.Abort()
+		}
+		return nil, nil, err
+	}
+	if res.err != nil {
+		client.Abort()
+		return nil, nil, res.err
+	}
+	return res.w, client, nil
+}
+
+// pipeResponseWriter is a minimal http.ResponseWriter which can be hijacked
+type pipeResponseWriter struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	header      http.Header
+	wroteHeader bool
+}
+
+var _ http.Hijacker = (*pipeResponseWriter)(nil)
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.header.Set("Connection", "close")
+	fmt.Fprintf(w.conn, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+	w.header.Write(w.conn)
+	fmt.Fprint(w.conn, "\r\n")
+}
+
+func (w *pipeResponseWriter) Write(buf []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.conn.Write(buf)
+}
+
+func (w *pipeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(w.br, bufio.NewWriter(w.conn)), nil
+}
@@ -0,0 +1,139 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// PreparedMessage is a message whose data is encoded only once for each codec,
+// so the same message can be sent to many connections without marshalling it again
+// The data is still marshalled for each connection which has OnSend set
+// It is safe to use a PreparedMessage from multiple goroutines
+type PreparedMessage struct {
+	typ  string
+	data any
+
+	mux   sync.Mutex
+	cache map[Codec]*preparedData
+}
+
+type preparedData struct {
+	msg *Message
+	// frame is the message encoded by JSONCodec, it's written directly if the message is not sequenced
+	frame []byte
+	err   error
+}
+
+// NewPreparedMessage creates a PreparedMessage
+// data is marshalled lazily when the message is sent with a codec for the first time,
+// so it must not be modified after NewPreparedMessage
+func NewPreparedMessage(typ string, data any) *PreparedMessage {
+	return &PreparedMessage{
+		typ:  typ,
+		data: data,
+	}
+}
+
+// Type returns the message type
+func (m *PreparedMessage) Type() string {
+	return m.typ
+}
+
+func (m *PreparedMessage) prepare(codec Codec) (*preparedData, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if d, ok := m.cache[codec]; ok {
+		return d, d.err
+	}
+	if m.cache == nil {
+		m.cache = make(map[Codec]*preparedData, 1)
+	}
+	d := new(preparedData)
+	m.cache[codec] = d
+	buf, err := codec.Marshal(m.data)
+	if err != nil {
+		d.err = err
+		return d, err
+	}
+	d.msg = &Message{
+		Type: m.typ,
+		Data: (json.RawMessage)(buf),
+	}
+	if codec == JSONCodec {
+		var frame bytes.Buffer
+		if err := JSONCodec.NewEncoder(&frame).Encode(d.msg); err == nil {
+			d.frame = frame.Bytes()
+		}
+	}
+	return d, nil
+}
+
+func (w *WebSocket) preparedPending(m *PreparedMessage) (*pendingMessage, error) {
+	if w.onSend != nil {
+		// OnSend may return different values for each connection
+		msg, err := w.buildMessage(m.typ, m.data)
+		if err != nil {
+			return nil, err
+		}
+		return &pendingMessage{msg: msg}, nil
+	}
+	d, err := m.prepare(w.codec)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingMessage{
+		msg:   d.msg,
+		frame: d.frame,
+	}, nil
+}
+
+// WritePreparedMessage calls WritePreparedMessageContext with context.Background()
+func (w *WebSocket) WritePreparedMessage(m *PreparedMessage) error {
+	return w.WritePreparedMessageContext(context.Background(), m)
+}
+
+// WritePreparedMessageContext is same as WriteMessageContext, but the data is encoded only once for all connections
+// The message is batched with other messages as usual
+func (w *WebSocket) WritePreparedMessageContext(ctx context.Context, m *PreparedMessage) error {
+	p, err := w.preparedPending(m)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+	return w.enqueueContext(ctx, p)
+}
+
+// SendPrepared calls SendPreparedContext with context.Background()
+func (w *WebSocket) SendPrepared(m *PreparedMessage) error {
+	return w.SendPreparedContext(context.Background(), m)
+}
+
+// SendPreparedContext is same as SendContext, but the data is encoded only once for all connections
+func (w *WebSocket) SendPreparedContext(ctx context.Context, m *PreparedMessage) error {
+	p, err := w.preparedPending(m)
+	if err != nil {
+		return err
+	}
+	p.done = make(chan error, 1)
+	return w.enqueueAndWait(ctx, p)
+}
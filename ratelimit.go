@@ -0,0 +1,142 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrRateLimited is the cause when the opposite sent messages too fast
+var ErrRateLimited = errors.New("Inbound rate limit exceeded")
+
+// ErrControlFlood is the cause when the opposite sent control frames faster than MaxControlFramesPerSec
+var ErrControlFlood = errors.New("Too many control frames")
+
+// RateLimitAction is the action to take when the inbound rate limit is exceeded
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops the messages exceeded the limit
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitClose closes the connection with code 1008 (policy violation) and ErrRateLimited
+	RateLimitClose
+)
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+func newTokenBucket(clock Clock, rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  (float64)(burst),
+		tokens: (float64)(burst),
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := b.clock.Now()
+	// a clock going backward must not take the tokens away
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+	}
+	b.last = now
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// reserve takes n tokens even if there are not enough, and returns how long to wait until the debt is paid
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.refill()
+	b.tokens -= (float64)(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return (time.Duration)(-b.tokens / b.rate * (float64)(time.Second))
+}
+
+func (b *tokenBucket) allow() bool {
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowInbound reports whether an inbound message should be processed
+// It must only be called from the read goroutine
+func (w *WebSocket) allowInbound() bool {
+	if !w.limiterActive.Load() || w.inboundLimiter.allow() {
+		return true
+	}
+	w.countDrop(dropRateLimited, 1)
+	if w.rateLimitAction == RateLimitClose {
+		go w.closeWithCause(websocket.ClosePolicyViolation, "rate limit exceeded", ErrRateLimited)
+	}
+	return false
+}
+
+// allowControl reports whether an inbound ping or pong frame should be processed
+// It's called by the ping and pong handlers, which run in the read goroutine
+func (w *WebSocket) allowControl() bool {
+	if w.controlFlooded {
+		return false
+	}
+	if w.controlLimiter != nil && !w.controlLimiter.allow() {
+		w.controlFlooded = true
+		w.logger.Warn("Too many control frames")
+		go w.closeWithCause(websocket.ClosePolicyViolation, "too many control frames", ErrControlFlood)
+		return false
+	}
+	w.controlFrames++
+	return w.maxControlFrames <= 0 || w.controlFrames <= w.maxControlFrames
+}
+
+// pace waits until the outbound rate limit allows writing a frame of n bytes
+// The frames of only internal messages are counted but not delayed, so the keepalive is not affected
+// It must only be called from the write goroutine
+func (w *WebSocket) pace(n int, wait bool) error {
+	if w.outboundLimiter == nil {
+		return nil
+	}
+	delay := w.outboundLimiter.reserve(n)
+	if delay <= 0 || !wait {
+		return nil
+	}
+	timer := w.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-w.ctx.Done():
+		return w.closedError()
+	}
+}
@@ -0,0 +1,65 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestRateLimitInternalMessages(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:         &websocket.Upgrader{},
+		Clock:            newFakeClock(),
+		PingInterval:     1000 * time.Hour,
+		InboundRateLimit: 1,
+		InboundBurst:     1,
+	}
+	s, c := pair(t, up, &aws.Dialer{})
+	s.Handle("echo", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return params, nil
+	})
+	c.Send("a", 1)
+	if msg := readWithin(s, time.Second); msg == nil || msg.Type != "a" {
+		t.Fatal(msg)
+	}
+	// the token is taken and never refilled by the fake clock, but the calls are not limited
+	for i := range 5 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		res, err := c.Call(ctx, "echo", i)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := json.Unmarshal(res, &n); err != nil || n != i {
+			t.Fatal("unexpected result", (string)(res), err)
+		}
+	}
+	c.Send("b", 1)
+	if msg := readWithin(s, 100*time.Millisecond); msg != nil {
+		t.Fatal("application message is not limited", msg)
+	}
+	if n := s.DroppedByReason()[aws.DropRateLimited]; n != 1 {
+		t.Fatal("dropped", n)
+	}
+}
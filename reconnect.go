@@ -0,0 +1,346 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrDisconnected is returned when sending with a ReconnectingClient which is reconnecting,
+// and the message cannot be buffered
+var ErrDisconnected = errors.New("Disconnected, reconnecting")
+
+// ConnState is the state of a ReconnectingClient
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ReconnectingClient keeps a connection dialed by Dialer, and re-dials with exponential backoff when it's dropped
+// The auth handshake is performed with each new connection
+// The zero value is not usable, at least Dialer and URL must be set, and the fields must not be changed after Connect
+type ReconnectingClient struct {
+	// Dialer should never be nil
+	Dialer *Dialer
+	URL    string
+	Header http.Header
+
+	// MinBackoff and MaxBackoff bound the delays between the dial attempts, default are 500ms and 30s
+	// The delay is doubled after each failed attempt, with a random jitter
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetries is the max failed attempts in a row before the client is closed, zero means no limit
+	MaxRetries int
+	// ShouldRetry reports whether to re-dial after a dial failure, default is always
+	ShouldRetry func(err error) bool
+	// Resume resumes the session of the dropped connection if the remote supports session resumption
+	Resume bool
+	// BufferSize is the max messages buffered while disconnected, they are sent after reconnected in order
+	// Zero means the messages are rejected with ErrDisconnected while disconnected
+	BufferSize int
+	// OnStateChange is called when the state is changed, err is the cause of disconnection or dial failure
+	// It's called from the reconnect goroutine and should not block
+	OnStateChange func(state ConnState, err error)
+
+	mux    sync.Mutex
+	conn   *WebSocket
+	state  ConnState
+	buffer []bufferedMessage
+	readCh chan *Message
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+type bufferedMessage struct {
+	typ  string
+	data any
+}
+
+// Connect dials the first connection, then reconnects in the background until Close is called
+// ctx only controls the first dial
+func (c *ReconnectingClient) Connect(ctx context.Context) error {
+	c.readCh = make(chan *Message, 8)
+	c.ctx, c.cancel = context.WithCancelCause(context.Background())
+	c.done = make(chan struct{})
+	c.setState(StateConnecting, nil, nil)
+	w, _, err := c.Dialer.DialContext(ctx, c.URL, c.Header)
+	if err != nil {
+		c.cancel(err)
+		close(c.done)
+		c.setState(StateClosed, nil, err)
+		return err
+	}
+	c.setState(StateConnected, w, nil)
+	go c.run(w)
+	return nil
+}
+
+// Conn returns the current connection, it's nil while disconnected
+func (c *ReconnectingClient) Conn() *WebSocket {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.conn
+}
+
+// State returns the current state
+func (c *ReconnectingClient) State() ConnState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state
+}
+
+// Done returns a channel which is closed after the client is closed
+func (c *ReconnectingClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close stops reconnecting, and closes the current connection
+func (c *ReconnectingClient) Close() error {
+	c.cancel(ErrClosed)
+	var err error
+	if w := c.Conn(); w != nil {
+		err = w.Close()
+	}
+	<-c.done
+	return err
+}
+
+func (c *ReconnectingClient) setState(state ConnState, w *WebSocket, err error) {
+	c.mux.Lock()
+	c.state = state
+	c.conn = w
+	c.mux.Unlock()
+	if c.OnStateChange != nil {
+		c.OnStateChange(state, err)
+	}
+}
+
+func (c *ReconnectingClient) run(w *WebSocket) {
+	defer close(c.done)
+	clock := c.Dialer.Clock
+	if clock == nil {
+		clock = RealClock
+	}
+	minBackoff, maxBackoff := c.MinBackoff, c.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = time.Millisecond * 500
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = max(minBackoff, time.Second*30)
+	}
+	for {
+		c.forward(w)
+		if c.ctx.Err() != nil {
+			c.setState(StateClosed, nil, nil)
+			return
+		}
+		c.setState(StateDisconnected, nil, context.Cause(w.Context()))
+		backoff := minBackoff
+		for failed := 0; ; {
+			c.setState(StateConnecting, nil, nil)
+			nw, err := c.dial(w)
+			if err == nil {
+				w = nw
+				break
+			}
+			if c.ctx.Err() != nil {
+				c.setState(StateClosed, nil, nil)
+				return
+			}
+			failed++
+			if (c.MaxRetries > 0 && failed >= c.MaxRetries) || (c.ShouldRetry != nil && !c.ShouldRetry(err)) {
+				c.cancel(err)
+				c.setState(StateClosed, nil, err)
+				return
+			}
+			c.setState(StateDisconnected, nil, err)
+			timer := clock.NewTimer(backoff/2 + rand.N(backoff/2+1))
+			select {
+			case <-timer.C():
+			case <-c.ctx.Done():
+				timer.Stop()
+				c.setState(StateClosed, nil, nil)
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+		if !c.connected(w) {
+			w.Close()
+			c.setState(StateClosed, nil, nil)
+			return
+		}
+	}
+}
+
+func (c *ReconnectingClient) dial(prev *WebSocket) (*WebSocket, error) {
+	var (
+		w   *WebSocket
+		err error
+	)
+	if c.Resume {
+		w, _, err = c.Dialer.ResumeContext(c.ctx, c.URL, c.Header, prev.Session())
+	} else {
+		w, _, err = c.Dialer.DialContext(c.ctx, c.URL, c.Header)
+	}
+	return w, err
+}
+
+// connected sends the buffered messages with the new connection, then marks the client as connected
+// It returns false if the client is closed
+func (c *ReconnectingClient) connected(w *WebSocket) bool {
+	c.mux.Lock()
+	if c.ctx.Err() != nil {
+		c.mux.Unlock()
+		return false
+	}
+	buffer := c.buffer
+	c.buffer = nil
+	// the lock is held, so new messages are sent after the buffered ones
+	for _, m := range buffer {
+		if msg, err := w.buildMessage(m.typ, m.data); err == nil {
+			w.enqueue(&pendingMessage{msg: msg})
+		}
+	}
+	c.state = StateConnected
+	c.conn = w
+	c.mux.Unlock()
+	if c.OnStateChange != nil {
+		c.OnStateChange(StateConnected, nil)
+	}
+	return true
+}
+
+// forward delivers the messages received by the connection until it's closed
+func (c *ReconnectingClient) forward(w *WebSocket) {
+	for {
+		select {
+		case msg, ok := <-w.MessageReader():
+			if !ok {
+				// the read side is closed, wait for the connection
+				select {
+				case <-w.Context().Done():
+				case <-c.ctx.Done():
+				}
+				return
+			}
+			select {
+			case c.readCh <- msg:
+			case <-c.ctx.Done():
+				return
+			}
+		case <-w.Context().Done():
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// MessageReader returns the channel of the messages received from all connections
+// The channel is never closed, use Done to check whether the client is closed
+func (c *ReconnectingClient) MessageReader() <-chan *Message {
+	return c.readCh
+}
+
+// ReadMessage calls ReadMessageContext with context.Background()
+func (c *ReconnectingClient) ReadMessage() (*Message, error) {
+	return c.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext receives a message from any connection
+// It returns ErrClosed after the client is closed
+func (c *ReconnectingClient) ReadMessageContext(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-c.readCh:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case <-c.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// Send calls SendContext with context.Background()
+func (c *ReconnectingClient) Send(typ string, data any) error {
+	return c.SendContext(context.Background(), typ, data)
+}
+
+// SendContext sends the message with the current connection, and waits until the message is flushed
+// While disconnected, the message is buffered and SendContext returns immediately,
+// or ErrDisconnected is returned if the buffer is full or BufferSize is zero
+// The buffered data is encoded after reconnected, so it must not be modified after SendContext returns
+func (c *ReconnectingClient) SendContext(ctx context.Context, typ string, data any) error {
+	w, err := c.connOrBuffer(typ, data)
+	if w == nil {
+		return err
+	}
+	return w.SendContext(ctx, typ, data)
+}
+
+// WriteMessage is same as Send, but it does not wait for the message to be flushed
+func (c *ReconnectingClient) WriteMessage(typ string, data any) error {
+	w, err := c.connOrBuffer(typ, data)
+	if w == nil {
+		return err
+	}
+	return w.WriteMessage(typ, data)
+}
+
+// connOrBuffer returns the current connection, or buffers the message if it's disconnected
+func (c *ReconnectingClient) connOrBuffer(typ string, data any) (*WebSocket, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	if c.conn != nil && !c.conn.IsClosed() {
+		return c.conn, nil
+	}
+	if len(c.buffer) >= c.BufferSize {
+		return nil, ErrDisconnected
+	}
+	// the data is encoded by the next connection, since the codec may be different
+	c.buffer = append(c.buffer, bufferedMessage{
+		typ:  typ,
+		data: data,
+	})
+	return nil, nil
+}
@@ -0,0 +1,90 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"encoding/json"
+)
+
+// On registers a handler for the application messages of the type
+// The matched messages are dispatched to the handler instead of MessageReader,
+// handlers are called sequentially in the read goroutine, or by the worker pool if DispatchWorkers is set
+// With zero or one worker, the handlers are called one by one in the receive order
+// data is encoded by the connection's codec
+// A nil handler removes the registered one
+func (w *WebSocket) On(typ string, handler func(data json.RawMessage)) {
+	w.routeMux.Lock()
+	defer w.routeMux.Unlock()
+	if handler == nil {
+		delete(w.routes, typ)
+		return
+	}
+	if w.routes == nil {
+		w.routes = make(map[string]func(json.RawMessage))
+	}
+	w.routes[typ] = handler
+}
+
+// OnDefault registers a handler for the application messages which do not match any handler registered by On
+// If it's nil, the unmatched messages are delivered to MessageReader
+func (w *WebSocket) OnDefault(handler func(msg *Message)) {
+	w.routeMux.Lock()
+	defer w.routeMux.Unlock()
+	w.defaultRoute = handler
+}
+
+// route returns the handler of the message, or nil if it should be delivered to MessageReader
+func (w *WebSocket) route(msg *Message) func() {
+	w.routeMux.RLock()
+	defer w.routeMux.RUnlock()
+	if handler := w.routes[msg.Type]; handler != nil {
+		return w.traceReceive(msg, func() { handler(msg.Data) })
+	}
+	if handler := w.defaultRoute; handler != nil {
+		return w.traceReceive(msg, func() { handler(msg) })
+	}
+	return nil
+}
+
+// dispatch calls the handler in the read goroutine, or passes it to the worker pool
+// It returns false if the connection is closed or the read side is stopped before the handler is accepted
+func (w *WebSocket) dispatch(handler func()) bool {
+	if w.dispatchCh == nil {
+		handler()
+		return true
+	}
+	select {
+	case w.dispatchCh <- handler:
+		return true
+	case <-w.readStop:
+		return false
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+func (w *WebSocket) dispatchWorker() {
+	defer w.recoverPanic()
+	for {
+		select {
+		case handler := <-w.dispatchCh:
+			handler()
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
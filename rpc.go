@@ -0,0 +1,156 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+)
+
+type callMessage struct {
+	Id     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type resultMessage struct {
+	Id     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type CallHandler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// CallError is returned by Call when the opposite's handler returned an error
+type CallError struct {
+	Method  string
+	Message string
+}
+
+func (e *CallError) Error() string {
+	return "call " + e.Method + ": " + e.Message
+}
+
+// Call invokes the method registered by Handle on the opposite, and waits for the result
+// The returned data is encoded by the connection's codec
+func (w *WebSocket) Call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	buf, err := w.codec.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	resCh := make(chan *resultMessage, 1)
+	w.callMux.Lock()
+	w.callId++
+	id := w.callId
+	if w.calls == nil {
+		w.calls = make(map[uint64]chan<- *resultMessage)
+	}
+	w.calls[id] = resCh
+	w.callMux.Unlock()
+	defer func() {
+		w.callMux.Lock()
+		delete(w.calls, id)
+		w.callMux.Unlock()
+	}()
+
+	if err := w.WriteMessageContext(ctx, "$call", &callMessage{
+		Id:     id,
+		Method: method,
+		Params: (json.RawMessage)(buf),
+	}); err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-resCh:
+		if res.Error != "" {
+			return nil, &CallError{Method: method, Message: res.Error}
+		}
+		return res.Result, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case <-w.ctx.Done():
+		return nil, w.closedError()
+	}
+}
+
+// Handle registers a handler for the method which can be invoked by the opposite's Call
+// The handler is called in a new goroutine, and its context is cancelled when the connection is closed
+// A method can only have one handler, it replaces the one registered by HandleStream
+// A nil handler removes the registered one
+func (w *WebSocket) Handle(method string, handler CallHandler) {
+	w.handlerMux.Lock()
+	defer w.handlerMux.Unlock()
+	delete(w.streamHandlers, method)
+	if handler == nil {
+		delete(w.handlers, method)
+		return
+	}
+	if w.handlers == nil {
+		w.handlers = make(map[string]CallHandler)
+	}
+	w.handlers[method] = handler
+}
+
+func (w *WebSocket) handleCall(msg *Message) {
+	var call callMessage
+	if err := w.ParseMessage(msg, &call); err != nil {
+		return
+	}
+	w.handlerMux.RLock()
+	handler := w.handlers[call.Method]
+	streamHandler := w.streamHandlers[call.Method]
+	w.handlerMux.RUnlock()
+	if streamHandler != nil {
+		go w.serveStream(&call, streamHandler)
+		return
+	}
+	if handler == nil {
+		w.writeInternal("$result", &resultMessage{
+			Id:    call.Id,
+			Error: "method not found",
+		})
+		return
+	}
+	go func() {
+		defer w.recoverPanic()
+		res := &resultMessage{Id: call.Id}
+		if result, err := handler(w.ctx, call.Params); err != nil {
+			res.Error = err.Error()
+		} else if buf, err := w.codec.Marshal(result); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Result = (json.RawMessage)(buf)
+		}
+		w.writeInternal("$result", res)
+	}()
+}
+
+func (w *WebSocket) handleResult(msg *Message) {
+	res := new(resultMessage)
+	if err := w.ParseMessage(msg, res); err != nil {
+		return
+	}
+	w.callMux.Lock()
+	resCh := w.calls[res.Id]
+	w.callMux.Unlock()
+	if resCh != nil {
+		select {
+		case resCh <- res:
+		default:
+		}
+	}
+}
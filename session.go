@@ -0,0 +1,389 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned by SessionStore if the session is not exist or expired,
+// or it cannot be resumed because some of the messages are already discarded
+var ErrSessionNotFound = errors.New("Session not found")
+
+// SessionStore keeps the recent outbound messages of the sessions, so a reconnected client can resume the session
+// The methods may be called concurrently
+type SessionStore interface {
+	// Create creates an empty session with the token
+	Create(token string) error
+	// Append appends an outbound message to the session
+	// The messages are appended in the order of Message.Seq, by the write goroutine before they are written,
+	// or when the connection is closed before they are written
+	// It's never called with the queue locked, so it can do network I/O, an error is logged and the message is still sent
+	Append(token string, msg *Message) error
+	// Since returns the messages of the session whose Seq is greater than seq
+	// It should return ErrSessionNotFound if the session cannot be resumed
+	Since(token string, seq uint64) ([]*Message, error)
+}
+
+// BatchSessionStore can be implemented by SessionStore to keep the sequence of the last batch flushed in each session,
+// so a resumed connection continues numbering the batches, see WebSocket.LastBatchSeq
+type BatchSessionStore interface {
+	// SetBatchSeq records the sequence of the last batch flushed in the session
+	SetBatchSeq(token string, seq uint64) error
+	// BatchSeq returns the sequence recorded by SetBatchSeq, or zero if it's never recorded
+	BatchSeq(token string) (uint64, error)
+}
+
+// SessionState is the state needed to resume a session
+type SessionState struct {
+	Token string
+	// Seq is the sequence of the last application message sent (on the server) or received (on the client)
+	Seq uint64
+}
+
+type resumeMessage struct {
+	Token string `json:"token"`
+	Seq   uint64 `json:"seq"`
+}
+
+type authReadyMessage struct {
+	// Session is true if the remote supports session resumption
+	Session bool `json:"session,omitempty"`
+	// Optional is true if the remote does not require an auth message
+	Optional bool `json:"optional,omitempty"`
+	// Binary is true if the remote expects a binary auth message
+	Binary bool `json:"binary,omitempty"`
+}
+
+func newSessionToken() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// Session returns the session state of the connection
+// The token is empty if session resumption is not enabled
+func (w *WebSocket) Session() SessionState {
+	seq := w.recvSeq.Load()
+	if w.sessionStore != nil {
+		seq = w.sendSeq.Load()
+	}
+	return SessionState{
+		Token: w.sessionToken,
+		Seq:   seq,
+	}
+}
+
+// Resumed reports whether the connection resumed a previous session
+func (w *WebSocket) Resumed() bool {
+	return w.resumed
+}
+
+// startSession resumes the session requested by the opposite, or creates a new one
+// It returns the messages need to be replayed
+// The sessions are keyed by the token bound to identity in the store, see sessionKey
+func (w *WebSocket) startSession(store SessionStore, identity string) ([]*Message, error) {
+	var resume *resumeMessage
+	select {
+	case msg := <-w.resumeCh:
+		resume = new(resumeMessage)
+		if err := w.ParseMessage(msg, resume); err != nil {
+			resume = nil
+		}
+	default:
+	}
+	if resume != nil && resume.Token != "" {
+		key := sessionKey(resume.Token, identity)
+		msgs, err := store.Since(key, resume.Seq)
+		if err == nil {
+			seq := resume.Seq
+			if n := len(msgs); n > 0 {
+				seq = msgs[n-1].Seq
+			}
+			if bs, ok := store.(BatchSessionStore); ok {
+				batchSeq, err := bs.BatchSeq(key)
+				if err != nil {
+					return nil, err
+				}
+				w.restoreBatchSeq(batchSeq)
+			}
+			w.queueMux.Lock()
+			w.sessionToken = resume.Token
+			w.sessionKey = key
+			w.sendSeq.Store(seq)
+			w.queueMux.Unlock()
+			w.resumed = true
+			return msgs, nil
+		}
+		if !errors.Is(err, ErrSessionNotFound) {
+			return nil, err
+		}
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	key := sessionKey(token, identity)
+	if err := store.Create(key); err != nil {
+		return nil, err
+	}
+	w.queueMux.Lock()
+	w.sessionToken = token
+	w.sessionKey = key
+	w.queueMux.Unlock()
+	return nil, nil
+}
+
+// sessionKey returns the key of the session in the store, which binds the token to the auth identity,
+// so the token presented by another identity does not match the session
+func sessionKey(token, identity string) string {
+	if identity == "" {
+		return token
+	}
+	sum := sha256.Sum256(([]byte)(identity))
+	return token + "." + hex.EncodeToString(sum[:16])
+}
+
+// restoreBatchSeq continues numbering the batches from seq, unless more batches are already flushed
+// The write goroutine may be flushing the handshake messages meanwhile, it only advances the sequence by CompareAndSwap
+func (w *WebSocket) restoreBatchSeq(seq uint64) {
+	for {
+		cur := w.batchSeq.Load()
+		if seq <= cur || w.batchSeq.CompareAndSwap(cur, seq) {
+			return
+		}
+	}
+}
+
+// saveBatchSeq records the sequence of the last batch flushed if the session store implements BatchSessionStore
+func (w *WebSocket) saveBatchSeq(seq uint64) {
+	bs, ok := w.sessionStore.(BatchSessionStore)
+	if !ok {
+		return
+	}
+	w.queueMux.Lock()
+	key := w.sessionKey
+	w.queueMux.Unlock()
+	if key == "" {
+		return
+	}
+	if err := bs.SetBatchSeq(key, seq); err != nil {
+		w.logger.Debug("Failed to save the batch sequence", "err", err)
+	}
+}
+
+// sequenced reports whether the outbound application messages are sequenced
+func (w *WebSocket) sequenced() bool {
+	return w.sessionStore != nil || w.ackInterval > 0
+}
+
+// sequence assigns the next sequence to an application message,
+// and appends it to the unacknowledged messages and the messages waiting for appendSession
+// It returns ErrSlowConsumer if the unacknowledged messages exceed the limit
+// It must be called with queueMux locked
+func (w *WebSocket) sequence(p *pendingMessage) error {
+	if !w.sequenced() || p.msg == nil || p.msg.Seq != 0 || (len(p.msg.Type) > 0 && p.msg.Type[0] == '$') {
+		return nil
+	}
+	msg := *p.msg
+	msg.Seq = w.sendSeq.Load() + 1
+	if w.ackInterval > 0 {
+		limit := w.maxUnacked
+		if limit == 0 {
+			limit = defaultMaxUnacked
+		}
+		if limit > 0 && len(w.unacked) >= limit {
+			return ErrSlowConsumer
+		}
+		w.unacked = append(w.unacked, &msg)
+	}
+	if w.sessionStore != nil {
+		w.sessionAppends = append(w.sessionAppends, &msg)
+	}
+	w.sendSeq.Store(msg.Seq)
+	p.msg = &msg
+	return nil
+}
+
+// appendAfterClosed appends the messages sequenced after the write goroutine may have exited
+func (w *WebSocket) appendAfterClosed() {
+	if w.sessionStore != nil && (w.ctx.Err() != nil || w.writeClosed.Load()) {
+		w.appendSession()
+	}
+}
+
+// appendSession appends the sequenced messages to the session store
+// It must not be called with queueMux locked, since the store may do network I/O
+func (w *WebSocket) appendSession() {
+	if w.sessionStore == nil {
+		return
+	}
+	w.appendMux.Lock()
+	defer w.appendMux.Unlock()
+	w.queueMux.Lock()
+	msgs, key := w.sessionAppends, w.sessionKey
+	w.sessionAppends = nil
+	w.queueMux.Unlock()
+	for _, msg := range msgs {
+		if err := w.sessionStore.Append(key, msg); err != nil {
+			w.logger.Warn("Failed to append the message to the session", "seq", msg.Seq, "err", err)
+		}
+	}
+}
+
+// MemorySessionStore is a SessionStore keeps the sessions in memory
+type MemorySessionStore struct {
+	size int
+	ttl  time.Duration
+
+	mux      sync.Mutex
+	sessions map[string]*memorySession
+	purgedAt time.Time
+}
+
+var (
+	_ SessionStore      = (*MemorySessionStore)(nil)
+	_ BatchSessionStore = (*MemorySessionStore)(nil)
+)
+
+type memorySession struct {
+	msgs     []*Message
+	lastSeq  uint64
+	batchSeq uint64
+	expireAt time.Time
+}
+
+// NewMemorySessionStore creates a MemorySessionStore keeps the last size messages of each session
+// A session expires if it's not active within ttl
+// The default size is 64, and the default ttl is one minute
+func NewMemorySessionStore(size int, ttl time.Duration) *MemorySessionStore {
+	if size <= 0 {
+		size = 64
+	}
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &MemorySessionStore{
+		size:     size,
+		ttl:      ttl,
+		sessions: make(map[string]*memorySession),
+		purgedAt: time.Now(),
+	}
+}
+
+func (s *MemorySessionStore) Create(token string) error {
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if now.Sub(s.purgedAt) > s.ttl {
+		s.purgedAt = now
+		for t, sess := range s.sessions {
+			if now.After(sess.expireAt) {
+				delete(s.sessions, t)
+			}
+		}
+	}
+	s.sessions[token] = &memorySession{
+		expireAt: now.Add(s.ttl),
+	}
+	return nil
+}
+
+// get returns the session if it's not expired, it must be called with mux locked
+func (s *MemorySessionStore) get(token string) *memorySession {
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(sess.expireAt) {
+		delete(s.sessions, token)
+		return nil
+	}
+	sess.expireAt = now.Add(s.ttl)
+	return sess
+}
+
+func (s *MemorySessionStore) Append(token string, msg *Message) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sess := s.get(token)
+	if sess == nil {
+		return ErrSessionNotFound
+	}
+	if len(sess.msgs) >= s.size {
+		copy(sess.msgs, sess.msgs[len(sess.msgs)-s.size+1:])
+		sess.msgs = sess.msgs[:s.size-1]
+	}
+	sess.msgs = append(sess.msgs, msg)
+	sess.lastSeq = msg.Seq
+	return nil
+}
+
+func (s *MemorySessionStore) Since(token string, seq uint64) ([]*Message, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sess := s.get(token)
+	if sess == nil || seq > sess.lastSeq {
+		return nil, ErrSessionNotFound
+	}
+	if seq == sess.lastSeq {
+		return nil, nil
+	}
+	if len(sess.msgs) == 0 || sess.msgs[0].Seq > seq+1 {
+		return nil, ErrSessionNotFound
+	}
+	i := (int)(seq + 1 - sess.msgs[0].Seq)
+	msgs := make([]*Message, len(sess.msgs)-i)
+	copy(msgs, sess.msgs[i:])
+	return msgs, nil
+}
+
+func (s *MemorySessionStore) SetBatchSeq(token string, seq uint64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sess := s.get(token)
+	if sess == nil {
+		return ErrSessionNotFound
+	}
+	sess.batchSeq = seq
+	return nil
+}
+
+func (s *MemorySessionStore) BatchSeq(token string) (uint64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sess := s.get(token)
+	if sess == nil {
+		return 0, ErrSessionNotFound
+	}
+	return sess.batchSeq, nil
+}
+
+// Delete removes the session
+func (s *MemorySessionStore) Delete(token string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.sessions, token)
+}
@@ -0,0 +1,236 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestResumeBatchSeq(t *testing.T) {
+	up := &aws.Upgrader{Upgrader: &websocket.Upgrader{}, SessionStore: aws.NewMemorySessionStore(16, time.Minute)}
+	url, ch := serve(t, up)
+	d := &aws.Dialer{Dialer: websocket.DefaultDialer}
+	c, _, err := d.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-ch
+	for i := range 5 {
+		if err := s.WriteMessage("n", i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := s.LastBatchSeq()
+	if last < 5 {
+		t.Fatalf("only %d batches are flushed", last)
+	}
+	st := c.Session()
+	c.WebSocket().UnderlyingConn().Close()
+	<-s.Context().Done()
+
+	c2, _, err := d.Resume(url, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if !c2.Resumed() {
+		t.Fatal("not resumed")
+	}
+	s2 := <-ch
+	defer s2.Close()
+	if err := s2.WriteMessage("n", 5); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c2.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Batch <= last {
+		t.Fatalf("batch sequence %d is not continued from %d", m.Batch, last)
+	}
+	if seq := s2.LastBatchSeq(); seq != m.Batch {
+		t.Fatalf("LastBatchSeq is %d, expect %d", seq, m.Batch)
+	}
+}
+
+func TestResumeOtherIdentity(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:     &websocket.Upgrader{},
+		SessionStore: aws.NewMemorySessionStore(16, time.Minute),
+		Authorizer: func(msg json.RawMessage) (any, error) {
+			var user string
+			err := json.Unmarshal(msg, &user)
+			return user, err
+		},
+	}
+	url, ch := serve(t, up)
+	dialer := func(user string) *aws.Dialer {
+		return &aws.Dialer{
+			Dialer: websocket.DefaultDialer,
+			AuthProvider: func(context.Context) (json.RawMessage, error) {
+				return json.Marshal(user)
+			},
+		}
+	}
+	c, _, err := dialer("alice").Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-ch
+	if err := s.WriteMessage("secret", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	st := c.Session()
+	c.WebSocket().UnderlyingConn().Close()
+	<-s.Context().Done()
+
+	other, _, err := dialer("bob").Resume(url, nil, aws.SessionState{Token: st.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	(<-ch).Close()
+	if other.Resumed() {
+		t.Fatal("session is resumed by another identity")
+	}
+	if other.Session().Token == st.Token {
+		t.Fatal("session token is reused by another identity")
+	}
+
+	c2, _, err := dialer("alice").Resume(url, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	(<-ch).Close()
+	if !c2.Resumed() {
+		t.Fatal("session is not resumed by the same identity")
+	}
+}
+
+// blockingStore blocks Append until release is closed once block is set, like a store over the network
+type blockingStore struct {
+	*aws.MemorySessionStore
+	block    atomic.Bool
+	appended chan uint64
+	release  chan struct{}
+}
+
+func (s *blockingStore) Append(token string, msg *aws.Message) error {
+	if s.block.Load() {
+		s.appended <- msg.Seq
+		<-s.release
+	}
+	return s.MemorySessionStore.Append(token, msg)
+}
+
+func TestSessionAppendOutsideLock(t *testing.T) {
+	store := &blockingStore{
+		MemorySessionStore: aws.NewMemorySessionStore(16, time.Minute),
+		appended:           make(chan uint64, 16),
+		release:            make(chan struct{}),
+	}
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}, SessionStore: store}, &aws.Dialer{})
+	release := sync.OnceFunc(func() { close(store.release) })
+	defer release()
+	store.block.Store(true)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.Send("a", 1)
+	}()
+	select {
+	case <-store.appended:
+	case <-time.After(time.Second):
+		t.Fatal("message is not appended")
+	}
+	// the queue must not be locked while the store is appending
+	queued := make(chan bool, 1)
+	go func() {
+		s.PendingCount()
+		queued <- s.TrySend("b", 2)
+	}()
+	select {
+	case ok := <-queued:
+		if !ok {
+			t.Fatal("message is not queued")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queue is locked by Append")
+	}
+	release()
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []string{"a", "b"} {
+		msg, err := c.ReadMessage()
+		if err != nil || msg.Type != typ {
+			t.Fatal(msg, err)
+		}
+	}
+}
+
+func TestResumeUnflushed(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:        &websocket.Upgrader{},
+		SessionStore:    aws.NewMemorySessionStore(16, time.Minute),
+		MinBatchTimeout: time.Hour,
+		MaxBatchTimeout: time.Hour,
+	}
+	url, ch := serve(t, up)
+	d := &aws.Dialer{Dialer: websocket.DefaultDialer}
+	c, _, err := d.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-ch
+	go s.Send("lost", 1)
+	for s.PendingCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	st := c.Session()
+	s.Abort()
+	c.Close()
+
+	c2, _, err := d.Resume(url, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if !c2.Resumed() {
+		t.Fatal("not resumed")
+	}
+	s2 := <-ch
+	defer s2.Close()
+	msg, err := c2.ReadMessage()
+	if err != nil || msg.Type != "lost" || msg.Seq != 1 {
+		t.Fatal("unflushed message is not replayed", msg, err)
+	}
+}
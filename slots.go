@@ -0,0 +1,170 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"sync"
+)
+
+// sendSlots is the fair semaphore of the bounded send queue
+// The callers take tickets in the order they arrived, the slots are granted and the messages are queued in the ticket order,
+// so a producer cannot be overtaken by the later ones, and the messages are queued in the same order as the slots are taken
+type sendSlots struct {
+	mux     sync.Mutex
+	free    int
+	waiters []*slotWaiter
+	// next is the next ticket to take, and turn is the ticket which can queue its message now
+	next      uint64
+	turn      uint64
+	turnCond  sync.Cond
+	abandoned map[uint64]struct{}
+}
+
+type slotWaiter struct {
+	ticket  uint64
+	granted bool
+	ready   chan struct{}
+}
+
+func newSendSlots(size int) *sendSlots {
+	s := &sendSlots{
+		free:      size,
+		abandoned: make(map[uint64]struct{}),
+	}
+	s.turnCond.L = &s.mux
+	return s
+}
+
+// acquire waits until a slot is granted, then waits for the ticket's turn to queue the message
+// If it returns nil, done must be called after the message is queued
+func (s *sendSlots) acquire(ctx context.Context, closed <-chan struct{}, closedErr func() error) (done func(), err error) {
+	s.mux.Lock()
+	ticket := s.next
+	s.next++
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		s.waitTurn(ticket)
+		s.mux.Unlock()
+		return func() { s.pass(ticket) }, nil
+	}
+	wt := &slotWaiter{
+		ticket: ticket,
+		ready:  make(chan struct{}),
+	}
+	s.waiters = append(s.waiters, wt)
+	s.mux.Unlock()
+
+	select {
+	case <-wt.ready:
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	case <-closed:
+		err = closedErr()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err != nil {
+		if wt.granted {
+			// the slot is granted at the same time, give it to the next waiter
+			s.releaseLocked()
+		} else {
+			for i, v := range s.waiters {
+				if v == wt {
+					s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		s.finishTurn(ticket)
+		return nil, err
+	}
+	s.waitTurn(ticket)
+	return func() { s.pass(ticket) }, nil
+}
+
+// tryAcquire takes a slot only if there is a free one and no caller is waiting
+func (s *sendSlots) tryAcquire() (done func(), ok bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.free <= 0 || len(s.waiters) > 0 {
+		return nil, false
+	}
+	s.free--
+	ticket := s.next
+	s.next++
+	s.waitTurn(ticket)
+	return func() { s.pass(ticket) }, true
+}
+
+// release returns a slot, which is granted to the earliest waiter if there is one
+func (s *sendSlots) release() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.releaseLocked()
+}
+
+func (s *sendSlots) releaseLocked() {
+	if len(s.waiters) == 0 {
+		s.free++
+		return
+	}
+	wt := s.waiters[0]
+	s.waiters = s.waiters[1:]
+	wt.granted = true
+	close(wt.ready)
+}
+
+// full reports whether all slots are taken
+func (s *sendSlots) full() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.free <= 0
+}
+
+// waitTurn waits until the earlier tickets are passed or abandoned
+// The earlier tickets are already granted since the slots are granted in order, so it only waits for their enqueue
+// It must be called with mux locked
+func (s *sendSlots) waitTurn(ticket uint64) {
+	for s.turn != ticket {
+		s.turnCond.Wait()
+	}
+}
+
+func (s *sendSlots) pass(ticket uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.finishTurn(ticket)
+}
+
+// finishTurn marks the ticket is passed or abandoned, and moves the turn forward
+// It must be called with mux locked
+func (s *sendSlots) finishTurn(ticket uint64) {
+	if ticket != s.turn {
+		s.abandoned[ticket] = struct{}{}
+		return
+	}
+	s.turn++
+	for {
+		if _, ok := s.abandoned[s.turn]; !ok {
+			break
+		}
+		delete(s.abandoned, s.turn)
+		s.turn++
+	}
+	s.turnCond.Broadcast()
+}
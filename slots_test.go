@@ -0,0 +1,233 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkIdle checks that all slots are returned and no ticket is left behind
+func checkIdle(t *testing.T, s *sendSlots, size int) {
+	t.Helper()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.free != size || len(s.waiters) != 0 || s.turn != s.next || len(s.abandoned) != 0 {
+		t.Fatalf("free=%d/%d waiters=%d turn=%d next=%d abandoned=%d", s.free, size, len(s.waiters), s.turn, s.next, len(s.abandoned))
+	}
+}
+
+func TestSendSlotsStress(t *testing.T) {
+	const (
+		size      = 4
+		producers = 32
+		count     = 200
+	)
+	s := newSendSlots(size)
+	closed := make(chan struct{})
+	closedErr := func() error { return ErrClosed }
+
+	var wg sync.WaitGroup
+	maxWait := make([]time.Duration, producers)
+	sent := make([]int, producers)
+	for p := range producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range count {
+				ctx, cancel := context.Background(), func() {}
+				// some callers give up while waiting, which abandons their tickets
+				if i%7 == p%7 {
+					ctx, cancel = context.WithTimeout(ctx, time.Duration(i%3)*50*time.Microsecond)
+				}
+				start := time.Now()
+				done, err := s.acquire(ctx, closed, closedErr)
+				cancel()
+				if wait := time.Since(start); wait > maxWait[p] {
+					maxWait[p] = wait
+				}
+				if err != nil {
+					if !errors.Is(err, context.DeadlineExceeded) {
+						t.Error(err)
+						return
+					}
+					continue
+				}
+				sent[p]++
+				done()
+				// the slot is released after the message is flushed by the write goroutine
+				go func() {
+					time.Sleep(10 * time.Microsecond)
+					s.release()
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+	// wait for the background releases
+	deadline := time.Now().Add(time.Second)
+	for !s.allFree(size) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	checkIdle(t, s, size)
+
+	var worst time.Duration
+	total := 0
+	for p := range producers {
+		if sent[p] == 0 {
+			t.Fatalf("producer %d is starved", p)
+		}
+		worst = max(worst, maxWait[p])
+		total += sent[p]
+	}
+	t.Logf("%d messages queued, the worst wait of a producer is %v", total, worst)
+	// with FIFO grants a producer waits for at most the other producers once per message,
+	// a starved producer would wait for the whole run instead
+	if worst > 2*time.Second {
+		t.Fatalf("producer waited %v", worst)
+	}
+}
+
+// allFree is only used by the tests
+func (s *sendSlots) allFree(size int) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.free == size
+}
+
+func TestSendSlotsFIFO(t *testing.T) {
+	s := newSendSlots(1)
+	closed := make(chan struct{})
+	closedErr := func() error { return ErrClosed }
+	done, err := s.acquire(context.Background(), closed, closedErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	const waiters = 16
+	results := make(chan int, waiters)
+	for i := range waiters {
+		go func() {
+			done, err := s.acquire(context.Background(), closed, closedErr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results <- i
+			done()
+		}()
+		// make sure the waiters take their tickets in order
+		for {
+			s.mux.Lock()
+			n := len(s.waiters)
+			s.mux.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := range waiters {
+		s.release()
+		if got := <-results; got != i {
+			t.Fatalf("waiter %d is granted before waiter %d", got, i)
+		}
+	}
+	s.release()
+	checkIdle(t, s, 1)
+}
+
+func TestSendSlotsCancelWhileGranted(t *testing.T) {
+	s := newSendSlots(1)
+	closed := make(chan struct{})
+	closedErr := func() error { return ErrClosed }
+	for range 1000 {
+		done, err := s.acquire(context.Background(), closed, closedErr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+		ctx, cancel := context.WithCancel(context.Background())
+		res := make(chan error, 1)
+		go func() {
+			done, err := s.acquire(ctx, closed, closedErr)
+			if err == nil {
+				done()
+				s.release()
+			}
+			res <- err
+		}()
+		for {
+			s.mux.Lock()
+			n := len(s.waiters)
+			s.mux.Unlock()
+			if n == 1 {
+				break
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+		// the slot may be granted at the same time as the context is cancelled
+		go s.release()
+		cancel()
+		if err := <-res; err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+		// the granted slot must not be lost in either case
+		deadline := time.Now().Add(time.Second)
+		for !s.allFree(1) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Microsecond)
+		}
+		checkIdle(t, s, 1)
+	}
+}
+
+func TestSendSlotsClosed(t *testing.T) {
+	s := newSendSlots(1)
+	closed := make(chan struct{})
+	closedErr := func() error { return ErrClosed }
+	done, err := s.acquire(context.Background(), closed, closedErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.acquire(context.Background(), closed, closedErr); !errors.Is(err, ErrClosed) {
+				t.Error(err)
+			}
+		}()
+	}
+	for {
+		s.mux.Lock()
+		n := len(s.waiters)
+		s.mux.Unlock()
+		if n == 8 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(closed)
+	wg.Wait()
+	s.release()
+	checkIdle(t, s, 1)
+}
@@ -0,0 +1,86 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"strconv"
+)
+
+// State is the lifecycle state of a connection
+// A connection only moves forward through the states, though some of them can be skipped,
+// such as WSAuthenticating when no authorizer is used, or WSDraining when it's not closed by Drain
+type State int32
+
+const (
+	// WSConnecting is the state before the auth handshake
+	WSConnecting State = iota
+	// WSAuthenticating is the state during the auth handshake, including the session resumption
+	// Re-authorizations do not change the state
+	WSAuthenticating
+	// WSOpen is the state after the ready message is exchanged
+	WSOpen
+	// WSDraining is the state after Drain is called
+	WSDraining
+	// WSClosed is the state after the connection's context is cancelled
+	WSClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case WSConnecting:
+		return "connecting"
+	case WSAuthenticating:
+		return "authenticating"
+	case WSOpen:
+		return "open"
+	case WSDraining:
+		return "draining"
+	case WSClosed:
+		return "closed"
+	}
+	return "State(" + strconv.Itoa((int)(s)) + ")"
+}
+
+// State returns the current lifecycle state of the connection, it never blocks
+func (w *WebSocket) State() State {
+	return (State)(w.state.Load())
+}
+
+// OnStateChange registers fn to be called after each state transition
+// The transitions are serialized and fn is called synchronously with them in order,
+// so fn should return quickly, and it must not call the methods which change the state, such as Drain and Close
+// fn is not called for the transitions happened before it's registered
+func (w *WebSocket) OnStateChange(fn func(old, new State)) {
+	w.stateMux.Lock()
+	defer w.stateMux.Unlock()
+	w.stateHandlers = append(w.stateHandlers, fn)
+}
+
+// setState changes the state if s is after the current state
+func (w *WebSocket) setState(s State) {
+	w.stateMux.Lock()
+	defer w.stateMux.Unlock()
+	old := w.State()
+	if s <= old {
+		return
+	}
+	w.state.Store((int32)(s))
+	w.logger.Debug("Connection state changed", "old", old, "new", s)
+	for _, fn := range w.stateHandlers {
+		fn(old, s)
+	}
+}
@@ -0,0 +1,542 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrStreamClosed is returned when writing to a closed StreamWriter, or the opposite's StreamReader is closed
+var ErrStreamClosed = errors.New("Stream is closed")
+
+// ErrStreamOverflow is returned by StreamReader when the stream is aborted,
+// since it's not accepted in time, or the opposite sent more chunks than the credits allowed
+var ErrStreamOverflow = errors.New("Stream overflow")
+
+// ErrTooManyStreams is the cause when the opposite opened more streams than MaxStreams
+var ErrTooManyStreams = errors.New("Too many streams")
+
+// defaultMaxStreams is used when MaxStreams is zero
+const defaultMaxStreams = 64
+
+// streamWindow is the chunks a StreamWriter can send before they are read by the opposite's StreamReader,
+// which is also the size of the StreamReader's buffer, so the read goroutine never waits for a stream
+// The StreamReader grants the credits back after half of the window is read
+const streamWindow = 16
+
+type streamMessage struct {
+	Id uint64 `json:"id"`
+	// Call is the id of the call which the stream responds to
+	Call uint64 `json:"call,omitempty"`
+	// Begin and Type are only set in the first chunk
+	Begin bool            `json:"begin,omitempty"`
+	Type  string          `json:"type,omitempty"`
+	Data  json.RawMessage `json:"d,omitempty"`
+	End   bool            `json:"end,omitempty"`
+	Error string          `json:"error,omitempty"`
+	// Credit is sent by the StreamReader to the StreamWriter with the writer's id, the writer can send the count of chunks more
+	// Negative means the reader is closed
+	Credit int `json:"credit,omitempty"`
+}
+
+// StreamHandler is the handler of a method which responds with a stream
+// The stream is closed after the handler returned, and the returned error is sent as the end of the stream
+type StreamHandler func(ctx context.Context, params json.RawMessage, stream *StreamWriter) error
+
+// StreamError is returned by StreamReader when the opposite closed the stream with an error
+type StreamError struct {
+	Type    string
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	return "stream " + e.Type + ": " + e.Message
+}
+
+// StreamWriter writes a sequence of chunks which the opposite reads as one logical response with a StreamReader
+// Each chunk is flushed as it's written, so the whole response is never buffered
+// A write waits if the opposite has not read the previous chunks, so a fast writer does not overflow a slow reader
+// It is safe to use a StreamWriter from multiple goroutines, the chunks are written in order
+type StreamWriter struct {
+	w    *WebSocket
+	id   uint64
+	call uint64
+	typ  string
+
+	mux    sync.Mutex
+	begun  bool
+	closed bool
+
+	// credit is updated by the read goroutine, creditSignal is notified after it
+	credit       atomic.Int64
+	creditSignal chan struct{}
+	// cancelled is set when the opposite's StreamReader is closed
+	cancelled atomic.Bool
+}
+
+// StreamWriter creates a stream with the type, the opposite will receive it from AcceptStream
+func (w *WebSocket) StreamWriter(typ string) *StreamWriter {
+	w.streamMux.Lock()
+	w.streamId++
+	id := w.streamId
+	w.streamMux.Unlock()
+	s := &StreamWriter{
+		w:            w,
+		id:           id,
+		typ:          typ,
+		creditSignal: make(chan struct{}, 1),
+	}
+	s.credit.Store(streamWindow)
+	return s
+}
+
+// Type returns the stream type
+func (s *StreamWriter) Type() string {
+	return s.typ
+}
+
+// Write calls WriteContext with context.Background()
+func (s *StreamWriter) Write(data any) error {
+	return s.WriteContext(context.Background(), data)
+}
+
+// WriteContext encodes data as the next chunk of the stream, then waits until it's flushed
+// The chunk is flushed immediately without waiting for the batch timeouts
+// If the opposite has not read the previous chunks, it waits until the opposite grants the credit
+// ErrStreamClosed is returned if the opposite's StreamReader is closed
+func (s *StreamWriter) WriteContext(ctx context.Context, data any) error {
+	buf, err := s.w.codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, &streamMessage{Data: (json.RawMessage)(buf)})
+}
+
+// Close sends the end of the stream
+// The opposite's StreamReader will return io.EOF after it read all chunks
+func (s *StreamWriter) Close() error {
+	return s.send(context.Background(), &streamMessage{End: true})
+}
+
+// CloseWithError sends the end of the stream with an error message
+// The opposite's StreamReader will return a *StreamError, or a *CallError if the stream responds to a call
+// If err is nil, it's same as Close
+func (s *StreamWriter) CloseWithError(err error) error {
+	m := &streamMessage{End: true}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	return s.send(context.Background(), m)
+}
+
+func (s *StreamWriter) send(ctx context.Context, m *streamMessage) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if s.w.writeClosed.Load() {
+		return ErrWriteClosed
+	}
+	if m.End {
+		if s.cancelled.Load() {
+			// the opposite does not read the stream anymore
+			s.closed = true
+			s.w.removeWriter(s.id)
+			return nil
+		}
+	} else if err := s.waitCredit(ctx); err != nil {
+		return err
+	}
+	m.Id = s.id
+	m.Call = s.call
+	if !s.begun {
+		s.begun = true
+		m.Begin = true
+		m.Type = s.typ
+		s.w.streamMux.Lock()
+		if s.w.writers == nil {
+			s.w.writers = make(map[uint64]*StreamWriter)
+		}
+		s.w.writers[s.id] = s
+		s.w.streamMux.Unlock()
+	}
+	if m.End {
+		s.closed = true
+		s.w.removeWriter(s.id)
+	}
+	msg, err := s.w.buildMessage("$stream", m)
+	if err != nil {
+		return err
+	}
+	p := &pendingMessage{
+		msg:  msg,
+		done: make(chan error, 1),
+	}
+	if err := s.w.enqueueContext(ctx, p); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return s.w.waitPending(ctx, p)
+}
+
+// waitCredit takes a credit to send a chunk, it must be called with mux locked
+func (s *StreamWriter) waitCredit(ctx context.Context) error {
+	for {
+		if s.cancelled.Load() {
+			return ErrStreamClosed
+		}
+		// only the sender holding mux takes the credits, so it cannot be taken by others after the check
+		if s.credit.Load() > 0 {
+			s.credit.Add(-1)
+			return nil
+		}
+		select {
+		case <-s.creditSignal:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-s.w.ctx.Done():
+			return s.w.closedError()
+		}
+	}
+}
+
+// grant is called by the read goroutine when the opposite's StreamReader granted the credits
+func (s *StreamWriter) grant(credit int) {
+	if credit < 0 {
+		s.cancelled.Store(true)
+	} else {
+		s.credit.Add((int64)(credit))
+	}
+	select {
+	case s.creditSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *WebSocket) removeWriter(id uint64) {
+	w.streamMux.Lock()
+	delete(w.writers, id)
+	w.streamMux.Unlock()
+}
+
+// sendCredit grants the credits to the opposite's StreamWriter, negative means the StreamReader is closed
+func (w *WebSocket) sendCredit(id uint64, credit int) {
+	if err := w.writeInternal("$stream", &streamMessage{Id: id, Credit: credit}); err == nil {
+		w.Flush()
+	}
+}
+
+// StreamReader reads the chunks written by the opposite's StreamWriter
+type StreamReader struct {
+	w *WebSocket
+	// id is the opposite's stream id, it's zero before the first chunk of a call stream is received
+	id     uint64
+	call   uint64
+	typ    string
+	ch     chan *streamMessage
+	done   chan struct{}
+	once   sync.Once
+	result <-chan *resultMessage
+	// err is returned by Next after the stream is ended
+	err error
+
+	// aborted is closed by the read goroutine when a chunk cannot be buffered
+	aborted   chan struct{}
+	abortOnce sync.Once
+	// consumed is the chunks read by Next which are not granted back yet
+	consumed int
+}
+
+func newStreamReader(w *WebSocket, typ string) *StreamReader {
+	return &StreamReader{
+		w:       w,
+		typ:     typ,
+		ch:      make(chan *streamMessage, streamWindow+1),
+		done:    make(chan struct{}),
+		aborted: make(chan struct{}),
+	}
+}
+
+// Type returns the stream type, for a call stream it's the method name
+func (r *StreamReader) Type() string {
+	return r.typ
+}
+
+// Next receives the next chunk, the data is encoded by the connection's codec
+// It returns io.EOF after the stream is ended
+// Next must not be called from multiple goroutines at the same time
+func (r *StreamReader) Next(ctx context.Context) (json.RawMessage, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	select {
+	case m := <-r.ch:
+		return r.handleChunk(m)
+	case res := <-r.result:
+		r.Close()
+		if res.Error != "" {
+			r.err = &CallError{Method: r.typ, Message: res.Error}
+		} else {
+			r.err = &CallError{Method: r.typ, Message: "result is not a stream"}
+		}
+		return nil, r.err
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case <-r.aborted:
+	case <-r.w.readStop:
+	case <-r.w.ctx.Done():
+	}
+	select {
+	case m := <-r.ch:
+		return r.handleChunk(m)
+	default:
+	}
+	select {
+	case <-r.aborted:
+		r.err = ErrStreamOverflow
+		return nil, r.err
+	default:
+	}
+	if r.w.ctx.Err() != nil {
+		return nil, r.w.closedError()
+	}
+	return nil, ErrReadClosed
+}
+
+func (r *StreamReader) handleChunk(m *streamMessage) (json.RawMessage, error) {
+	if !m.End {
+		if r.consumed++; r.consumed >= streamWindow/2 {
+			r.w.sendCredit(r.id, r.consumed)
+			r.consumed = 0
+		}
+		return m.Data, nil
+	}
+	// the opposite's StreamWriter is ended, so it's not notified
+	r.close(false)
+	if m.Error == "" {
+		r.err = io.EOF
+	} else if r.call != 0 {
+		r.err = &CallError{Method: r.typ, Message: m.Error}
+	} else {
+		r.err = &StreamError{Type: r.typ, Message: m.Error}
+	}
+	return nil, r.err
+}
+
+// abort stops receiving the stream, Next returns ErrStreamOverflow after the buffered chunks
+func (r *StreamReader) abort() {
+	r.abortOnce.Do(func() {
+		close(r.aborted)
+	})
+	r.close(true)
+}
+
+// Close stops receiving the stream, the chunks received later will be dropped
+// The opposite's StreamWriter will return ErrStreamClosed
+func (r *StreamReader) Close() {
+	r.close(true)
+}
+
+func (r *StreamReader) close(notify bool) {
+	r.once.Do(func() {
+		close(r.done)
+		r.w.streamMux.Lock()
+		id := r.id
+		if r.call != 0 {
+			delete(r.w.callStreams, r.call)
+		} else if r.w.streams[r.id] == r {
+			delete(r.w.streams, r.id)
+		}
+		r.w.streamMux.Unlock()
+		if r.call != 0 {
+			r.w.callMux.Lock()
+			delete(r.w.calls, r.call)
+			r.w.callMux.Unlock()
+		}
+		// the id of a call stream is unknown before its first chunk, it's told when the chunk is received
+		if notify && id != 0 {
+			r.w.sendCredit(id, -1)
+		}
+	})
+}
+
+// AcceptStream waits for the next stream created by the opposite's StreamWriter
+// The read goroutine is never blocked by the streams, since the chunks are sent only after the previous ones are read,
+// and at most 8 streams can be waiting to be accepted
+// A stream is aborted if it's not accepted in time, or the opposite sent more chunks than allowed,
+// then its Next returns ErrStreamOverflow after the buffered chunks, and the opposite's StreamWriter returns ErrStreamClosed
+// The accepted StreamReader should be read or closed promptly
+func (w *WebSocket) AcceptStream(ctx context.Context) (*StreamReader, error) {
+	select {
+	case r := <-w.streamCh:
+		return r, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case <-w.readStop:
+		return nil, ErrReadClosed
+	case <-w.ctx.Done():
+		return nil, w.closedError()
+	}
+}
+
+// HandleStream registers a handler for the method which responds with a stream,
+// the opposite should invoke it with CallStream
+// A method can only have one handler, it replaces the one registered by Handle
+// A nil handler removes the registered one
+func (w *WebSocket) HandleStream(method string, handler StreamHandler) {
+	w.handlerMux.Lock()
+	defer w.handlerMux.Unlock()
+	delete(w.handlers, method)
+	if handler == nil {
+		delete(w.streamHandlers, method)
+		return
+	}
+	if w.streamHandlers == nil {
+		w.streamHandlers = make(map[string]StreamHandler)
+	}
+	w.streamHandlers[method] = handler
+}
+
+// CallStream invokes the method registered by HandleStream on the opposite, and returns the stream of the response
+// ctx only controls sending the call, use the context passed to Next to control the reading
+// The returned StreamReader should be closed if it's not read until the end
+func (w *WebSocket) CallStream(ctx context.Context, method string, params any) (*StreamReader, error) {
+	buf, err := w.codec.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	resCh := make(chan *resultMessage, 1)
+	r := newStreamReader(w, method)
+	r.result = resCh
+	w.callMux.Lock()
+	w.callId++
+	id := w.callId
+	if w.calls == nil {
+		w.calls = make(map[uint64]chan<- *resultMessage)
+	}
+	w.calls[id] = resCh
+	w.callMux.Unlock()
+	r.call = id
+	w.streamMux.Lock()
+	if w.callStreams == nil {
+		w.callStreams = make(map[uint64]*StreamReader)
+	}
+	w.callStreams[id] = r
+	w.streamMux.Unlock()
+
+	if err := w.WriteMessageContext(ctx, "$call", &callMessage{
+		Id:     id,
+		Method: method,
+		Params: (json.RawMessage)(buf),
+	}); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (w *WebSocket) serveStream(call *callMessage, handler StreamHandler) {
+	defer w.recoverPanic()
+	s := w.StreamWriter(call.Method)
+	s.call = call.Id
+	err := handler(w.ctx, call.Params, s)
+	// the handler may have closed the stream already
+	s.CloseWithError(err)
+}
+
+func (w *WebSocket) handleStream(msg *Message) {
+	m := new(streamMessage)
+	if err := w.ParseMessage(msg, m); err != nil {
+		return
+	}
+	if m.Credit != 0 {
+		w.streamMux.Lock()
+		s := w.writers[m.Id]
+		w.streamMux.Unlock()
+		if s != nil {
+			s.grant(m.Credit)
+		}
+		return
+	}
+	var r *StreamReader
+	accept := false
+	w.streamMux.Lock()
+	if m.Call != 0 {
+		r = w.callStreams[m.Call]
+		if r != nil && r.id == 0 {
+			r.id = m.Id
+		}
+	} else if r = w.streams[m.Id]; r == nil && m.Begin {
+		limit := w.maxStreams
+		if limit == 0 {
+			limit = defaultMaxStreams
+		}
+		if limit > 0 && len(w.streams) >= limit {
+			w.streamMux.Unlock()
+			w.logger.Warn("Too many streams", "limit", limit)
+			go w.closeWithCause(websocket.ClosePolicyViolation, "too many streams", ErrTooManyStreams)
+			return
+		}
+		r = newStreamReader(w, m.Type)
+		r.id = m.Id
+		if w.streams == nil {
+			w.streams = make(map[uint64]*StreamReader)
+		}
+		w.streams[m.Id] = r
+		accept = true
+	}
+	if r != nil && m.End {
+		if m.Call != 0 {
+			delete(w.callStreams, m.Call)
+		} else {
+			delete(w.streams, m.Id)
+		}
+	}
+	w.streamMux.Unlock()
+	if r == nil {
+		// the stream is closed or aborted, stop its writer which may be waiting for the credits
+		if !m.End {
+			w.sendCredit(m.Id, -1)
+		}
+		return
+	}
+	// the read goroutine must not be blocked by a stream, or the other messages are not processed either
+	if accept {
+		select {
+		case w.streamCh <- r:
+		default:
+			w.logger.Warn("Stream aborted, it's not accepted in time", "type", r.typ)
+			r.abort()
+			return
+		}
+	}
+	select {
+	case r.ch <- m:
+	case <-r.done:
+	default:
+		w.logger.Warn("Stream aborted, the opposite sent more chunks than allowed", "type", r.typ)
+		r.abort()
+	}
+}
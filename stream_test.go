@@ -0,0 +1,186 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamFlowControl(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	const chunks = 100
+	errCh := make(chan error, 1)
+	go func() {
+		sw := s.StreamWriter("rows")
+		for i := range chunks {
+			if err := sw.Write(i); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- sw.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := c.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a slow reader must not lose any chunk
+	for i := 0; ; i++ {
+		data, err := r.Next(ctx)
+		if err == io.EOF && i == chunks {
+			break
+		}
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		var n int
+		if json.Unmarshal(data, &n); n != i {
+			t.Fatalf("got chunk %d, expect %d", n, i)
+		}
+		if i%10 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamReaderClosed(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	sw := s.StreamWriter("rows")
+	if err := sw.Write(0); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	// the writer is stopped instead of waiting for the credits forever
+	for i := 1; ; i++ {
+		if err := sw.WriteContext(ctx, i); err != nil {
+			if !errors.Is(err, aws.ErrStreamClosed) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamNotAccepted(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	writers := make([]*aws.StreamWriter, 20)
+	for i := range writers {
+		writers[i] = s.StreamWriter("rows")
+		if err := writers[i].Write(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the read goroutine is not blocked by the streams which are not accepted
+	s.Send("after", 1)
+	if msg := readWithin(c, time.Second); msg == nil || msg.Type != "after" {
+		t.Fatal("message after the streams is not received", msg)
+	}
+	// the streams exceeded the accept queue are aborted
+	last := writers[len(writers)-1]
+	for i := 1; ; i++ {
+		if err := last.WriteContext(ctx, i); err != nil {
+			if !errors.Is(err, aws.ErrStreamClosed) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+}
+
+func TestStreamOverflow(t *testing.T) {
+	url, ch := serve(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}})
+	// a raw client ignores the credits
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-ch
+	const chunks = 40
+	for i := range chunks {
+		frame := fmt.Sprintf(`{"t":"$stream","d":{"id":1,"begin":%v,"type":"rows","d":%d}}`, i == 0, i)
+		if err := c.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.WriteMessage(websocket.TextMessage, []byte(`{"t":"after","d":1}`))
+	if msg := readWithin(s, time.Second); msg == nil || msg.Type != "after" {
+		t.Fatal("message after the stream is not received", msg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := s.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		if _, err = r.Next(ctx); err != nil {
+			break
+		}
+		n++
+	}
+	if !errors.Is(err, aws.ErrStreamOverflow) || n == 0 || n >= chunks {
+		t.Fatalf("read %d chunks: %v", n, err)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}, MaxStreams: 4}, &aws.Dialer{})
+	for range 5 {
+		if err := c.StreamWriter("rows").Write(0); err != nil {
+			break
+		}
+	}
+	select {
+	case <-s.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	if cause := context.Cause(s.Context()); !errors.Is(cause, aws.ErrTooManyStreams) {
+		t.Fatal(cause)
+	}
+	var closeErr *websocket.CloseError
+	if cause := context.Cause(c.Context()); !errors.As(cause, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Fatal(cause)
+	}
+}
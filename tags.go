@@ -0,0 +1,76 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"sort"
+)
+
+// AddTag adds a tag to the connection, such as a room or topic it subscribed
+// The hubs containing the connection index it by the tag, see Hub.BroadcastTo
+// It is safe to call AddTag from multiple goroutines
+func (w *WebSocket) AddTag(tag string) {
+	w.tagMux.Lock()
+	defer w.tagMux.Unlock()
+	if _, ok := w.tags[tag]; ok {
+		return
+	}
+	if w.tags == nil {
+		w.tags = make(map[string]struct{})
+	}
+	w.tags[tag] = struct{}{}
+	for h := range w.hubs {
+		h.mux.Lock()
+		h.indexTag(w, tag)
+		h.mux.Unlock()
+	}
+}
+
+// RemoveTag removes a tag from the connection
+func (w *WebSocket) RemoveTag(tag string) {
+	w.tagMux.Lock()
+	defer w.tagMux.Unlock()
+	if _, ok := w.tags[tag]; !ok {
+		return
+	}
+	delete(w.tags, tag)
+	for h := range w.hubs {
+		h.mux.Lock()
+		h.unindexTag(w, tag)
+		h.mux.Unlock()
+	}
+}
+
+// HasTag reports whether the connection has the tag
+func (w *WebSocket) HasTag(tag string) bool {
+	w.tagMux.Lock()
+	defer w.tagMux.Unlock()
+	_, ok := w.tags[tag]
+	return ok
+}
+
+// Tags returns the tags of the connection in sorted order
+func (w *WebSocket) Tags() []string {
+	w.tagMux.Lock()
+	defer w.tagMux.Unlock()
+	tags := make([]string, 0, len(w.tags))
+	for tag := range w.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
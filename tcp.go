@@ -0,0 +1,81 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"net"
+	"time"
+)
+
+// unwrapConn removes the internal wrappers of the connection
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *countConn:
+			conn = c.Conn
+		case *handoffConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// tcpConn returns the *net.TCPConn under the connection, or nil if it's not a TCP connection
+// The TLS and internal wrappers are unwrapped
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := unwrapConn(conn).(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			// such as *tls.Conn
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// applyTCPOptions sets the options to the underlying TCP connection
+// Failures are only logged, since the connection is still usable
+func (w *WebSocket) applyTCPOptions(noDelay bool, keepAlive time.Duration) {
+	if !noDelay && keepAlive == 0 {
+		return
+	}
+	conn := tcpConn(w.ws.UnderlyingConn())
+	if conn == nil {
+		w.logger.Debug("TCP options are not applied to a non-TCP connection")
+		return
+	}
+	if noDelay {
+		if err := conn.SetNoDelay(true); err != nil {
+			w.logger.Warn("Failed to set TCP_NODELAY", "err", err)
+		}
+	}
+	if keepAlive < 0 {
+		if err := conn.SetKeepAlive(false); err != nil {
+			w.logger.Warn("Failed to disable TCP keepalive", "err", err)
+		}
+	} else if keepAlive > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			w.logger.Warn("Failed to enable TCP keepalive", "err", err)
+		} else if err := conn.SetKeepAlivePeriod(keepAlive); err != nil {
+			w.logger.Warn("Failed to set TCP keepalive period", "err", err)
+		}
+	}
+}
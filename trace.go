@@ -0,0 +1,47 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+)
+
+// traceSend calls OnSendSpan for the application message, and injects the returned traceparent into it
+// It returns nil if the message is not traced
+func (w *WebSocket) traceSend(ctx context.Context, p *pendingMessage) (end func(err error)) {
+	// prepared messages share the encoded frame, so they cannot carry a trace of their own
+	if w.onSendSpan == nil || p.msg == nil || p.frame != nil || (len(p.msg.Type) > 0 && p.msg.Type[0] == '$') {
+		return nil
+	}
+	traceparent, end := w.onSendSpan(ctx, p.msg.Type)
+	p.msg.Trace = traceparent
+	return end
+}
+
+// traceReceive wraps the handler of the message with OnReceiveSpan if the message carries a trace
+func (w *WebSocket) traceReceive(msg *Message, handler func()) func() {
+	if w.onReceiveSpan == nil || msg.Trace == "" {
+		return handler
+	}
+	return func() {
+		end := w.onReceiveSpan(msg)
+		if end != nil {
+			defer end()
+		}
+		handler()
+	}
+}
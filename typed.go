@@ -0,0 +1,38 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"context"
+)
+
+// ReadTyped calls ReadTypedContext with context.Background()
+func ReadTyped[T any](w *WebSocket) (string, T, error) {
+	return ReadTypedContext[T](context.Background(), w)
+}
+
+// ReadTypedContext receives a message, and decodes its data as T with the connection's codec
+// The message is consumed even if it cannot be decoded
+func ReadTypedContext[T any](ctx context.Context, w *WebSocket) (typ string, data T, err error) {
+	msg, err := w.ReadMessageContext(ctx)
+	if err != nil {
+		return
+	}
+	typ = msg.Type
+	err = w.ParseMessage(msg, &data)
+	return
+}
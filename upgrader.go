@@ -18,89 +18,1313 @@ package aws
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// ErrNoSubprotocol is returned by Upgrade when the client did not request any of the subprotocols
 var ErrNoSubprotocol = errors.New("No matching subprotocol")
 
+// ErrShutdown is returned by Upgrade after the Upgrader is shutdown
+var ErrShutdown = errors.New("Upgrader is shutdown")
+
+// ErrMaxDuration is the cause when the connection reached the Upgrader's MaxConnectionDuration
+var ErrMaxDuration = errors.New("Max connection duration reached")
+
+// ErrTooManyConnections is returned by Upgrade when MaxConnections is reached
+var ErrTooManyConnections = errors.New("Too many connections")
+
+// ErrUnsupportedProtocol is returned by Upgrade when the request is sent over HTTP/2 or HTTP/3 but it's not an RFC 8441 extended CONNECT,
+// the client should fall back to HTTP/1.1
+// WebSocket over HTTP/2 requires the server to accept the extended CONNECT, which is enabled by GODEBUG=http2xconnect=1 for net/http,
+// and WebSocket over HTTP/3 (RFC 9220) is not supported
+var ErrUnsupportedProtocol = errors.New("WebSocket over HTTP/2 or HTTP/3 is not supported")
+
+// ErrNotWebSocket is returned by Upgrade when the request is not a WebSocket upgrade request and it's served by Upgrader.Fallback
+var ErrNotWebSocket = errors.New("Not a WebSocket upgrade request")
+
+// IsWebSocketRequest reports whether the request is a WebSocket upgrade request, or an RFC 8441 extended CONNECT over HTTP/2
+func IsWebSocketRequest(req *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(req) || isExtendedConnect(req)
+}
+
+// CloseReauthFailed is the close code used when the opposite failed to re-authorize
+const CloseReauthFailed = 4001
+
+// AuthTimeoutPolicy is the action to take when the authorizer does not return within AuthTimeout
+type AuthTimeoutPolicy int
+
+const (
+	// AuthTimeoutReject rejects the connection with ErrAuthTimeout
+	AuthTimeoutReject AuthTimeoutPolicy = iota
+	// AuthTimeoutFallback accepts the connection with a *FallbackAuth carrying Upgrader.FallbackAuthData as the auth data
+	AuthTimeoutFallback
+)
+
+// DuplicateAuthPolicy is the action to take when the client sends an auth message which is not requested,
+// such as a second auth message after the handshake
+type DuplicateAuthPolicy int
+
+const (
+	// DuplicateAuthIgnore drops the unrequested auth messages
+	DuplicateAuthIgnore DuplicateAuthPolicy = iota
+	// DuplicateAuthReauth re-authorizes the opposite with the unrequested auth message like a requested re-authorization,
+	// it's same as DuplicateAuthIgnore if Reauthorizer is nil
+	DuplicateAuthReauth
+	// DuplicateAuthClose closes the connection with code 1002 (protocol error) and ErrUnexpectedAuth
+	DuplicateAuthClose
+)
+
+// FallbackAuth is the auth data of the connections accepted by AuthTimeoutFallback
+// Handlers can check it with AuthDataAs to restrict the capabilities of the connections which are not really authorized
+// It's replaced by the Reauthorizer's result once the opposite re-authorized
+type FallbackAuth struct {
+	// Data is Upgrader.FallbackAuthData
+	Data any
+}
+
+// AuthError can be returned by Authorizer or Reauthorizer to reject the connection with a close code and reason
+// For example, code 1008 (policy violation) for unauthorized clients
+type AuthError struct {
+	Code   int
+	Reason string
+	// Err is the underlying error, can be nil
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	if e.Err != nil {
+		return "auth failed: " + e.Reason + ": " + e.Err.Error()
+	}
+	return "auth failed: " + e.Reason
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes AuthError match ErrAuthRejected
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthRejected
+}
+
+// HTTPError can be returned by PreAuthorize or PreUpgradeAuthorize to reject the request with a status code and message
+type HTTPError struct {
+	// Status is the HTTP status code, default is 401 (unauthorized)
+	Status int
+	// Message is the response body, default is the status text
+	Message string
+	// Err is the underlying error, can be nil
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.status())
+	}
+	if e.Err != nil {
+		return "pre-auth failed: " + msg + ": " + e.Err.Error()
+	}
+	return "pre-auth failed: " + msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes HTTPError match ErrAuthRejected
+func (e *HTTPError) Is(target error) bool {
+	return target == ErrAuthRejected
+}
+
+func (e *HTTPError) status() int {
+	if e.Status == 0 {
+		return http.StatusUnauthorized
+	}
+	return e.Status
+}
+
 type Upgrader struct {
 	// Upgrader should never be nil
 	Upgrader *websocket.Upgrader
 
-	PingInterval    time.Duration
-	PongTimeout     time.Duration
+	// A ping is sent every PingInterval,
+	// and the connection will be closed with ErrPongTimeout if no pong is received within PongTimeout
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// OnPong is called with the round-trip time when a pong is received
+	OnPong func(rtt time.Duration)
+	// OnPingTimeout is called before the connection is closed because of pong timeout
+	OnPingTimeout func()
+	// OnPeerClose is called with the code and text of the close frame sent by the opposite, before the connection is closed
+	// It's also called when the opposite echoed the close frame
+	// It's called in the read goroutine, so it should not wait for the connection to be closed
+	OnPeerClose func(code int, text string)
+	// NoCloseEcho disables echoing the close frame sent by the opposite before closing the connection
+	// By default, the close frame is echoed as RFC 6455 requires
+	NoCloseEcho bool
+	// PingMessage is sent with each ping along with the send time, the opposite should echo it in the pong
+	// If ValidatePong is true, a pong which does not echo the PingMessage will not be counted
+	PingMessage  []byte
+	ValidatePong bool
+	// KeepaliveMatcher reports whether a text frame is an application level heartbeat and should reset the pong timeout like a pong,
+	// for the clients that cannot send the native pong frames through their proxies
+	// It's called with each raw text frame before decoding, the matched frames are consumed and not decoded
+	// The heartbeats reset the pong timeout but not IdleTimeout, and count towards MaxControlFramesPerSec
+	// Control frame pongs always reset the pong timeout
+	KeepaliveMatcher func(json.RawMessage) bool
+	// AutoPongAppMessages replies the application level pings sent as JSON text frames, such as {"type":"ping"},
+	// for the clients that cannot use the native ping frames
+	// The pings reset the pong timeout but not IdleTimeout, and count towards MaxControlFramesPerSec,
+	// but they are not delivered to the handlers or MessageReader
+	// The other messages are not affected, and it's disabled if nil
+	AutoPongAppMessages *AppPing
+
+	// Outbound messages are batched into one frame when both MinBatchTimeout and MaxBatchTimeout are set
+	// A batch is flushed when no new message is queued within MinBatchTimeout,
+	// or MaxBatchTimeout has passed since the first message is queued,
+	// or the batch reaches MaxBatchCount messages or MaxBatchBytes bytes, whichever comes first
+	// A flushed batch is split into multiple frames if it exceeds MaxBatchCount or MaxBatchBytes
+	// Zero MaxBatchCount or MaxBatchBytes means no limit
+	// If the request's context has a deadline, the batch is also flushed shortly before it, so it's not lost at the cancellation
 	MinBatchTimeout time.Duration
 	MaxBatchTimeout time.Duration
+	MaxBatchCount   int
+	MaxBatchBytes   int
+	// EagerFirstSend flushes the first message immediately if no batch is pending and nothing is flushed within MinBatchTimeout,
+	// the following messages are batched as usual, so the first message after a quiet period does not wait for the batch timeouts
+	EagerFirstSend bool
+	// BatchFraming decides how a batch is framed, default is FramingNDJSON
+	// Both sides should use the same framing
+	BatchFraming BatchFraming
+	// FlushFailurePolicy decides whether the messages of the frames written before a failed frame in the same flush succeed,
+	// default is FlushStopOnError
+	FlushFailurePolicy FlushFailurePolicy
+	// RawJSONRPC makes each text frame a bare JSON-RPC 2.0 message or batch without the $jsonrpc envelope,
+	// so the opposite can be a plain JSON-RPC client, see WebSocket.RegisterRPC
+	// The other messages cannot be sent, and the internal messages are not sent except the pings which are sent as control frames,
+	// so the authorization must use an AuthSource other than AuthFirstFrame, and SessionStore, AckInterval and WebSocket.Ping are not supported
+	// It requires a codec which encodes as JSON
+	RawJSONRPC bool
+
+	// Codec is used to encode and decode the messages, default is JSONCodec
+	Codec Codec
+	// Codecs are the codecs keyed by subprotocol names, such as "json.v1" or "msgpack.v1"
+	// The codec matching the negotiated subprotocol will be used, otherwise Codec is used
+	// If Upgrader.Subprotocols is empty, the names of Codecs will be offered in sorted order
+	Codecs map[string]Codec
+	// RequireSubprotocol rejects the upgrade with 400 (bad request) if the client did not request any of the offered subprotocols,
+	// which are Upgrader.Subprotocols, the names of Codecs, or the one set in the Sec-Websocket-Protocol response header
+	// Upgrade returns ErrNoSubprotocol before anything is written to the upgraded connection
+	RequireSubprotocol bool
+	// MaxMessageSize is the maximum size in bytes of a frame read from the opposite, including the auth frame
+	// If a frame exceeds the limit, the connection will be closed with code 1009 (message too big)
+	// Zero means no limit
+	MaxMessageSize int64
+	// OnLargeMessage is called in the read goroutine when an inbound application message is larger than LargeMessageThreshold,
+	// size is the size of its type and data, or the size of a binary frame
+	// It's a soft limit which only reports the message, the message is still delivered, see also WebSocket.InboundSizes
+	// It's disabled if LargeMessageThreshold is not positive
+	OnLargeMessage        func(size int)
+	LargeMessageThreshold int
+	// OnRawFrame is called in the read goroutine with each frame which is not used by the codec,
+	// which is a binary frame for JSONCodec, instead of delivering it to BinaryReader
+	// It's never called with the frames of the codec, the messages in them are still decoded and copied as usual
+	// data aliases the read buffer which is reused for the next frame, so it must not be retained or modified after OnRawFrame returned,
+	// copy it if it's needed later
+	// The read goroutine is blocked until OnRawFrame returns
+	OnRawFrame func(messageType int, data []byte)
+	// OnDecodeError is called in the read goroutine when a frame cannot be decoded by the codec, with the whole frame and the error
+	// If it returns true, the rest of the frame is dropped and the connection keeps reading,
+	// otherwise the connection is closed with code 1007 (invalid frame payload data) and a cause matching ErrInvalidMessage
+	// The frames are buffered before decoding if it's set, so raw is available
+	// If it's nil, the bad frames are dropped with a warning
+	OnDecodeError func(raw []byte, err error) (drop bool)
+	// OnSend is called with each application message before it's encoded and queued,
+	// the returned value is encoded instead, so it can be used to transform or validate the outbound messages
+	// If it returns an error, the message is not queued and the error is returned by the send method
+	// Internal messages are not passed to OnSend
+	OnSend func(typ string, data any) (any, error)
+	// OnReceive is called in the read goroutine with each application message before it's delivered to MessageReader
+	// It can modify the message in place, and the message is dropped if it returns an error
+	OnReceive func(msg *Message) error
+	// OnSendSpan is called with the sender's context when an application message is sent, so a child span can be created around the send
+	// The returned traceparent is injected into Message.Trace, and end is called with the result when the send returns,
+	// which is after the flush for the methods waiting for it
+	// Internal messages and prepared messages are not traced
+	OnSendSpan func(ctx context.Context, typ string) (traceparent string, end func(err error))
+	// OnReceiveSpan is called before the handler registered by On or OnDefault is called with a message carrying Message.Trace,
+	// and end is called after the handler returns
+	// The messages read from MessageReader are not traced, Message.Trace can be extracted directly
+	OnReceiveSpan func(msg *Message) (end func())
+	// DispatchWorkers is the count of goroutines calling the handlers registered by WebSocket.On
+	// Zero means the handlers are called sequentially in the read goroutine, so a slow handler delays the pings and pongs
+	// One means a dedicated worker goroutine calls the handlers one by one in the receive order,
+	// so the per connection state used by the handlers does not need locking
+	// With more workers, the handlers are called concurrently and the order between messages is not kept
+	// DispatchQueueSize is the count of messages can be waiting for the workers before the read goroutine is blocked,
+	// default is DispatchWorkers
+	DispatchWorkers   int
+	DispatchQueueSize int
+	// MaxPendingMessages and MaxPendingBytes limit the messages queued but not yet written
+	// If a limit is exceeded, the connection will be closed with code 1008 (policy violation) and ErrSlowConsumer as the cause
+	// The internal messages such as the pings and acks are counted but never rejected by the limits
+	// Zero means no limit
+	MaxPendingMessages int
+	MaxPendingBytes    int
+	// OnQueueHighWater is called when the messages queued but not yet written reach QueueHighWaterMessages or QueueHighWaterBytes,
+	// so a producer can back off, drop or coalesce messages before the limits above are exceeded
+	// It's called at most once until the queue is flushed, in the goroutine which queued the message, so it must not block
+	// Zero disables the corresponding mark
+	OnQueueHighWater       func(count int, bytes int)
+	QueueHighWaterMessages int
+	QueueHighWaterBytes    int
+	// SendQueueSize bounds the messages queued by Send, SendContext, WriteMessage and WriteMessageContext
+	// When the queue is full, they block until a flush makes room, or the context is done,
+	// blocked callers are served first come first served and their messages are queued in the same order,
+	// so no producer is starved under contention, and TrySend returns false instead of blocking
+	// A full queue is flushed immediately without waiting for the batch timeouts
+	// Internal messages and MessageWriter are not bounded by SendQueueSize
+	// Zero means no bound
+	SendQueueSize int
+	// EnableCompression enables permessage-deflate compression if the client supports it
+	// CompressionLevel is the flate compression level, zero means the default level
+	// Frames smaller than CompressionThreshold bytes will not be compressed, zero means compress all frames
+	// The context takeover and window bits are not configurable, gorilla/websocket always negotiates
+	// server_no_context_takeover and client_no_context_takeover with the default window bits,
+	// so no compression state is kept between frames, and the flate writers and readers are pooled
+	// The memory per connection is not increased when idle, only CompressionLevel trades CPU for the ratio
+	EnableCompression    bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// InboundRateLimit is the maximum messages per second can be received from the client after authorization
+	// InboundBurst is the maximum messages can be received at once, default is 1
+	// RateLimitAction decides what to do when the limit is exceeded
+	// Only the application messages and binary frames are limited, the internal messages such as $auth, $call, $result, $resume and $ack are not
+	// Zero InboundRateLimit means no limit
+	InboundRateLimit float64
+	InboundBurst     int
+	RateLimitAction  RateLimitAction
+	// MaxControlFramesPerSec is the maximum ping and pong frames per second can be received,
+	// the connection is closed with code 1008 (policy violation) and ErrControlFlood when it's exceeded
+	// Zero means no limit
+	MaxControlFramesPerSec float64
+	// OutboundRateLimit is the maximum bytes per second can be written to the opposite, the frames are delayed to keep the rate
+	// OutboundBurst is the maximum bytes can be written at once, default is OutboundRateLimit
+	// A frame larger than the burst is still written at once, and the following frames are delayed longer
+	// While the writes are delayed, the messages are kept queued, so MaxPendingMessages and MaxPendingBytes close a client
+	// which cannot keep up with the rate as a slow consumer
+	// Zero OutboundRateLimit means no limit
+	OutboundRateLimit float64
+	OutboundBurst     int
+	// MaxConsecutiveControlFrames is the maximum ping and pong frames can be received without a data frame between them,
+	// the extra ones are ignored, so pings are not answered and do not keep the connection alive until a data frame is received
+	// It stops a flood of control frames from using up the write bandwidth of the data messages
+	// Zero means no limit
+	MaxConsecutiveControlFrames int
+	// MaxStreams is the maximum streams opened by the opposite's StreamWriter which are not ended yet, default is 64
+	// If it's exceeded, the connection will be closed with code 1008 (policy violation) and ErrTooManyStreams as the cause
+	// Negative means no limit
+	MaxStreams int
 
-	Authorizer  func(json.RawMessage) (any, error)
+	// Metrics receives the events of the connections, it can be nil
+	Metrics Metrics
+	// Logger receives the internal errors of the connections, such as pong timeouts, decode failures and write errors
+	// Default discards all logs
+	Logger *slog.Logger
+	// DebugPayloadLimit is the max bytes of a payload logged after WebSocket.SetDebug is enabled, default is 256
+	// Negative means the payloads are not logged
+	// DebugRedact can replace the payload before it's logged, typ is empty for binary frames
+	// If it's nil, the payloads of $auth, $resume and $ready are redacted, since they carry the credentials and the session tokens
+	DebugPayloadLimit int
+	DebugRedact       func(typ string, data []byte) []byte
+	// OnPanic is called when the Authorizer, Reauthorizer or a handler panicked
+	// The connection will be closed with ErrHandlerPanic
+	OnPanic func(recovered any, stack []byte)
+	// IdleTimeout closes the connection with ErrIdleTimeout if no application message is received within the duration
+	// Internal messages such as pings and pongs are not counted
+	// Zero means no idle timeout
+	IdleTimeout time.Duration
+	// WriteTimeout is the deadline of each frame write
+	// If a write times out, the connection will be closed with ErrWriteTimeout
+	// Zero means no timeout
+	WriteTimeout time.Duration
+	// ReadTimeout bounds the time to receive the rest of a message after its first frame header arrives,
+	// so a client which trickles the bytes of a message cannot hold the read goroutine
+	// If a read times out, the connection will be closed with ErrReadTimeout
+	// The time between the messages is not limited, see IdleTimeout and PongTimeout for that
+	// The messages are received in full before decoding when it's set, zero means no timeout
+	ReadTimeout time.Duration
+	// Clock provides the time to the timers of the connections, default is RealClock
+	Clock Clock
+	// CloseFlushTimeout is the maximum duration Close, CloseError and CloseWithCode wait for the queued messages to be flushed
+	// Zero means the default 3 seconds, negative means the queued messages will be discarded
+	CloseFlushTimeout time.Duration
+	// CloseHandshakeTimeout is the maximum duration to wait for the opposite to echo the close frame,
+	// the connection is forcibly closed with ErrCloseTimeout as the cause if it's reached
+	// Zero means the default 3 seconds
+	CloseHandshakeTimeout time.Duration
+
+	// Fallback serves the requests which are not WebSocket upgrade requests, such as a long polling transport
+	// Upgrade returns ErrNotWebSocket after Fallback is returned
+	// If Fallback is nil, the requests will be rejected with 400 (bad request)
+	// MaxConnections and PreAuthorize are not applied to Fallback
+	Fallback http.Handler
+
+	// PreAuthorize is called before the request is upgraded
+	// If it returns an error, the request will be rejected with a HTTP error response instead of upgrading,
+	// the status is taken from *HTTPError, otherwise it's 401 (unauthorized)
+	PreAuthorize func(*http.Request) error
+	// PreUpgradeAuthorize is called after PreAuthorize, and its errors are handled the same way
+	// It can set the response headers of the upgrade based on the auth result, such as a session cookie or Sec-Websocket-Protocol,
+	// since the other authorizers run after the handshake when the headers are already sent
+	// The returned data is the connection's auth data, until it's replaced by the other authorizers or the Reauthorizer
+	PreUpgradeAuthorize func(req *http.Request, respHeader http.Header) (any, error)
+
+	// Authorizer is called with the auth message sent by the client
+	// If it returns an *AuthError, the connection will be closed with the error's code and reason
+	Authorizer func(json.RawMessage) (any, error)
+	// AuthTimeout limits both receiving the auth message and calling the authorizer, default is 10s
 	AuthTimeout time.Duration
+	// OnAuthTimeout is the action to take when the authorizer does not return within AuthTimeout,
+	// the authorizer's context is cancelled with ErrAuthTimeout and its late result is discarded
+	// It allows degraded operation when the auth backend is slow or unavailable
+	OnAuthTimeout AuthTimeoutPolicy
+	// FallbackAuthData is wrapped in *FallbackAuth as the auth data when AuthTimeoutFallback is used
+	FallbackAuthData any
+	// ContextAuthorizer is same as Authorizer but it's called with a context derived from the request's context,
+	// which has a deadline of AuthTimeout and is cancelled when the connection is closed,
+	// so the external calls made by the authorizer, such as a token introspection, can be aborted promptly
+	// AuthorizerContext takes precedence over ContextAuthorizer, and ContextAuthorizer takes precedence over the other authorizers
+	ContextAuthorizer func(ctx context.Context, msg json.RawMessage) (any, error)
+	// AuthorizerContext is same as ContextAuthorizer but it also returns a context
+	// The values of the returned context will be visible through the connection's context,
+	// so values such as trace spans and request IDs can flow into the connection's lifetime
+	// Only the values of the returned context are used, its cancellation is ignored
+	// The returned context can be nil, which means no values are added
+	// AuthorizerContext takes precedence over Authorizer
+	AuthorizerContext func(ctx context.Context, msg json.RawMessage) (context.Context, any, error)
+	// RequestAuthorizer is same as Authorizer but it's also called with the upgrade request,
+	// so the headers and cookies can be checked along with the auth message
+	// The request's body must not be read
+	// CertAuthorizer takes precedence over RequestAuthorizer, and RequestAuthorizer takes precedence over Authorizer
+	RequestAuthorizer func(req *http.Request, msg json.RawMessage) (any, error)
+	// CertAuthorizer is same as Authorizer but it's also called with the certificates presented by the client over mTLS,
+	// so the auth message can be checked along with the certificate subject, see WebSocket.PeerCertificates
+	// The certificates are only verified if the server's tls.Config.ClientAuth requires the verification
+	// certs is nil if the connection is not over TLS or the client presented no certificate
+	// ContextAuthorizer takes precedence over CertAuthorizer
+	CertAuthorizer func(certs []*x509.Certificate, msg json.RawMessage) (any, error)
+	// AuthValidator is called with the auth message before the authorizer or Reauthorizer,
+	// so malformed messages are rejected before any business logic runs
+	// It's also called when the auth data is taken from AuthCache
+	// If it returns an error, the connection will be closed with code 1007 (invalid payload data) and ErrInvalidAuthMessage,
+	// unless the error is an *AuthError
+	// See AuthSchema for a validator based on a Go type
+	AuthValidator func(msg json.RawMessage) error
+	// BinaryAuthorizer is same as Authorizer but the auth message is the raw bytes sent by the client,
+	// which is a binary frame, or a []byte encoded by the codec if the codec is using binary frames
+	// For AuthHeader and AuthQueryParam, the token is passed as is
+	// It's only used if none of the other authorizers is set, and AuthValidator is not applied to it
+	// Reauthorizer still receives the JSON auth messages
+	BinaryAuthorizer func(data []byte) (any, error)
+	// ExpiringAuthorizer is same as Authorizer but it also returns when the auth expires, such as the expiry of an access token
+	// When it expires, the opposite is asked to re-authorize if Reauthorizer is set,
+	// otherwise the connection will be closed with CloseReauthFailed and ErrAuthExpired as the cause
+	// A successful re-authorization clears the expiry, and a zero expiry means the auth never expires
+	// It's only used if AuthorizerContext, ContextAuthorizer, CertAuthorizer, RequestAuthorizer and Authorizer are nil
+	ExpiringAuthorizer func(msg json.RawMessage) (data any, expiry time.Time, err error)
+	// AuthCache caches the auth data returned by the authorizer, keyed by AuthCacheKey of the auth message,
+	// so the authorizer is skipped when a client reconnects with the same credential, see MemoryAuthCache
+	// AuthValidator is not skipped, it still checks the auth message of a cached result
+	// The results of AuthorizerContext which carry a context are not cached, and the failed ones are never cached
+	// It should not be used if the authorizer depends on anything other than the auth message, such as the request of RequestAuthorizer
+	// The results cached before SetAuthorizer is called are not used after it
+	AuthCache AuthCache
+	// AuthSource decides where the auth message is taken from, default is AuthFirstFrame
+	// For AuthHeader and AuthQueryParam, the token is passed to the authorizer as a JSON string, or nil if it's not present,
+	// and the client does not need to send the auth frame
+	// AuthParam is the header name or the query parameter name
+	AuthSource AuthSource
+	AuthParam  string
+	// RejectBeforeAuth makes the connections returned by UpgradeAsync reject the messages sent before the auth completes with ErrAuthPending,
+	// instead of holding them until the ready message is sent
+	RejectBeforeAuth bool
+	// InitialMessage is called with the auth data after the auth handshake succeeded,
+	// and the returned data is sent as a message of InitialMessageType right after the ready message and the replayed messages,
+	// so the opposite always receives it before any message sent by Send, including the ones held by UpgradeAsync
+	// Nothing is sent if it returns nil, and the upgrade fails if it returns an error
+	// InitialMessageType is "init" if it's empty
+	InitialMessage     func(authData any) (any, error)
+	InitialMessageType string
+
+	// Reauthorizer will be called with the current auth data and the new auth message every ReauthInterval
+	// If the opposite does not re-authorize within AuthTimeout, or Reauthorizer returns an error,
+	// the connection will be closed with CloseReauthFailed
+	Reauthorizer   func(old any, msg json.RawMessage) (any, error)
+	ReauthInterval time.Duration
+	// OnDuplicateAuth is the action to take when the client sends an auth message which is not requested after the handshake,
+	// default is DuplicateAuthIgnore
+	// The auth messages are never delivered to the handlers or MessageReader
+	OnDuplicateAuth DuplicateAuthPolicy
+
+	// SessionStore enables session resumption if it's not nil
+	// Application messages are sequenced when they are queued, and appended to the store before they are written,
+	// a reconnected client can present the session token during the auth handshake,
+	// then the messages it missed will be replayed right after the ready message
+	// The auth handshake is always performed when SessionStore is set, the auth message is ignored if Authorizer is nil
+	// Binary frames are not resumable
+	SessionStore SessionStore
+	// SessionIdentity returns the identity of the auth data, a session can only be resumed by the same identity which created it,
+	// so a leaked session token cannot be used by another client, the request is treated as a new session instead
+	// Default is the auth data formatted by fmt.Sprint, it should be set if the auth data of the same client changes between the authorizations,
+	// such as containing an expiry
+	SessionIdentity func(authData any) string
+	// AckInterval enables the delivery receipts if it's positive
+	// Application messages are sequenced, and kept until the opposite acknowledges them, see AckedSeq and Unacked
+	// The highest sequence which it and all the messages before it are processed is acknowledged every AckInterval if it's changed,
+	// a message is processed after it's taken from MessageReader, its handler returned, or it's dropped
+	// Both sides should enable it, and priorities are ignored since the messages must be sent in sequence
+	// MaxUnackedMessages limits the messages kept for the opposite, default is 4096, negative means no limit
+	// If it's exceeded, the connection will be closed with code 1008 (policy violation) and ErrSlowConsumer as the cause
+	AckInterval        time.Duration
+	MaxUnackedMessages int
+
+	// TrustedProxies are the networks of the reverse proxies
+	// The X-Forwarded-For and X-Real-IP headers are only used to resolve ClientIP if the request is sent from them
+	TrustedProxies []netip.Prefix
+
+	// MaxConnectionDuration closes the connection with code 1001 (going away) and ErrMaxDuration after the duration,
+	// regardless of the activity, so the clients reconnect periodically
+	// The connection's context will have a deadline a few seconds later than the duration for the close handshake
+	// Zero means no limit
+	MaxConnectionDuration time.Duration
+
+	// UpgradeTimeout bounds the whole Upgrade call, including PreAuthorize, the websocket handshake and the authorization,
+	// so a client which stalls before becoming a usable connection is cleaned up within the duration
+	// When it's exceeded, the connection is closed and Upgrade returns ErrUpgradeTimeout
+	// The websocket handshake timeout is shortened to fit in the remaining time
+	// Zero means no limit, only AuthTimeout and the handshake timeout are applied
+	UpgradeTimeout time.Duration
+
+	// TCPNoDelay makes sure TCP_NODELAY is set on the underlying TCP connection, so Nagle's algorithm will not delay the batched frames
+	// Go enables it for TCP connections by default, but a custom listener may not
+	// TCPKeepAlive is the TCP keepalive period, negative disables TCP keepalive, zero keeps the listener's setting
+	// They are not applied if the underlying connection is not TCP
+	TCPNoDelay   bool
+	TCPKeepAlive time.Duration
+
+	// MaxConnections limits the connections created by the Upgrader, including the ones being authorized
+	// If the limit is reached, Upgrade will reply 503 and return ErrTooManyConnections
+	// Zero means no limit
+	MaxConnections int
+
+	conns    Hub
+	shutdown atomic.Bool
+	active   atomic.Int64
+	// config is the snapshot set by Reconfigure
+	config atomic.Pointer[Upgrader]
+	// authorizer is set by SetAuthorizer, it overrides the Authorizer of the options
+	authorizer atomic.Pointer[swappedAuthorizer]
+	authGen    atomic.Uint64
+}
+
+// swappedAuthorizer is the authorizer set by SetAuthorizer,
+// gen is put into the AuthCache keys, so the results of the previous authorizers are not used
+type swappedAuthorizer struct {
+	fn  func(json.RawMessage) (any, error)
+	gen uint64
+}
+
+// Reconfigure replaces the options used by the following upgrades with the ones of config atomically,
+// the connections created before keep their original options
+// config is used as an immutable snapshot, it must not be modified or used to upgrade after it's passed,
+// and its connections, active count and shutdown state are not used
+// Changing the fields of the Upgrader directly is not safe while Upgrade is being called, use Reconfigure instead
+// A nil config restores the Upgrader's own fields
+func (u *Upgrader) Reconfigure(config *Upgrader) {
+	u.config.Store(config)
+}
+
+// SetAuthorizer replaces the Authorizer used by the following handshakes atomically, such as when rotating the signing keys,
+// the connections already authorized are not affected
+// It's safe to call concurrently with Upgrade, the authorizations in progress use either the old or the new function
+// It also overrides the Authorizer of the options set by Reconfigure, and a nil fn restores the Authorizer of the options
+// It has no effect if any authorizer which takes precedence over Authorizer is set
+// The results cached in AuthCache before are not used by the following handshakes,
+// since the keys of the new ones are AuthCacheKey of the auth message followed by "." and a generation number
+func (u *Upgrader) SetAuthorizer(fn func(json.RawMessage) (any, error)) {
+	u.authorizer.Store(&swappedAuthorizer{
+		fn:  fn,
+		gen: u.authGen.Add(1),
+	})
+}
+
+// current returns the options used by a new upgrade
+func (u *Upgrader) current() *Upgrader {
+	if c := u.config.Load(); c != nil {
+		return c
+	}
+	return u
+}
+
+// ActiveConnections returns how many connections created by the Upgrader are not closed yet
+func (u *Upgrader) ActiveConnections() int {
+	return (int)(u.active.Load())
+}
+
+// Connections returns the live connections created by the Upgrader, such as for an admin endpoint listing them with Info
+// The connections being authorized are not included until they are ready
+func (u *Upgrader) Connections() []*WebSocket {
+	return u.conns.Connections()
+}
+
+// Range calls fn for each live connection created by the Upgrader until fn returns false, see Hub.Range
+func (u *Upgrader) Range(fn func(*WebSocket) bool) {
+	u.conns.Range(fn)
+}
+
+// Shutdown stops accepting new connections, then closes all connections created by the Upgrader
+// The connections still in their handshake are closed with ErrShutdown when the handshake is done, and not waited
+// See Hub.Shutdown for details
+func (u *Upgrader) Shutdown(ctx context.Context) error {
+	u.shutdown.Store(true)
+	return u.conns.Shutdown(ctx)
+}
+
+// hasSubprotocol reports whether the client requested one of the offered subprotocols
+func (u *Upgrader) hasSubprotocol(req *http.Request, respHeader http.Header) bool {
+	offered := u.Upgrader.Subprotocols
+	if len(offered) == 0 {
+		offered = codecSubprotocols(u.Codecs)
+	}
+	if p := respHeader.Get("Sec-Websocket-Protocol"); p != "" {
+		offered = []string{p}
+	}
+	for _, p := range websocket.Subprotocols(req) {
+		for _, o := range offered {
+			if p == o {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Upgrade will upgrade a http connection to a websocket connection
 // If Authorizer is not nil, this method will wait until the authorization process is done
+// The request can also be an RFC 8441 extended CONNECT over HTTP/2, see ErrUnsupportedProtocol
 func (u *Upgrader) Upgrade(rw http.ResponseWriter, req *http.Request, respHeader http.Header) (*WebSocket, error) {
-	ws, err := u.Upgrader.Upgrade(rw, req, respHeader)
+	return u.upgrade(rw, req, respHeader, upgradeSync)
+}
+
+// upgradeMode decides how the auth handshake is done by upgrade
+type upgradeMode int
+
+const (
+	// upgradeSync returns after the auth handshake
+	upgradeSync upgradeMode = iota
+	// upgradeAsync returns before the auth handshake, and the messages are held until it's done
+	upgradeAsync
+	// upgradeHandoff skips the auth handshake, since the connection is already authorized by its previous owner
+	upgradeHandoff
+)
+
+func (u *Upgrader) upgrade(rw http.ResponseWriter, req *http.Request, respHeader http.Header, mode upgradeMode) (*WebSocket, error) {
+	// the config is loaded once, so a concurrent Reconfigure does not affect this upgrade
+	c := u.current()
+	clock := c.Clock
+	if clock == nil {
+		clock = RealClock
+	}
+	var upgradeDeadline time.Time
+	if c.UpgradeTimeout > 0 {
+		upgradeDeadline = clock.Now().Add(c.UpgradeTimeout)
+	}
+	if u.shutdown.Load() {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, ErrShutdown
+	}
+	if c.Fallback != nil && !IsWebSocketRequest(req) {
+		c.Fallback.ServeHTTP(rw, req)
+		return nil, ErrNotWebSocket
+	}
+	extendedConnect := isExtendedConnect(req)
+	if req.ProtoMajor >= 2 && !extendedConnect {
+		// 505 (HTTP version not supported) tells the client to retry with HTTP/1.1
+		http.Error(rw, ErrUnsupportedProtocol.Error(), http.StatusHTTPVersionNotSupported)
+		return nil, ErrUnsupportedProtocol
+	}
+	var preAuthData any
+	if mode != upgradeHandoff && (c.PreAuthorize != nil || c.PreUpgradeAuthorize != nil) {
+		var err error
+		if c.PreAuthorize != nil {
+			err = c.PreAuthorize(req)
+		}
+		if err == nil && c.PreUpgradeAuthorize != nil {
+			if respHeader == nil {
+				respHeader = make(http.Header)
+			}
+			preAuthData, err = c.PreUpgradeAuthorize(req, respHeader)
+		}
+		if err != nil {
+			status, msg := http.StatusUnauthorized, ""
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) {
+				status, msg = httpErr.status(), httpErr.Message
+			}
+			if msg == "" {
+				msg = http.StatusText(status)
+			}
+			http.Error(rw, msg, status)
+			err = rejectAuth(err)
+			if c.Metrics != nil {
+				c.Metrics.OnAuthFailure(err)
+			}
+			return nil, err
+		}
+	}
+	// the subprotocol may be chosen by PreUpgradeAuthorize
+	if c.RequireSubprotocol && !c.hasSubprotocol(req, respHeader) {
+		http.Error(rw, ErrNoSubprotocol.Error(), http.StatusBadRequest)
+		return nil, ErrNoSubprotocol
+	}
+	if n := u.active.Add(1); c.MaxConnections > 0 && n > (int64)(c.MaxConnections) {
+		u.active.Add(-1)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, ErrTooManyConnections
+	}
+	upgrader := c.Upgrader
+	var handshakeTimeout time.Duration
+	if !upgradeDeadline.IsZero() {
+		if handshakeTimeout = upgradeDeadline.Sub(clock.Now()); handshakeTimeout <= 0 {
+			u.active.Add(-1)
+			http.Error(rw, http.StatusText(http.StatusRequestTimeout), http.StatusRequestTimeout)
+			return nil, ErrUpgradeTimeout
+		}
+		if upgrader.HandshakeTimeout > 0 && upgrader.HandshakeTimeout < handshakeTimeout {
+			handshakeTimeout = 0
+		}
+	}
+	if (c.EnableCompression && !upgrader.EnableCompression) || (len(c.Codecs) > 0 && len(upgrader.Subprotocols) == 0) || handshakeTimeout > 0 {
+		copied := *upgrader
+		if handshakeTimeout > 0 {
+			copied.HandshakeTimeout = handshakeTimeout
+		}
+		if c.EnableCompression {
+			copied.EnableCompression = true
+		}
+		if len(copied.Subprotocols) == 0 {
+			copied.Subprotocols = codecSubprotocols(c.Codecs)
+		}
+		upgrader = &copied
+	}
+	counter := new(byteCounter)
+	hijacker := &countHijacker{ResponseWriter: rw, counter: counter}
+	upgradeReq := req
+	var stream *extendedConnectWriter
+	if extendedConnect {
+		stream = &extendedConnectWriter{ResponseWriter: rw, req: req}
+		hijacker.ResponseWriter = stream
+		upgradeReq = extendedConnectRequest(req)
+	}
+	ws, err := upgrader.Upgrade(hijacker, upgradeReq, respHeader)
 	if err != nil {
+		u.active.Add(-1)
 		return nil, err
 	}
-	if len(u.Upgrader.Subprotocols) > 0 && respHeader.Get("Sec-Websocket-Protocol") == "" {
+	if stream != nil {
+		// the handshake response is sent as the HTTP/2 headers
+		counter.sent.Store(0)
+	}
+	if len(c.Upgrader.Subprotocols) > 0 && respHeader.Get("Sec-Websocket-Protocol") == "" {
 		sp := ws.Subprotocol()
 		ok := false
-		for _, p := range u.Upgrader.Subprotocols {
+		for _, p := range c.Upgrader.Subprotocols {
 			if p == sp {
 				ok = true
 				break
 			}
 		}
 		if !ok {
+			u.active.Add(-1)
 			return nil, ErrNoSubprotocol
 		}
 	}
 	w := &WebSocket{
 		ws:              ws,
-		pingInterval:    u.PingInterval,
-		pongTimeout:     u.PongTimeout,
-		minBatchTimeout: u.MinBatchTimeout,
-		maxBatchTimeout: u.MaxBatchTimeout,
+		counter:         counter,
+		clientIP:        requestClientIP(req, c.TrustedProxies),
+		peerCerts:       requestPeerCertificates(req),
+		codec:           selectCodec(c.Codecs, ws.Subprotocol(), c.Codec),
+		metrics:         c.Metrics,
+		logger:          c.Logger,
+		idleTimeout:     c.IdleTimeout,
+		writeTimeout:    c.WriteTimeout,
+		readTimeout:     c.ReadTimeout,
+		onPanic:         c.OnPanic,
+		onPong:          c.OnPong,
+		onPingTimeout:   c.OnPingTimeout,
+		onPeerClose:     c.OnPeerClose,
+		noCloseEcho:     c.NoCloseEcho,
+		batchFraming:    c.BatchFraming,
+		rawJSONRPC:      c.RawJSONRPC,
+		flushPolicy:     c.FlushFailurePolicy,
+		onRawFrame:      c.OnRawFrame,
+		onDecodeError:   c.OnDecodeError,
+		onSend:          c.OnSend,
+		onReceive:       c.OnReceive,
+		onSendSpan:      c.OnSendSpan,
+		onReceiveSpan:   c.OnReceiveSpan,
+		dispatchWorkers: c.DispatchWorkers,
+		dispatchQueue:   c.DispatchQueueSize,
+		debugLimit:      c.DebugPayloadLimit,
+		debugRedact:     c.DebugRedact,
+		pingMessage:     c.PingMessage,
+		validatePong:    c.ValidatePong,
+		maxBatchCount:   c.MaxBatchCount,
+		maxBatchBytes:   c.MaxBatchBytes,
+		maxMessageSize:  c.MaxMessageSize,
+		onLargeMessage:  c.OnLargeMessage,
+		largeThreshold:  c.LargeMessageThreshold,
+		maxPendingMsgs:  c.MaxPendingMessages,
+		maxPendingBytes: c.MaxPendingBytes,
+		sendQueueSize:   c.SendQueueSize,
+
+		onQueueHighWater: c.OnQueueHighWater,
+		highWaterMsgs:    c.QueueHighWaterMessages,
+		highWaterBytes:   c.QueueHighWaterBytes,
+
+		compression:          upgrader.EnableCompression && hasPerMessageDeflate(req.Header),
+		compressionThreshold: c.CompressionThreshold,
+
+		inboundRateLimit: c.InboundRateLimit,
+		inboundBurst:     c.InboundBurst,
+		rateLimitAction:  c.RateLimitAction,
+
+		controlRateLimit:  c.MaxControlFramesPerSec,
+		outboundRateLimit: c.OutboundRateLimit,
+		outboundBurst:     c.OutboundBurst,
+		maxControlFrames:  c.MaxConsecutiveControlFrames,
+		maxStreams:        c.MaxStreams,
+
+		sessionStore:      c.SessionStore,
+		rejectBeforeAuth:  c.RejectBeforeAuth,
+		closeFlushTimeout: c.CloseFlushTimeout,
+		closeTimeout:      c.CloseHandshakeTimeout,
+		keepaliveMatcher:  c.KeepaliveMatcher,
+		appPing:           c.AutoPongAppMessages.normalized(),
+		ackInterval:       c.AckInterval,
+		maxUnacked:        c.MaxUnackedMessages,
+		eagerFirstSend:    c.EagerFirstSend,
+		clock:             c.Clock,
+
+		duplicateAuth: c.OnDuplicateAuth,
+	}
+	if c.OnDuplicateAuth == DuplicateAuthReauth && c.Reauthorizer != nil {
+		w.unrequestedAuth = make(chan json.RawMessage, 1)
+	}
+	if preAuthData != nil {
+		w.setAuthData(preAuthData)
+	}
+	w.pingInterval.Store((int64)(c.PingInterval))
+	w.pongTimeout.Store((int64)(c.PongTimeout))
+	w.minBatchTimeout.Store((int64)(c.MinBatchTimeout))
+	w.maxBatchTimeout.Store((int64)(c.MaxBatchTimeout))
+	baseCtx := &valuesContext{Context: req.Context()}
+	w.ctx, w.cancel = context.WithCancelCause(baseCtx)
+	if c.MaxConnectionDuration > 0 {
+		closeTimeout := c.CloseHandshakeTimeout
+		if closeTimeout <= 0 {
+			closeTimeout = closeHandshakeTimeout
+		}
+		var cancelDeadline context.CancelFunc
+		w.ctx, cancelDeadline = context.WithTimeoutCause(w.ctx, c.MaxConnectionDuration+closeTimeout, ErrMaxDuration)
+		context.AfterFunc(w.ctx, cancelDeadline)
+	}
+	if stream != nil {
+		w.ctx, w.cancel = stream.conn.bind(w.ctx, w.cancel)
 	}
-	w.ctx, w.cancel = context.WithCancelCause(req.Context())
 	context.AfterFunc(w.ctx, func() {
 		ws.Close()
+		u.active.Add(-1)
 	})
+	if err := w.initCompression(c.CompressionLevel); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if mode == upgradeAsync {
+		w.holdMessages()
+	}
 	w.init()
-	if u.Authorizer != nil {
-		if err := w.WriteMessage("$auth_ready", nil); err != nil {
-			w.Close()
+	w.applyTCPOptions(c.TCPNoDelay, c.TCPKeepAlive)
+	switch mode {
+	case upgradeHandoff:
+		// the handshake response was discarded
+		counter.sent.Store(0)
+		go w.pingHelper()
+		if c.MaxConnectionDuration > 0 {
+			go w.maxDurationHelper(c.MaxConnectionDuration)
+		}
+		w.ready()
+		if err := u.register(w); err != nil {
 			return nil, err
 		}
-		w.Flush()
-		authTimeout := u.AuthTimeout
-		if authTimeout <= 0 {
-			authTimeout = time.Second * 10
+		return w, nil
+	case upgradeAsync:
+		go func() {
+			w.finishAuth(u.handshake(c, w, req, baseCtx, upgradeDeadline))
+		}()
+		return w, nil
+	}
+	if err := u.handshake(c, w, req, baseCtx, upgradeDeadline); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// handshake does the auth handshake and sends the ready message
+// The connection is closed if it returns an error
+func (u *Upgrader) handshake(c *Upgrader, w *WebSocket, req *http.Request, baseCtx *valuesContext, upgradeDeadline time.Time) error {
+	// stopUpgradeTimer returns false if the upgrade timeout is exceeded
+	stopUpgradeTimer := func() bool { return true }
+	if !upgradeDeadline.IsZero() {
+		timer := w.clock.NewTimer(max(upgradeDeadline.Sub(w.clock.Now()), 0))
+		stopped := make(chan struct{})
+		go func() {
+			select {
+			case <-timer.C():
+				w.cancel(ErrUpgradeTimeout)
+			case <-stopped:
+			case <-w.ctx.Done():
+			}
+		}()
+		stopUpgradeTimer = sync.OnceValue(func() bool {
+			defer close(stopped)
+			return timer.Stop()
+		})
+		defer stopUpgradeTimer()
+	}
+	go w.pingHelper()
+	if c.MaxConnectionDuration > 0 {
+		go w.maxDurationHelper(c.MaxConnectionDuration)
+	}
+	authTimeout := c.AuthTimeout
+	if authTimeout <= 0 {
+		authTimeout = time.Second * 10
+	}
+	authorizer := c.AuthorizerContext
+	if authorizer == nil && c.ContextAuthorizer != nil {
+		authorizer = func(ctx context.Context, msg json.RawMessage) (context.Context, any, error) {
+			data, err := c.ContextAuthorizer(ctx, msg)
+			return nil, data, err
 		}
-		authMsg, err := w.readAuthMessage(authTimeout)
-		if err != nil {
-			w.Close()
-			return nil, err
+	}
+	if authorizer == nil && c.CertAuthorizer != nil {
+		authorizer = func(_ context.Context, msg json.RawMessage) (context.Context, any, error) {
+			data, err := c.CertAuthorizer(w.peerCerts, msg)
+			return nil, data, err
 		}
-		if w.authData, err = u.Authorizer(authMsg); err != nil {
-			w.WriteMessage("$error", "auth failed")
-			w.Close()
-			return nil, err
+	}
+	if authorizer == nil && c.RequestAuthorizer != nil {
+		authorizer = func(_ context.Context, msg json.RawMessage) (context.Context, any, error) {
+			data, err := c.RequestAuthorizer(req, msg)
+			return nil, data, err
+		}
+	}
+	authorizeFn := c.Authorizer
+	sa := u.authorizer.Load()
+	if sa != nil && sa.fn != nil {
+		authorizeFn = sa.fn
+	}
+	// authGen is the generation of SetAuthorizer if Authorizer is used
+	var authGen uint64
+	if authorizer == nil && authorizeFn != nil {
+		if sa != nil {
+			authGen = sa.gen
+		}
+		authorizer = func(_ context.Context, msg json.RawMessage) (context.Context, any, error) {
+			data, err := authorizeFn(msg)
+			return nil, data, err
 		}
 	}
-	if err := w.WriteMessage("$ready", &ReadyMessage{
-		PingInterval: w.pingInterval.Milliseconds(),
-		PongTimeout:  w.pongTimeout.Milliseconds(),
+	var authExpiry time.Time
+	if authorizer == nil && c.ExpiringAuthorizer != nil {
+		authorizer = func(_ context.Context, msg json.RawMessage) (context.Context, any, error) {
+			data, expiry, err := c.ExpiringAuthorizer(msg)
+			authExpiry = expiry
+			return nil, data, err
+		}
+	}
+	binaryAuth := authorizer == nil && c.BinaryAuthorizer != nil
+	var binaryAuthMsg []byte
+	if binaryAuth {
+		authorizer = func(context.Context, json.RawMessage) (context.Context, any, error) {
+			data, err := c.BinaryAuthorizer(binaryAuthMsg)
+			return nil, data, err
+		}
+	} else if authorizer != nil && c.AuthValidator != nil {
+		authorize := authorizer
+		authorizer = func(ctx context.Context, msg json.RawMessage) (context.Context, any, error) {
+			if err := validateAuth(c.AuthValidator, msg); err != nil {
+				return nil, nil, err
+			}
+			return authorize(ctx, msg)
+		}
+	}
+	reauthorizer := c.Reauthorizer
+	if reauthorizer != nil && c.AuthValidator != nil {
+		reauthorizer = func(old any, msg json.RawMessage) (any, error) {
+			if err := validateAuth(c.AuthValidator, msg); err != nil {
+				return nil, err
+			}
+			return c.Reauthorizer(old, msg)
+		}
+	}
+	if authorizer != nil || c.SessionStore != nil {
+		w.setState(WSAuthenticating)
+		var authMsg json.RawMessage
+		fromRequest := c.AuthSource != AuthFirstFrame
+		if fromRequest {
+			if binaryAuth {
+				if token := requestAuthToken(req, c.AuthSource, c.AuthParam); token != "" {
+					binaryAuthMsg = ([]byte)(token)
+				}
+			} else {
+				authMsg = requestAuthMessage(req, c.AuthSource, c.AuthParam)
+			}
+		}
+		// the handshake is still needed to receive the resume request
+		if !fromRequest || c.SessionStore != nil {
+			var authReady any
+			if c.SessionStore != nil || binaryAuth {
+				authReady = &authReadyMessage{
+					Session:  c.SessionStore != nil,
+					Optional: authorizer == nil || fromRequest,
+					Binary:   binaryAuth && !fromRequest,
+				}
+			}
+			readBinary := binaryAuth && !fromRequest
+			if readBinary {
+				w.binaryAuth.Store(true)
+			}
+			if err := w.writeInternal("$auth_ready", authReady); err != nil {
+				w.Abort()
+				return err
+			}
+			w.Flush()
+			var (
+				frameMsg json.RawMessage
+				err      error
+			)
+			if readBinary {
+				binaryAuthMsg, err = w.readBinaryAuthMessage(authTimeout)
+				w.binaryAuth.Store(false)
+			} else {
+				frameMsg, err = w.readAuthMessage(authTimeout)
+			}
+			if err != nil {
+				w.metrics.OnAuthFailure(err)
+				w.Abort()
+				return err
+			}
+			if !fromRequest {
+				authMsg = frameMsg
+			}
+		}
+		if authorizer != nil {
+			var (
+				authCtx  context.Context
+				authData any
+				expiry   time.Time
+				cacheKey string
+				cached   bool
+				err      error
+			)
+			if c.AuthCache != nil {
+				if binaryAuth {
+					cacheKey = AuthCacheKey(binaryAuthMsg)
+				} else {
+					cacheKey = AuthCacheKey(authMsg)
+				}
+				if authGen > 0 {
+					cacheKey += "." + strconv.FormatUint(authGen, 10)
+				}
+				authData, expiry, cached = c.AuthCache.Get(cacheKey)
+				// the cached results are still validated, so a stricter AuthValidator applies to the cached credentials
+				if cached && !binaryAuth && c.AuthValidator != nil {
+					err = validateAuth(c.AuthValidator, authMsg)
+				}
+			}
+			if !cached {
+				// authCtx must not be derived from w.ctx, or the value lookups will be looping
+				reqCtx, cancelReq := context.WithCancelCause(req.Context())
+				context.AfterFunc(w.ctx, func() {
+					cancelReq(context.Cause(w.ctx))
+				})
+				// the deadline uses the real time like the network deadlines, so the external calls can use it
+				authorizeCtx, cancelAuthorize := context.WithDeadlineCause(reqCtx, time.Now().Add(authTimeout), ErrAuthTimeout)
+				authCtx, authData, err = w.authorizeWithin(authTimeout, func(msg json.RawMessage) (context.Context, any, error) {
+					defer cancelAuthorize()
+					return authorizer(authorizeCtx, msg)
+				}, authMsg)
+				// authExpiry must not be read if the authorizer timed out, since it may be still running
+				if err == ErrAuthTimeout {
+					cancelReq(err)
+					if c.OnAuthTimeout == AuthTimeoutFallback {
+						w.logger.Warn("Authorizer timed out, using fallback auth data")
+						authData, err = &FallbackAuth{Data: c.FallbackAuthData}, nil
+					}
+				} else {
+					expiry = authExpiry
+					if err == nil && authCtx == nil && c.AuthCache != nil {
+						c.AuthCache.Set(cacheKey, authData, expiry)
+					}
+				}
+			}
+			if err != nil {
+				if err != ErrAuthTimeout {
+					err = rejectAuth(err)
+				}
+				w.metrics.OnAuthFailure(err)
+				var authErr *AuthError
+				if errors.As(err, &authErr) {
+					w.closeWithCause(authErr.Code, authErr.Reason, err)
+				} else {
+					w.writeInternal("$error", "auth failed")
+					w.cancel(err)
+				}
+				return err
+			}
+			w.setAuthData(authData)
+			if authCtx != nil {
+				baseCtx.setValues(authCtx)
+			}
+			if reauthorizer != nil && (c.ReauthInterval > 0 || !expiry.IsZero() || w.unrequestedAuth != nil) {
+				go w.reauthHelper(c.ReauthInterval, authTimeout, expiry, reauthorizer)
+			} else if !expiry.IsZero() {
+				go w.authExpiryHelper(expiry)
+			}
+		}
+	}
+	var replay []*Message
+	if c.SessionStore != nil {
+		var err error
+		identity := ""
+		if authData := w.AuthData(); authData != nil {
+			if c.SessionIdentity != nil {
+				identity = c.SessionIdentity(authData)
+			} else {
+				identity = fmt.Sprint(authData)
+			}
+		}
+		if replay, err = w.startSession(c.SessionStore, identity); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.writeInternal("$ready", &ReadyMessage{
+		PingInterval: w.PingInterval().Milliseconds(),
+		PongTimeout:  w.PongTimeout().Milliseconds(),
+		Session:      w.sessionToken,
+		Resumed:      w.resumed,
 	}); err != nil {
-		w.Close()
-		return nil, err
+		w.Abort()
+		return err
+	}
+	for _, msg := range replay {
+		if err := w.enqueue(&pendingMessage{msg: msg}); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if c.InitialMessage != nil {
+		if err := w.sendInitialMessage(c.InitialMessageType, c.InitialMessage); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if !stopUpgradeTimer() {
+		w.cancel(ErrUpgradeTimeout)
+		return ErrUpgradeTimeout
 	}
 	w.Flush()
-	return w, nil
+	w.ready()
+	return u.register(w)
+}
+
+// register adds the connection to the Upgrader's connections after the handshake
+// Shutdown only closes the connections already added, so the connection is closed if Shutdown is called during its handshake
+func (u *Upgrader) register(w *WebSocket) error {
+	u.conns.Add(w)
+	if u.shutdown.Load() {
+		w.closeWithCause(websocket.CloseGoingAway, "shutdown", ErrShutdown)
+		return ErrShutdown
+	}
+	return nil
+}
+
+// authorize calls the authorizer, and converts panics to errors
+func (w *WebSocket) authorize(authorizer func(json.RawMessage) (any, error), msg json.RawMessage) (data any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = w.handlePanic(r)
+		}
+	}()
+	return authorizer(msg)
+}
+
+// sendInitialMessage queues the initial message before the held messages, and converts panics to errors
+func (w *WebSocket) sendInitialMessage(typ string, initial func(authData any) (any, error)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = w.handlePanic(r)
+		}
+	}()
+	data, err := initial(w.AuthData())
+	if err != nil || data == nil {
+		return err
+	}
+	if typ == "" {
+		typ = "init"
+	}
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	return w.enqueue(&pendingMessage{msg: msg, initial: true})
+}
+
+type authResult struct {
+	ctx  context.Context
+	data any
+	err  error
+}
+
+// authorizeWithin calls the authorizer in a new goroutine, and returns ErrAuthTimeout if it does not return within the timeout
+func (w *WebSocket) authorizeWithin(timeout time.Duration, authorizer func(json.RawMessage) (context.Context, any, error), msg json.RawMessage) (context.Context, any, error) {
+	resCh := make(chan authResult, 1)
+	go func() {
+		var ctx context.Context
+		data, err := w.authorize(func(msg json.RawMessage) (data any, err error) {
+			ctx, data, err = authorizer(msg)
+			return
+		}, msg)
+		resCh <- authResult{ctx, data, err}
+	}()
+	timer := w.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-resCh:
+		return res.ctx, res.data, res.err
+	case <-timer.C():
+		return nil, nil, ErrAuthTimeout
+	}
+}
+
+// maxDurationHelper closes the connection with ErrMaxDuration after the duration
+func (w *WebSocket) maxDurationHelper(duration time.Duration) {
+	timer := w.clock.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		w.closeWithCause(websocket.CloseGoingAway, "max duration", ErrMaxDuration)
+	case <-w.ctx.Done():
+	}
+}
+
+// authExpiryHelper closes the connection with ErrAuthExpired when the auth expires
+func (w *WebSocket) authExpiryHelper(expiry time.Time) {
+	timer := w.clock.NewTimer(max(expiry.Sub(w.clock.Now()), 0))
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		w.metrics.OnAuthFailure(ErrAuthExpired)
+		w.closeWithCause(CloseReauthFailed, "auth expired", ErrAuthExpired)
+	case <-w.ctx.Done():
+	}
+}
+
+// reauthHelper asks the opposite to re-authorize every interval, and when the auth expires
+// The interval is disabled if it's not positive, and the expiry is disabled if it's zero
+func (w *WebSocket) reauthHelper(interval time.Duration, timeout time.Duration, expiry time.Time, reauthorizer func(any, json.RawMessage) (any, error)) {
+	var timer, expiryTimer Timer
+	var timerC, expiryC <-chan time.Time
+	if interval > 0 {
+		timer = w.clock.NewTimer(interval)
+		defer timer.Stop()
+		timerC = timer.C()
+	}
+	if !expiry.IsZero() {
+		expiryTimer = w.clock.NewTimer(max(expiry.Sub(w.clock.Now()), 0))
+		defer expiryTimer.Stop()
+		expiryC = expiryTimer.C()
+	}
+	for {
+		var authMsg json.RawMessage
+		requested := true
+		select {
+		case <-timerC:
+			timer.Reset(interval)
+		case <-expiryC:
+			expiryC = nil
+		case authMsg = <-w.unrequestedAuth:
+			requested = false
+		case <-w.ctx.Done():
+			return
+		}
+		var err error
+		if requested {
+			// drop any unrequested auth message
+			select {
+			case <-w.authCh:
+			default:
+			}
+			w.authRequested.Store(true)
+			if err := w.writeInternal("$auth_ready", nil); err != nil {
+				return
+			}
+			w.Flush()
+			authMsg, err = w.readAuthMessage(timeout)
+			w.authRequested.Store(false)
+		}
+		if err == nil {
+			var authData any
+			if authData, err = w.authorize(func(msg json.RawMessage) (any, error) {
+				return reauthorizer(w.AuthData(), msg)
+			}, authMsg); err == nil {
+				w.setAuthData(authData)
+				// the new auth message is authorized, so the old expiry no longer applies
+				if expiryTimer != nil {
+					expiryTimer.Stop()
+					expiryC = nil
+				}
+				continue
+			}
+			err = rejectAuth(err)
+		}
+		if w.ctx.Err() == nil {
+			w.metrics.OnAuthFailure(err)
+			var authErr *AuthError
+			if errors.As(err, &authErr) {
+				w.closeWithCause(authErr.Code, authErr.Reason, err)
+			} else {
+				w.closeWithCause(CloseReauthFailed, "reauth failed", err)
+			}
+		}
+		return
+	}
 }
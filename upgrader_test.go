@@ -0,0 +1,166 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownDuringAuth(t *testing.T) {
+	authorizing := make(chan struct{})
+	release := make(chan struct{})
+	up := &aws.Upgrader{
+		Upgrader: &websocket.Upgrader{},
+		Authorizer: func(json.RawMessage) (any, error) {
+			close(authorizing)
+			<-release
+			return nil, nil
+		},
+	}
+	errCh := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, err := up.Upgrade(rw, req, nil)
+		errCh <- err
+	}))
+	defer srv.Close()
+	d := &aws.Dialer{
+		Dialer: websocket.DefaultDialer,
+		AuthProvider: func(context.Context) (json.RawMessage, error) {
+			return json.RawMessage(`"token"`), nil
+		},
+	}
+	go func() {
+		if c, _, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil); err == nil {
+			c.Close()
+		}
+	}()
+	<-authorizing
+	if err := up.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, aws.ErrShutdown) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upgrade did not return")
+	}
+	if n := len(up.Connections()); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestSetAuthorizerAuthCache(t *testing.T) {
+	var oldCalls, newCalls atomic.Int32
+	up := &aws.Upgrader{
+		Upgrader: &websocket.Upgrader{},
+		Authorizer: func(json.RawMessage) (any, error) {
+			oldCalls.Add(1)
+			return "old", nil
+		},
+		AuthCache: aws.NewMemoryAuthCache(16, time.Minute),
+	}
+	d := &aws.Dialer{AuthProvider: func(context.Context) (json.RawMessage, error) {
+		return json.RawMessage(`"token"`), nil
+	}}
+	authData := func() any {
+		s, _ := pair(t, up, d)
+		return s.AuthData()
+	}
+	if data := authData(); data != "old" {
+		t.Fatal(data)
+	}
+	up.SetAuthorizer(func(json.RawMessage) (any, error) {
+		newCalls.Add(1)
+		return "new", nil
+	})
+	for range 2 {
+		if data := authData(); data != "new" {
+			t.Fatal("cached result of the old authorizer is used", data)
+		}
+	}
+	up.SetAuthorizer(nil)
+	if data := authData(); data != "old" {
+		t.Fatal("cached result of the new authorizer is used", data)
+	}
+	if o, n := oldCalls.Load(), newCalls.Load(); o != 2 || n != 1 {
+		t.Fatal("unexpected authorizer calls", o, n)
+	}
+}
+
+func TestAuthCacheValidated(t *testing.T) {
+	var strict atomic.Bool
+	var calls atomic.Int32
+	up := &aws.Upgrader{
+		Upgrader: &websocket.Upgrader{},
+		Authorizer: func(json.RawMessage) (any, error) {
+			calls.Add(1)
+			return "data", nil
+		},
+		AuthValidator: func(json.RawMessage) error {
+			if strict.Load() {
+				return errors.New("validator tightened")
+			}
+			return nil
+		},
+		AuthCache: aws.NewMemoryAuthCache(16, time.Minute),
+	}
+	errs := make(chan error, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w, err := up.Upgrade(rw, req, nil)
+		errs <- err
+		if err == nil {
+			<-w.Context().Done()
+		}
+	}))
+	defer srv.Close()
+	d := &aws.Dialer{Dialer: websocket.DefaultDialer, AuthProvider: func(context.Context) (json.RawMessage, error) {
+		return json.RawMessage(`"token"`), nil
+	}}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	c, _, err := d.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	strict.Store(true)
+	if c, _, err := d.Dial(url, nil); err == nil {
+		c.Close()
+	}
+	if err := <-errs; !errors.Is(err, aws.ErrInvalidAuthMessage) {
+		t.Fatal("cached result is not validated", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatal("unexpected authorizer calls", n)
+	}
+}
@@ -0,0 +1,1220 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrSlowConsumer is the cause when the outbound queue exceeded the limit
+var ErrSlowConsumer = errors.New("Slow consumer: too many pending messages")
+
+// ErrWriteTimeout is the cause when a frame cannot be written within the write timeout
+// It also matches os.ErrDeadlineExceeded
+var ErrWriteTimeout = fmt.Errorf("Write timeout: %w", os.ErrDeadlineExceeded)
+
+// ErrQueueFull is returned when the outbound queue has no room for a non-blocking send
+var ErrQueueFull = errors.New("Outbound queue is full")
+
+// FlushFailurePolicy decides the results reported to the senders when a flush writes several frames and one of them failed,
+// such as a batch split by MaxBatchCount or MaxBatchBytes, or FramingOneFramePerMessage
+// The connection is always closed after a write failure, and the failed messages are not retried
+// They cannot be re-queued since a write error of gorilla/websocket is sticky, no frame can be written on the connection after it
+// With SessionStore the sequenced ones are still replayed after the session is resumed, as they are appended before being written
+type FlushFailurePolicy int
+
+const (
+	// FlushStopOnError stops at the failed frame, the messages of the frames written before it succeed,
+	// and the messages of the failed frame and the following ones receive the error instead of being re-queued
+	FlushStopOnError FlushFailurePolicy = iota
+	// FlushAllOrNothing reports the error to all messages of the flush, including the ones in the frames written before the failed one,
+	// so none of the messages of a failed flush is considered delivered, though the opposite may have received some of them
+	// The senders of a successful flush are notified after all frames are written
+	FlushAllOrNothing
+)
+
+const (
+	pendingQueued int32 = iota
+	pendingTaken
+	pendingCancelled
+)
+
+type pendingMessage struct {
+	// msg is nil if the pending message is a binary frame
+	msg    *Message
+	binary []byte
+	// text makes binary written as a text frame, it's used by the replies of the application level pings
+	text bool
+	// frame is the pre-encoded msg, it's only set for JSONCodec and ignored if msg is sequenced
+	frame []byte
+	state atomic.Int32
+	// slot is true if the message holds a slot of the bounded queue
+	slot bool
+	// barrier is true if the pending message is only used to wait for the messages queued before it
+	barrier bool
+	// initial is true for the Upgrader's InitialMessage, which is queued during the handshake and never held
+	initial bool
+	// key is set by SendKeyed, the queued message with the same key will be replaced
+	key string
+	// flushBy is the latest time the message should be flushed, can be zero
+	flushBy time.Time
+	// expireAt is set by SendWithTTL, the message is dropped if it's not flushed before it
+	expireAt time.Time
+	// priority decides the position in the queue, higher priority messages are written first
+	priority int
+	// compress is set by SendCompressed, positive forces the compression and negative disables it,
+	// zero follows the compression threshold
+	compress int8
+	// done will receive the result after the message is flushed, can be nil
+	done chan error
+}
+
+// internal reports whether the pending message is an internal message, such as $ping or $ack
+func (p *pendingMessage) internal() bool {
+	return p.msg != nil && len(p.msg.Type) > 0 && p.msg.Type[0] == '$'
+}
+
+func (p *pendingMessage) take() bool {
+	return p.state.CompareAndSwap(pendingQueued, pendingTaken)
+}
+
+func (p *pendingMessage) cancel() bool {
+	return p.state.CompareAndSwap(pendingQueued, pendingCancelled)
+}
+
+func (p *pendingMessage) finish(err error) {
+	if p.done != nil {
+		p.done <- err
+	}
+}
+
+func (p *pendingMessage) size() int {
+	if p.msg == nil {
+		return len(p.binary)
+	}
+	return len(p.msg.Type) + len(p.msg.Data)
+}
+
+func (w *WebSocket) enqueue(p *pendingMessage) error {
+	if w.ctx.Err() != nil {
+		return w.closedError()
+	}
+	if w.rawJSONRPC && p.msg != nil {
+		return ErrRawJSONRPC
+	}
+	if w.writeClosed.Load() {
+		// internal messages and barriers are still accepted until the write goroutine is stopped
+		select {
+		case <-w.writeStop:
+			return ErrWriteClosed
+		default:
+		}
+		if !p.barrier && !p.internal() {
+			return ErrWriteClosed
+		}
+	}
+	if w.draining.Load() && !p.barrier && !p.internal() {
+		return ErrDraining
+	}
+	w.queueMux.Lock()
+	if held, err := w.holdMessage(p); held {
+		w.queueMux.Unlock()
+		return err
+	}
+	// the internal messages such as the pings and acks are never limited, or the keepalive would fail first
+	if !p.barrier && !p.internal() && ((w.maxPendingMsgs > 0 && w.queueCount >= w.maxPendingMsgs) ||
+		(w.maxPendingBytes > 0 && w.queueBytes+p.size() > w.maxPendingBytes)) {
+		w.queueMux.Unlock()
+		w.countDrop(dropSlowConsumer, 1)
+		go w.closeWithCause(websocket.ClosePolicyViolation, "slow consumer", ErrSlowConsumer)
+		return ErrSlowConsumer
+	}
+	if err := w.sequence(p); err != nil {
+		w.queueMux.Unlock()
+		if err == ErrSlowConsumer {
+			w.countDrop(dropSlowConsumer, 1)
+			go w.closeWithCause(websocket.ClosePolicyViolation, "slow consumer", ErrSlowConsumer)
+		}
+		return err
+	}
+	replaced := w.replaceKeyed(p)
+	if !replaced {
+		w.insertQueue(p)
+		w.queueBytes += p.size()
+		if !p.barrier {
+			w.queueCount++
+		}
+	}
+	if !p.flushBy.IsZero() && (w.queueFlushBy.IsZero() || p.flushBy.Before(w.queueFlushBy)) {
+		w.queueFlushBy = p.flushBy
+	}
+	highWater := w.reachHighWater()
+	count, bytes := w.queueCount, w.queueBytes
+	w.queueMux.Unlock()
+	w.appendAfterClosed()
+	if replaced {
+		w.countDrop(dropReplaced, 1)
+	}
+	if highWater {
+		w.onQueueHighWater(count, bytes)
+	}
+	select {
+	case w.queueSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// enqueueAll queues the application messages under one lock acquisition, and signals the write goroutine once
+// It returns the count of the queued messages, which may be less than len(ps) if an error is returned
+func (w *WebSocket) enqueueAll(ps []*pendingMessage) (queued int, err error) {
+	if w.ctx.Err() != nil {
+		return 0, w.closedError()
+	}
+	if w.rawJSONRPC {
+		return 0, ErrRawJSONRPC
+	}
+	if w.writeClosed.Load() {
+		return 0, ErrWriteClosed
+	}
+	if w.draining.Load() {
+		return 0, ErrDraining
+	}
+	// the write goroutine is signaled even if only a part of the messages are queued
+	defer func() {
+		if queued > 0 {
+			select {
+			case w.queueSignal <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	size := 0
+	for _, p := range ps {
+		size += p.size()
+	}
+	w.queueMux.Lock()
+	if (w.maxPendingMsgs > 0 && w.queueCount+len(ps) > w.maxPendingMsgs) ||
+		(w.maxPendingBytes > 0 && w.queueBytes+size > w.maxPendingBytes) {
+		w.queueMux.Unlock()
+		w.countDrop(dropSlowConsumer, len(ps))
+		go w.closeWithCause(websocket.ClosePolicyViolation, "slow consumer", ErrSlowConsumer)
+		return 0, ErrSlowConsumer
+	}
+	for _, p := range ps {
+		if held, err := w.holdMessage(p); held {
+			if err != nil {
+				w.queueMux.Unlock()
+				return queued, err
+			}
+			queued++
+			continue
+		}
+		if err := w.sequence(p); err != nil {
+			w.queueMux.Unlock()
+			if err == ErrSlowConsumer {
+				w.countDrop(dropSlowConsumer, len(ps)-queued)
+				go w.closeWithCause(websocket.ClosePolicyViolation, "slow consumer", ErrSlowConsumer)
+			}
+			return queued, err
+		}
+		w.insertQueue(p)
+		w.queueBytes += p.size()
+		w.queueCount++
+		queued++
+	}
+	highWater := w.reachHighWater()
+	count, bytes := w.queueCount, w.queueBytes
+	w.queueMux.Unlock()
+	w.appendAfterClosed()
+	if highWater {
+		w.onQueueHighWater(count, bytes)
+	}
+	return queued, nil
+}
+
+// replaceKeyed replaces the queued message which has the same key with p, it reports whether a message is replaced
+// Keyed messages are not replaced if the messages are sequenced, since every sequence must be delivered
+// It must be called with queueMux locked
+func (w *WebSocket) replaceKeyed(p *pendingMessage) bool {
+	if p.key == "" || w.sequenced() {
+		return false
+	}
+	if old, ok := w.queueKeys[p.key]; ok {
+		for i, q := range w.queue {
+			if q == old {
+				// keep the position, so the messages waited by Flush are still written before it returns
+				w.queue[i] = p
+				w.queueKeys[p.key] = p
+				w.queueBytes += p.size() - old.size()
+				w.releaseSlot(old)
+				return true
+			}
+		}
+	}
+	if w.queueKeys == nil {
+		w.queueKeys = make(map[string]*pendingMessage)
+	}
+	w.queueKeys[p.key] = p
+	return false
+}
+
+// reachHighWater reports whether onQueueHighWater should be called for the queue just grown
+// It must be called with queueMux locked
+func (w *WebSocket) reachHighWater() bool {
+	if w.onQueueHighWater == nil || w.highWater {
+		return false
+	}
+	if (w.highWaterMsgs > 0 && w.queueCount >= w.highWaterMsgs) || (w.highWaterBytes > 0 && w.queueBytes >= w.highWaterBytes) {
+		w.highWater = true
+		return true
+	}
+	return false
+}
+
+// enqueueContext waits until the bounded queue has room, then queues the message
+// If SendQueueSize is not set, it's the same as enqueue
+func (w *WebSocket) enqueueContext(ctx context.Context, p *pendingMessage) (err error) {
+	// the messages waited by enqueueAndWait are traced there
+	if p.done == nil {
+		if end := w.traceSend(ctx, p); end != nil {
+			defer func() { end(err) }()
+		}
+	}
+	if w.sendSlots != nil {
+		done, err := w.sendSlots.acquire(ctx, w.ctx.Done(), w.closedError)
+		if err != nil {
+			return err
+		}
+		defer done()
+		p.slot = true
+	}
+	return w.enqueueSlot(p)
+}
+
+// tryEnqueue queues the message only if the bounded queue has room
+func (w *WebSocket) tryEnqueue(p *pendingMessage) (err error) {
+	if end := w.traceSend(context.Background(), p); end != nil {
+		defer func() { end(err) }()
+	}
+	if w.sendSlots != nil {
+		done, ok := w.sendSlots.tryAcquire()
+		if !ok {
+			w.countDrop(dropQueueFull, 1)
+			return ErrQueueFull
+		}
+		defer done()
+		p.slot = true
+	}
+	return w.enqueueSlot(p)
+}
+
+func (w *WebSocket) enqueueSlot(p *pendingMessage) error {
+	if err := w.enqueue(p); err != nil {
+		w.releaseSlot(p)
+		return err
+	}
+	return nil
+}
+
+func (w *WebSocket) releaseSlot(p *pendingMessage) {
+	if p.slot {
+		p.slot = false
+		w.sendSlots.release()
+	}
+}
+
+// insertQueue inserts the message after the last queued message which has the same or higher priority
+// It must be called with queueMux locked
+func (w *WebSocket) insertQueue(p *pendingMessage) {
+	i := len(w.queue)
+	if !w.sequenced() {
+		for i > 0 && w.queue[i-1].priority < p.priority {
+			i--
+		}
+	}
+	w.queue = append(w.queue, nil)
+	copy(w.queue[i+1:], w.queue[i:])
+	w.queue[i] = p
+}
+
+// LastError returns the first error occurred when writing the queued messages
+// It's useful to detect the write failures after WriteMessage, which does not wait for the flush
+// Once a write failed, the connection will be closed and the later messages cannot be queued anymore
+func (w *WebSocket) LastError() error {
+	if err := w.writeErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// PendingCount returns the number of the messages queued but not yet flushed, including the internal messages
+// A producer can use it to back off before the queue is full, see also OnQueueHighWater
+func (w *WebSocket) PendingCount() int {
+	w.queueMux.Lock()
+	defer w.queueMux.Unlock()
+	return w.queueCount
+}
+
+// PendingBytes returns the size of the messages queued but not yet flushed, which is the sum of the type and data lengths
+func (w *WebSocket) PendingBytes() int {
+	w.queueMux.Lock()
+	defer w.queueMux.Unlock()
+	return w.queueBytes
+}
+
+// Send calls SendContext with context.Background()
+func (w *WebSocket) Send(typ string, data any) error {
+	return w.SendContext(context.Background(), typ, data)
+}
+
+// SendContext build and queue a message, then wait until the message is flushed
+// If SendQueueSize is set, it blocks until the queue has room before queueing the message
+// If ctx is done before the message is flushed, the context's cause will be returned,
+// and the message will be discarded if it's not being written yet
+func (w *WebSocket) SendContext(ctx context.Context, typ string, data any) error {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	p := &pendingMessage{
+		msg:  msg,
+		done: make(chan error, 1),
+	}
+	return w.enqueueAndWait(ctx, p)
+}
+
+// SendPriority calls SendPriorityContext with context.Background()
+func (w *WebSocket) SendPriority(typ string, data any, priority int) error {
+	return w.SendPriorityContext(context.Background(), typ, data, priority)
+}
+
+// SendPriorityContext is same as SendContext, but the message is placed before the queued messages which have lower priority
+// The messages have the same priority are kept in order, and the default priority is zero
+// Priority is ignored if session resumption or acknowledgement is enabled, since the messages must be sent in sequence
+func (w *WebSocket) SendPriorityContext(ctx context.Context, typ string, data any, priority int) error {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	p := &pendingMessage{
+		msg:      msg,
+		priority: priority,
+		done:     make(chan error, 1),
+	}
+	return w.enqueueAndWait(ctx, p)
+}
+
+// SendWithin build and queue a message, and guarantees the message will be flushed within maxDelay,
+// even if maxDelay is shorter than the batch timeouts
+// Other queued messages are flushed together, but the batch is not flushed immediately unless maxDelay is not positive
+// It will not wait for the message to be flushed
+func (w *WebSocket) SendWithin(typ string, data any, maxDelay time.Duration) error {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	return w.enqueueContext(context.Background(), &pendingMessage{
+		msg:     msg,
+		flushBy: w.clock.Now().Add(maxDelay),
+	})
+}
+
+// SendWithTTL build and queue a message, which is dropped instead of sent if it's not flushed within ttl,
+// so the stale messages queued during a stall are not sent as a burst after it, such as the updates of a real-time feed
+// The TTL is checked when the batch is flushed, the message is never dropped once it's being written
+// Messages are not dropped if session resumption or acknowledgement is enabled
+// It will not wait for the message to be flushed
+func (w *WebSocket) SendWithTTL(typ string, data any, ttl time.Duration) error {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	return w.enqueueContext(context.Background(), &pendingMessage{
+		msg:      msg,
+		expireAt: w.clock.Now().Add(ttl),
+	})
+}
+
+// SendKeyed build and queue a message, which replaces the queued but not yet flushed message with the same key,
+// so only the latest value of a key is sent in a batch, such as the state of an entity
+// The replacing message takes the position of the replaced one
+// Messages are not replaced if session resumption or acknowledgement is enabled
+// It will not wait for the message to be flushed
+func (w *WebSocket) SendKeyed(typ string, key string, data any) error {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	return w.enqueueContext(context.Background(), &pendingMessage{
+		msg: msg,
+		key: key,
+	})
+}
+
+// TrySend build and queue a message without blocking
+// It returns false if the message cannot be built, the queue is full, or the connection is closed
+// It will not wait for the message to be flushed
+func (w *WebSocket) TrySend(typ string, data any) bool {
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return false
+	}
+	return w.tryEnqueue(&pendingMessage{msg: msg}) == nil
+}
+
+// SendAll calls SendAllContext with context.Background()
+func (w *WebSocket) SendAll(typ string, vs []any) error {
+	return w.SendAllContext(context.Background(), typ, vs)
+}
+
+// SendAllContext builds a message of typ for each of vs, queues them at once, then waits until they are all flushed
+// It's faster than calling SendContext in a loop for a large amount of messages, such as an initial state dump,
+// since the queue is locked only once and the write goroutine is signaled only once
+// The messages are batched by the normal rules, except that they are queued one by one if SendQueueSize is set
+// If ctx is done before the messages are flushed, the context's cause will be returned,
+// and the messages not being written yet will be discarded
+func (w *WebSocket) SendAllContext(ctx context.Context, typ string, vs []any) error {
+	ps := make([]*pendingMessage, len(vs))
+	for i, v := range vs {
+		msg, err := w.buildMessage(typ, v)
+		if err != nil {
+			return err
+		}
+		ps[i] = &pendingMessage{msg: msg}
+	}
+	if len(ps) == 0 {
+		return nil
+	}
+	// the messages are flushed in order, so only the last one needs to be waited
+	last := ps[len(ps)-1]
+	last.done = make(chan error, 1)
+	ends := make([]func(error), len(ps))
+	for i, p := range ps {
+		ends[i] = w.traceSend(ctx, p)
+	}
+	var (
+		queued int
+		err    error
+	)
+	if w.sendSlots != nil {
+		for _, p := range ps {
+			if err = w.enqueueContext(ctx, p); err != nil {
+				break
+			}
+			queued++
+		}
+	} else {
+		queued, err = w.enqueueAll(ps)
+	}
+	if err != nil {
+		for i, p := range ps {
+			if i < queued {
+				p.cancel()
+			}
+			if ends[i] != nil {
+				ends[i](err)
+			}
+		}
+		return err
+	}
+	err = w.waitPending(ctx, last)
+	for i, p := range ps {
+		if err != nil {
+			p.cancel()
+		}
+		if ends[i] != nil {
+			ends[i](err)
+		}
+	}
+	return err
+}
+
+// SendEvery calls gen every interval, and queues the returned data as a message of typ until gen returns false,
+// the connection is closed, or stop is called
+// If interval is not positive, MaxBatchTimeout is used, so one message is generated for about each batch
+// The messages are batched as usual and SendEvery will not wait for them to be flushed
+// gen is called by the write goroutine, which shares one timer with all the generators of the connection,
+// so gen must not block or wait for the messages to be flushed
+// gen is not called anymore after stop returns, stop must not be called by gen
+func (w *WebSocket) SendEvery(typ string, interval time.Duration, gen func() (data any, ok bool)) (stop func()) {
+	if interval <= 0 {
+		if interval = w.MaxBatchTimeout(); interval <= 0 {
+			interval = time.Second
+		}
+	}
+	g := &generator{
+		typ:      typ,
+		interval: interval,
+		next:     w.clock.Now().Add(interval),
+		gen:      gen,
+	}
+	w.generatorMux.Lock()
+	w.generators = append(w.generators, g)
+	w.generatorMux.Unlock()
+	select {
+	case w.generatorSignal <- struct{}{}:
+	default:
+	}
+	return g.stop
+}
+
+// generator is a SendEvery generator, it's called by the write goroutine
+type generator struct {
+	typ      string
+	interval time.Duration
+	gen      func() (any, bool)
+
+	// mux is held while gen is called, so stop waits for it
+	mux     sync.Mutex
+	next    time.Time
+	stopped bool
+}
+
+func (g *generator) stop() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.stopped = true
+}
+
+// run calls gen if it's due, and reports whether the generator is still active
+func (g *generator) run(w *WebSocket, now time.Time) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.stopped {
+		return false
+	}
+	// a clock going backward must not delay the generator for longer than the interval
+	if wait := g.next.Sub(now); wait > g.interval {
+		g.next = now.Add(g.interval)
+	} else if wait > 0 {
+		return true
+	}
+	g.next = now.Add(g.interval)
+	data, ok := g.call(w)
+	if !ok {
+		g.stopped = true
+		return false
+	}
+	msg, err := w.buildMessage(g.typ, data)
+	if err == nil {
+		// it's the write goroutine, so it must not wait for the bounded queue
+		err = w.enqueue(&pendingMessage{msg: msg})
+	}
+	if err != nil {
+		w.logger.Debug("SendEvery stopped", "type", g.typ, "err", err)
+		g.stopped = true
+		return false
+	}
+	return true
+}
+
+func (g *generator) call(w *WebSocket) (data any, ok bool) {
+	defer w.recoverPanic()
+	return g.gen()
+}
+
+// runGenerators calls the due generators of SendEvery, and returns when the next one is due
+func (w *WebSocket) runGenerators() (next time.Time, ok bool) {
+	w.generatorMux.Lock()
+	gens := make([]*generator, len(w.generators))
+	copy(gens, w.generators)
+	w.generatorMux.Unlock()
+	if len(gens) == 0 {
+		return
+	}
+	now := w.clock.Now()
+	stopped := 0
+	for _, g := range gens {
+		if !g.run(w, now) {
+			stopped++
+		}
+	}
+	w.generatorMux.Lock()
+	defer w.generatorMux.Unlock()
+	if stopped > 0 {
+		active := w.generators[:0]
+		for _, g := range w.generators {
+			g.mux.Lock()
+			if !g.stopped {
+				active = append(active, g)
+			}
+			g.mux.Unlock()
+		}
+		for i := len(active); i < len(w.generators); i++ {
+			w.generators[i] = nil
+		}
+		w.generators = active
+	}
+	for _, g := range w.generators {
+		g.mux.Lock()
+		if !ok || g.next.Before(next) {
+			next, ok = g.next, true
+		}
+		g.mux.Unlock()
+	}
+	return
+}
+
+func (w *WebSocket) enqueueAndWait(ctx context.Context, p *pendingMessage) error {
+	// the span lasts until the message is flushed
+	end := w.traceSend(ctx, p)
+	err := w.enqueueContext(ctx, p)
+	if err == nil {
+		err = w.waitPending(ctx, p)
+	}
+	if end != nil {
+		end(err)
+	}
+	return err
+}
+
+// waitPending waits until the queued message is flushed
+// The message will be discarded if ctx is done before it's being written
+func (w *WebSocket) waitPending(ctx context.Context, p *pendingMessage) error {
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		p.cancel()
+		return context.Cause(ctx)
+	case <-w.ctx.Done():
+		return w.closedError()
+	}
+}
+
+// ctxFlushMargin is how long before the deadline of the connection's context the batch is flushed
+const ctxFlushMargin = 100 * time.Millisecond
+
+func (w *WebSocket) writeHelper() {
+	// ctxDeadline is inherited from the request's context, or set by MaxConnectionDuration
+	ctxDeadline, hasCtxDeadline := w.ctx.Deadline()
+	var minTimer, maxTimer Timer
+	var minC, maxC <-chan time.Time
+	// deadlineTimer fires at the earliest flushBy of the queued messages
+	var deadlineTimer Timer
+	var deadlineC <-chan time.Time
+	var deadline time.Time
+	// flushedAt is the time of the last flush, it's used by eager first send
+	var flushedAt time.Time
+	// genTimer fires when the next generator of SendEvery is due
+	var genTimer Timer
+	var genC <-chan time.Time
+	resetGenTimer := func() {
+		next, ok := w.runGenerators()
+		if !ok {
+			if genTimer != nil {
+				genTimer.Stop()
+				genTimer, genC = nil, nil
+			}
+			return
+		}
+		wait := max(next.Sub(w.clock.Now()), 0)
+		if genTimer == nil {
+			genTimer = w.clock.NewTimer(wait)
+			genC = genTimer.C()
+			return
+		}
+		if !genTimer.Stop() {
+			select {
+			case <-genC:
+			default:
+			}
+		}
+		genTimer.Reset(wait)
+	}
+	defer func() {
+		if genTimer != nil {
+			genTimer.Stop()
+		}
+	}()
+	// the messages never written are still appended, so they can be replayed after resumed
+	defer w.appendSession()
+	stopTimers := func() {
+		if maxTimer != nil {
+			minTimer.Stop()
+			maxTimer.Stop()
+			minTimer, maxTimer = nil, nil
+			minC, maxC = nil, nil
+		}
+		if deadlineTimer != nil {
+			deadlineTimer.Stop()
+			deadlineTimer, deadlineC = nil, nil
+			deadline = time.Time{}
+		}
+	}
+	defer stopTimers()
+	for {
+		flush := false
+		trigger := flushImmediate
+		select {
+		case msg := <-w.writeCh:
+			w.enqueue(&pendingMessage{msg: msg})
+		case <-w.queueSignal:
+		case <-w.generatorSignal:
+			resetGenTimer()
+			continue
+		case <-genC:
+			resetGenTimer()
+		case <-w.flushSignal:
+			flush, trigger = true, flushManual
+		case <-minC:
+			flush, trigger = true, flushMinTimeout
+		case <-maxC:
+			flush, trigger = true, flushMaxTimeout
+		case <-deadlineC:
+			flush, trigger = true, flushDeadline
+		case <-w.writeStop:
+			w.discardQueue(ErrWriteClosed)
+			return
+		case <-w.ctx.Done():
+			return
+		}
+		// the batch timeouts can be changed by SetBatchTimeouts
+		minTimeout, maxTimeout := w.MinBatchTimeout(), w.MaxBatchTimeout()
+		if minTimeout <= 0 || maxTimeout <= 0 {
+			flush = true
+		}
+		if !flush && w.batchFull() {
+			flush, trigger = true, flushSize
+		}
+		if !flush && w.eagerFirstSend && maxTimer == nil {
+			// a negative duration means the clock went backward, which should not stop the eager send forever
+			if quiet := w.clock.Now().Sub(flushedAt); quiet < 0 || quiet >= minTimeout {
+				flush = true
+			}
+		}
+		if !flush {
+			flushBy := w.queueDeadline()
+			if hasCtxDeadline {
+				// the context's deadline is in wall time, which may not be the same as the clock
+				if by := w.clock.Now().Add(time.Until(ctxDeadline) - ctxFlushMargin); flushBy.IsZero() || by.Before(flushBy) {
+					flushBy = by
+				}
+			}
+			if !flushBy.IsZero() && (deadline.IsZero() || flushBy.Before(deadline)) {
+				wait := flushBy.Sub(w.clock.Now())
+				if wait <= 0 {
+					flush, trigger = true, flushDeadline
+				} else {
+					if deadlineTimer != nil {
+						deadlineTimer.Stop()
+					}
+					deadlineTimer = w.clock.NewTimer(wait)
+					deadlineC = deadlineTimer.C()
+					deadline = flushBy
+				}
+			}
+		}
+		if !flush {
+			if maxTimer == nil {
+				minTimer = w.clock.NewTimer(minTimeout)
+				maxTimer = w.clock.NewTimer(maxTimeout)
+				minC, maxC = minTimer.C(), maxTimer.C()
+			} else {
+				if !minTimer.Stop() {
+					select {
+					case <-minTimer.C():
+					default:
+					}
+				}
+				minTimer.Reset(minTimeout)
+			}
+			continue
+		}
+		stopTimers()
+		w.queueMux.Lock()
+		pending := len(w.queue) > 0
+		w.queueMux.Unlock()
+		// an empty flush should not delay the next eager send, or be counted
+		if pending {
+			if w.eagerFirstSend {
+				flushedAt = w.clock.Now()
+			}
+			w.batchStats.flushes[trigger].Add(1)
+		}
+		if err := w.flushQueue(); err != nil {
+			// the close frame is sent, the cause is decided by the close handshake, so it must not be replaced by the write error
+			if w.closing.Load() || errors.Is(err, websocket.ErrCloseSent) {
+				return
+			}
+			w.logger.Error("Failed to write messages", "err", err)
+			var pingErr *pingWriteError
+			failedPing := errors.As(err, &pingErr)
+			if failedPing {
+				err = pingErr.err
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = ErrWriteTimeout
+			} else {
+				err = &WSWriteError{err}
+			}
+			if failedPing {
+				err = fmt.Errorf("%w: %w", ErrPingFailed, err)
+			}
+			w.writeErr.CompareAndSwap(nil, &err)
+			w.cancel(err)
+			return
+		}
+	}
+}
+
+// discardQueue removes all queued messages, the waiting senders will receive err
+func (w *WebSocket) discardQueue(err error) {
+	w.queueMux.Lock()
+	queue := w.queue
+	w.queue = nil
+	w.queueBytes = 0
+	w.queueCount = 0
+	w.queueKeys = nil
+	w.queueFlushBy = time.Time{}
+	w.highWater = false
+	w.queueMux.Unlock()
+	dropped := 0
+	for _, p := range queue {
+		w.releaseSlot(p)
+		if p.barrier || p.take() {
+			if !p.barrier && p.done == nil {
+				dropped++
+			}
+			p.finish(err)
+		}
+	}
+	w.countDrop(dropClosed, dropped)
+}
+
+// queueDeadline returns the earliest flushBy of the queued messages
+func (w *WebSocket) queueDeadline() time.Time {
+	w.queueMux.Lock()
+	defer w.queueMux.Unlock()
+	return w.queueFlushBy
+}
+
+func (w *WebSocket) batchFull() bool {
+	if w.sendSlots != nil && w.sendSlots.full() {
+		return true
+	}
+	if w.maxBatchCount <= 0 && w.maxBatchBytes <= 0 {
+		return false
+	}
+	w.queueMux.Lock()
+	defer w.queueMux.Unlock()
+	return (w.maxBatchCount > 0 && len(w.queue) >= w.maxBatchCount) ||
+		(w.maxBatchBytes > 0 && w.queueBytes >= w.maxBatchBytes)
+}
+
+// splitBatch returns how many messages from the head of queue can be written in one frame
+// A binary frame or a message with compression override is always written alone
+func (w *WebSocket) splitBatch(queue []*pendingMessage) int {
+	if queue[0].msg == nil || queue[0].compress != 0 || w.batchFraming == FramingOneFramePerMessage {
+		return 1
+	}
+	n, bytes := 0, 0
+	for _, p := range queue {
+		if p.msg == nil || p.compress != 0 {
+			break
+		}
+		if n > 0 {
+			if w.maxBatchCount > 0 && n >= w.maxBatchCount {
+				break
+			}
+			if w.maxBatchBytes > 0 && bytes+p.size() > w.maxBatchBytes {
+				break
+			}
+		}
+		n++
+		bytes += p.size()
+	}
+	return n
+}
+
+// flushQueue writes all queued messages
+// Messages will be split into multiple frames if MaxBatchCount or MaxBatchBytes is set
+func (w *WebSocket) flushQueue() error {
+	w.queueMux.Lock()
+	queue := w.queue
+	w.queue = nil
+	w.queueBytes = 0
+	w.queueCount = 0
+	w.queueKeys = nil
+	w.queueFlushBy = time.Time{}
+	w.highWater = false
+	w.queueMux.Unlock()
+	// the messages are in the store before the opposite can see them, so they can be resumed
+	w.appendSession()
+
+	taken := queue[:0]
+	var barriers []*pendingMessage
+	now := w.clock.Now()
+	expired := 0
+	for _, p := range queue {
+		w.releaseSlot(p)
+		if p.barrier {
+			barriers = append(barriers, p)
+		} else if p.take() {
+			// sequenced messages must be delivered
+			if !p.expireAt.IsZero() && p.msg.Seq == 0 && !now.Before(p.expireAt) {
+				expired++
+				p.finish(nil)
+				continue
+			}
+			taken = append(taken, p)
+		}
+	}
+	if expired > 0 {
+		w.logger.Debug("Dropped expired messages", "count", expired)
+		w.countDrop(dropExpired, expired)
+	}
+	var err error
+	// written holds the messages of the frames already written until the whole flush is done
+	var written *[]*pendingMessage
+	if w.flushPolicy == FlushAllOrNothing {
+		written = new([]*pendingMessage)
+	}
+	for len(taken) > 0 {
+		n := w.splitBatch(taken)
+		if err = w.writeBatch(taken[:n], written); err != nil {
+			for _, p := range taken[n:] {
+				p.finish(err)
+			}
+			break
+		}
+		taken = taken[n:]
+	}
+	if written != nil {
+		for _, p := range *written {
+			p.finish(err)
+		}
+	}
+	for _, p := range barriers {
+		p.finish(err)
+	}
+	return err
+}
+
+// writeBatch writes the messages into one frame
+// If written is not nil, the written messages are appended to it instead of being finished
+func (w *WebSocket) writeBatch(batch []*pendingMessage, written *[]*pendingMessage) error {
+	if batch[0].msg == nil {
+		return w.writeBinary(batch[0], written)
+	}
+	size := 0
+	for _, p := range batch {
+		size += p.size()
+	}
+	b := getBatchBuffer()
+	defer putBatchBuffer(b)
+	e := b.encoder(w.codec)
+	array := w.batchFraming == FramingJSONArray
+	batchSeq := w.batchSeq.Load() + 1
+	for _, p := range batch {
+		start := b.buf.Len()
+		if array {
+			if len(b.encoded) == 0 {
+				b.buf.WriteByte('[')
+			} else {
+				b.buf.WriteByte(',')
+			}
+		}
+		var err error
+		if len(b.encoded) == 0 {
+			// the first message carries the batch sequence
+			msg := *p.msg
+			msg.Batch = batchSeq
+			err = e.Encode(&msg)
+		} else if p.frame != nil && p.msg.Seq == 0 {
+			b.buf.Write(p.frame)
+		} else if p.msg.Batch != 0 {
+			msg := *p.msg
+			msg.Batch = 0
+			err = e.Encode(&msg)
+		} else {
+			err = e.Encode(p.msg)
+		}
+		if err != nil {
+			// drop the separator and anything partially encoded
+			b.buf.Truncate(start)
+			p.finish(err)
+			continue
+		}
+		if array {
+			// remove the newline appended by json.Encoder
+			if n := b.buf.Len(); n > 0 && b.buf.Bytes()[n-1] == '\n' {
+				b.buf.Truncate(n - 1)
+			}
+		}
+		b.encoded = append(b.encoded, p)
+	}
+	encoded := b.encoded
+	if len(encoded) == 0 {
+		return nil
+	}
+	if array {
+		b.buf.WriteByte(']')
+	}
+	internal := true
+	for _, p := range encoded {
+		if len(p.msg.Type) == 0 || p.msg.Type[0] != '$' {
+			internal = false
+			break
+		}
+	}
+	if err := w.pace(b.buf.Len(), !internal); err != nil {
+		for _, p := range encoded {
+			p.finish(err)
+		}
+		return err
+	}
+	w.setWriteCompression(size, batch[0].compress)
+	w.setWriteDeadline()
+	err := w.ws.WriteMessage(w.codec.FrameType(), b.buf.Bytes())
+	if err == nil && written != nil {
+		*written = append(*written, encoded...)
+	} else {
+		for _, p := range encoded {
+			p.finish(err)
+		}
+	}
+	if err != nil {
+		for _, p := range encoded {
+			if p.msg.Type == "$ping" {
+				return &pingWriteError{err}
+			}
+		}
+		return err
+	}
+	// the sequence may be restored by a resumed session meanwhile, which is kept
+	if w.batchSeq.CompareAndSwap(batchSeq-1, batchSeq) {
+		w.saveBatchSeq(batchSeq)
+	}
+	if w.debug.Load() {
+		for _, p := range encoded {
+			w.debugMessage("sent", p.msg)
+		}
+	}
+	w.batchStats.countFrame(len(encoded), b.buf.Len())
+	w.metrics.OnBatchFlush(len(encoded), b.buf.Len())
+	for _, p := range encoded {
+		if len(p.msg.Type) == 0 || p.msg.Type[0] != '$' {
+			w.metrics.OnMessageSent(p.size())
+		}
+	}
+	return nil
+}
+
+// pingWriteError marks the write error of a frame which contains a ping
+type pingWriteError struct {
+	err error
+}
+
+func (e *pingWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pingWriteError) Unwrap() error {
+	return e.err
+}
+
+func (w *WebSocket) setWriteDeadline() {
+	if w.writeTimeout > 0 {
+		w.ws.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+	}
+}
+
+func (w *WebSocket) writeBinary(p *pendingMessage, written *[]*pendingMessage) error {
+	if err := w.pace(len(p.binary), !p.text); err != nil {
+		p.finish(err)
+		return err
+	}
+	w.setWriteCompression(len(p.binary), p.compress)
+	w.setWriteDeadline()
+	frameType := websocket.BinaryMessage
+	if p.text {
+		frameType = websocket.TextMessage
+	}
+	err := w.ws.WriteMessage(frameType, p.binary)
+	if err == nil && written != nil {
+		*written = append(*written, p)
+	} else {
+		p.finish(err)
+	}
+	if err != nil {
+		return err
+	}
+	if w.debug.Load() {
+		w.debugBinary("sent", p.binary)
+	}
+	w.batchStats.countFrame(1, len(p.binary))
+	w.metrics.OnBatchFlush(1, len(p.binary))
+	if !p.text {
+		w.metrics.OnMessageSent(len(p.binary))
+	}
+	return nil
+}
+
+// maxPooledBatchBuffer is the max capacity of the buffers put back to the pool,
+// so a large batch will not keep the memory forever
+const maxPooledBatchBuffer = 64 * 1024
+
+// batchBuffer is used to encode a batch before writing it as one frame
+type batchBuffer struct {
+	buf     bytes.Buffer
+	encoded []*pendingMessage
+	// jsonEncoder writes to buf, it's reused since JSONCodec's encoder does not keep any state between messages
+	jsonEncoder *json.Encoder
+}
+
+var batchBufferPool = sync.Pool{
+	New: func() any {
+		b := new(batchBuffer)
+		b.jsonEncoder = json.NewEncoder(&b.buf)
+		b.jsonEncoder.SetEscapeHTML(false)
+		return b
+	},
+}
+
+func getBatchBuffer() *batchBuffer {
+	return batchBufferPool.Get().(*batchBuffer)
+}
+
+func putBatchBuffer(b *batchBuffer) {
+	if b.buf.Cap() > maxPooledBatchBuffer {
+		return
+	}
+	b.buf.Reset()
+	clear(b.encoded)
+	b.encoded = b.encoded[:0]
+	batchBufferPool.Put(b)
+}
+
+// encoder returns an Encoder writes to the buffer
+func (b *batchBuffer) encoder(codec Codec) Encoder {
+	if codec == JSONCodec {
+		return b.jsonEncoder
+	}
+	return codec.NewEncoder(&b.buf)
+}
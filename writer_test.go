@@ -0,0 +1,207 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+func TestConcurrentSend(t *testing.T) {
+	const (
+		senders = 100
+		count   = 20
+	)
+	up := &aws.Upgrader{
+		Upgrader:        &websocket.Upgrader{},
+		MinBatchTimeout: time.Millisecond,
+		MaxBatchTimeout: 5 * time.Millisecond,
+	}
+	url, ch := serve(t, up)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-ch
+	defer s.Close()
+
+	type payload struct {
+		Sender int    `json:"s"`
+		N      int    `json:"n"`
+		Pad    string `json:"p"`
+	}
+	pad := string(bytes.Repeat([]byte{'x'}, 256))
+	var wg sync.WaitGroup
+	for i := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range count {
+				if err := s.Send("m", payload{Sender: i, N: n, Pad: pad}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	next := make([]int, senders)
+	received := 0
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for received < senders*count {
+		typ, frame, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.TextMessage {
+			t.Fatalf("unexpected frame type %d", typ)
+		}
+		// every line of a frame must be a whole message
+		for _, line := range bytes.Split(bytes.TrimSuffix(frame, []byte{'\n'}), []byte{'\n'}) {
+			var msg aws.Message
+			if err := json.Unmarshal(line, &msg); err != nil {
+				t.Fatalf("interleaved frame %q: %v", line, err)
+			}
+			if msg.Type != "m" {
+				continue
+			}
+			var p payload
+			if err := json.Unmarshal(msg.Data, &p); err != nil || p.Pad != pad {
+				t.Fatalf("corrupted message %q: %v", msg.Data, err)
+			}
+			if p.N != next[p.Sender] {
+				t.Fatalf("sender %d: got message %d, expect %d", p.Sender, p.N, next[p.Sender])
+			}
+			next[p.Sender]++
+			received++
+		}
+	}
+	wg.Wait()
+}
+
+func BenchmarkSendAll(b *testing.B) {
+	const count = 64
+	up := &aws.Upgrader{
+		Upgrader:        &websocket.Upgrader{},
+		MinBatchTimeout: time.Millisecond,
+		MaxBatchTimeout: 5 * time.Millisecond,
+	}
+	s, c := pair(b, up, &aws.Dialer{})
+	go func() {
+		for {
+			if _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	vs := make([]any, count)
+	for i := range vs {
+		vs[i] = i
+	}
+	b.Run("Send", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			for _, v := range vs {
+				if err := s.Send("n", v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("SendAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if err := s.SendAll("n", vs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// limitConn fails the writes once left is used up
+type limitConn struct {
+	net.Conn
+	left *atomic.Int64
+}
+
+func (c limitConn) Write(p []byte) (int, error) {
+	if c.left.Add(-1) < 0 {
+		return 0, errors.New("injected write error")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestFlushFailureMidBatch(t *testing.T) {
+	for _, policy := range []aws.FlushFailurePolicy{aws.FlushStopOnError, aws.FlushAllOrNothing} {
+		var left atomic.Int64
+		left.Store(1 << 30)
+		d := *websocket.DefaultDialer
+		d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return limitConn{c, &left}, nil
+		}
+		_, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}, PingInterval: time.Hour}, &aws.Dialer{
+			Dialer:             &d,
+			BatchFraming:       aws.FramingOneFramePerMessage,
+			FlushFailurePolicy: policy,
+			MinBatchTimeout:    time.Hour,
+			MaxBatchTimeout:    time.Hour,
+		})
+		const count = 3
+		var wg sync.WaitGroup
+		errs := make([]error, count)
+		// queue the senders in order, so the i-th message is the i-th frame
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = c.Send("a", i)
+			}()
+			for c.PendingCount() < i+1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		// only the first frame can be written
+		left.Store(1)
+		c.Flush()
+		wg.Wait()
+		for i, err := range errs {
+			if want := i == 0 && policy == aws.FlushStopOnError; (err == nil) != want {
+				t.Errorf("policy %d: sender %d got %v", policy, i, err)
+			}
+		}
+		select {
+		case <-c.Context().Done():
+		case <-time.After(2 * time.Second):
+			t.Errorf("policy %d: connection is not closed after the write failure", policy)
+		}
+	}
+}
@@ -17,11 +17,22 @@
 package aws
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net"
 	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -29,6 +40,12 @@ import (
 type Message struct {
 	Type string          `json:"t"`
 	Data json.RawMessage `json:"d"`
+	// Seq is the sequence of the application message if session resumption or acknowledgement is enabled
+	Seq uint64 `json:"s,omitempty"`
+	// Batch is the sequence of the batch, it's only set on the first message of each batch frame, see LastBatchSeq
+	Batch uint64 `json:"b,omitempty"`
+	// Trace is the W3C traceparent of the message, it's set by OnSendSpan
+	Trace string `json:"tp,omitempty"`
 }
 
 func BuildMessage(typ string, data any) (*Message, error) {
@@ -42,71 +59,585 @@ func BuildMessage(typ string, data any) (*Message, error) {
 	}, nil
 }
 
+// ParseData decodes the message data as JSON
+// Use WebSocket.ParseMessage instead if the connection is not using JSONCodec
 func (m *Message) ParseData(ptr any) error {
 	return json.Unmarshal(([]byte)(m.Data), ptr)
 }
 
+// WebSocket is an authorized websocket connection
+// All methods are safe to be called from multiple goroutines concurrently
+// Outbound messages are queued in order and written by a single internal writer goroutine,
+// so a frame is never interleaved with another one
 type WebSocket struct {
-	ws       *websocket.Conn
-	authData any
+	ws      *websocket.Conn
+	counter *byteCounter
+	logger  *slog.Logger
+	codec   Codec
+	metrics Metrics
+	onPanic func(recovered any, stack []byte)
+	// clientIP is resolved from the upgrade request, it's empty on the client side
+	clientIP string
+	// peerCerts are the client certificates captured from the upgrade request, they are nil on the client side
+	peerCerts []*x509.Certificate
+	// onPeerClose is called when a close frame is received
+	onPeerClose func(code int, text string)
+	// noCloseEcho disables echoing the close frame sent by the opposite
+	noCloseEcho  bool
+	batchFraming BatchFraming
+	flushPolicy  FlushFailurePolicy
+	// rawJSONRPC makes the text frames bare JSON-RPC messages
+	rawJSONRPC bool
+	onRawFrame func(messageType int, data []byte)
+	// onDecodeError is only called by the read goroutine
+	onDecodeError func(raw []byte, err error) bool
+	onSend        func(typ string, data any) (any, error)
+	onReceive     func(msg *Message) error
+	onSendSpan    func(ctx context.Context, typ string) (string, func(error))
+	onReceiveSpan func(msg *Message) func()
+	debug         atomic.Bool
+	debugLimit    int
+	debugRedact   func(typ string, data []byte) []byte
+	// dispatchWorkers is the size of the worker pool calling the handlers registered by On
+	dispatchWorkers int
+	dispatchQueue   int
+	dispatchCh      chan func()
+	routeMux        sync.RWMutex
+	routes          map[string]func(json.RawMessage)
+	defaultRoute    func(*Message)
+	// binaryAuth is true while the binary auth frame is expected, the binary frames are sent to authBinaryCh
+	binaryAuth   atomic.Bool
+	authBinaryCh chan []byte
+	// rawBuf is reused to read the raw frames, it's only accessed by the read goroutine
+	rawBuf []byte
 
-	pingInterval    time.Duration
-	pongTimeout     time.Duration
-	minBatchTimeout time.Duration
-	maxBatchTimeout time.Duration
+	onPong        func(rtt time.Duration)
+	onPingTimeout func()
+	pingMessage   []byte
+	validatePong  bool
+	latency       atomic.Int64
+	pongSignal    chan struct{}
+	// pingWaiters are the Ping calls waiting for the pongs, keyed by the ping time
+	pingMux     sync.Mutex
+	pingWaiters map[int64]chan time.Duration
+	authData    atomic.Pointer[any]
+	// closeCause is the cause used when the opposite echoed our close frame
+	closeCause atomic.Pointer[error]
+	// closing is set when the close handshake is started
+	closing atomic.Bool
+	// draining is set when Drain is called, only internal messages and barriers can be queued after that
+	draining atomic.Bool
+	// writeErr is the first write error
+	writeErr atomic.Pointer[error]
+	// keepaliveMatcher reports whether a text frame should be counted as a pong
+	keepaliveMatcher func(json.RawMessage) bool
+	// appPing is the normalized AutoPongAppMessages, it's nil if disabled
+	appPing *AppPing
+	clock   Clock
+	// eagerFirstSend flushes the first message immediately if nothing is flushed within the min batch timeout
+	eagerFirstSend bool
 
-	readCh      chan *Message
-	writeCh     chan *Message
+	pingInterval    atomic.Int64
+	pongTimeout     atomic.Int64
+	minBatchTimeout atomic.Int64
+	maxBatchTimeout atomic.Int64
+	maxBatchCount   int
+	maxBatchBytes   int
+	maxMessageSize  int64
+	maxPendingMsgs  int
+	maxPendingBytes int
+	sendQueueSize   int
+	// onQueueHighWater is called once the queue reaches the high water marks, until the queue is flushed
+	onQueueHighWater func(count int, bytes int)
+	highWaterMsgs    int
+	highWaterBytes   int
+	idleTimeout      time.Duration
+	writeTimeout     time.Duration
+	readTimeout      time.Duration
+	// closeFlushTimeout is negative if the queued messages should not be flushed on close
+	closeFlushTimeout time.Duration
+	// closeTimeout is the close handshake timeout
+	closeTimeout time.Duration
+
+	compression          bool
+	compressionThreshold int
+
+	inboundRateLimit float64
+	inboundBurst     int
+	rateLimitAction  RateLimitAction
+	// inboundLimiter is only accessed by the read goroutine after limiterActive is set
+	inboundLimiter *tokenBucket
+	limiterActive  atomic.Bool
+
+	controlRateLimit float64
+	maxControlFrames int
+	// controlLimiter, controlFrames and controlFlooded are only accessed by the read goroutine
+	controlLimiter *tokenBucket
+	// controlFrames is the count of the control frames received since the last data frame
+	controlFrames  int
+	controlFlooded bool
+
+	outboundRateLimit float64
+	outboundBurst     int
+	// outboundLimiter is only accessed by the write goroutine
+	outboundLimiter *tokenBucket
+
+	// createdAt is used as the base of the monotonic timestamps
+	createdAt time.Time
+	// activeAt is the duration since createdAt when the last application message is received
+	activeAt atomic.Int64
+
+	readCh     chan *Message
+	binaryCh   chan []byte
+	writeCh    chan *Message
+	queueMux   sync.Mutex
+	queue      []*pendingMessage
+	queueBytes int
+	// queueCount is the number of the queued messages excluding the barriers
+	queueCount int
+	// queueKeys are the queued messages sent by SendKeyed
+	queueKeys   map[string]*pendingMessage
+	queueSignal chan struct{}
+	sendSlots   *sendSlots
 	flushSignal chan struct{}
 	authCh      chan *Message
-	ctx         context.Context
-	cancel      context.CancelCauseFunc
+
+	// generators are called by the write goroutine, see SendEvery
+	generatorMux    sync.Mutex
+	generators      []*generator
+	generatorSignal chan struct{}
+
+	// authRequested is true while reauthHelper is waiting for the requested auth message
+	authRequested atomic.Bool
+	duplicateAuth DuplicateAuthPolicy
+	// unrequestedAuth receives the unrequested auth messages for reauthHelper if DuplicateAuthReauth is used
+	unrequestedAuth chan json.RawMessage
+	readyCh         chan *Message
+	resumeCh        chan *Message
+	// queueFlushBy is the earliest flushBy of the queued messages, it's guarded by queueMux
+	queueFlushBy time.Time
+	// highWater reports whether onQueueHighWater is called since the last flush, it's guarded by queueMux
+	highWater bool
+
+	// authPending and held are guarded by queueMux, see UpgradeAsync
+	authPending      bool
+	held             []*pendingMessage
+	rejectBeforeAuth bool
+	// authDone is closed after authErr is set
+	authDone chan struct{}
+	authErr  error
+
+	sessionStore SessionStore
+	sessionToken string
+	// sessionKey is the key of the session in sessionStore, which is bound to the auth identity
+	sessionKey string
+	resumed    bool
+	// sessionAppends are the sequenced messages not yet appended to sessionStore, it's guarded by queueMux
+	// appendMux is held while appending them, so they are appended in the order of the sequences
+	sessionAppends []*Message
+	appendMux      sync.Mutex
+	// sendSeq is the sequence of the last application message sent
+	// recvSeq is the sequence of the last application message received
+	sendSeq atomic.Uint64
+	recvSeq atomic.Uint64
+	// batchSeq is the sequence of the last batch flushed
+	batchSeq atomic.Uint64
+
+	batchStats batchCounters
+	dropped    [dropReasonCount]atomic.Uint64
+
+	// inboundSizes is only updated by the read goroutine, but it's read concurrently
+	inboundSizes   sizeCounters
+	onLargeMessage func(size int)
+	largeThreshold int
+
+	ackInterval time.Duration
+	ackedSeq    atomic.Uint64
+	// unacked is guarded by queueMux
+	unacked    []*Message
+	maxUnacked int
+	acks       ackTracker
+
+	callMux    sync.Mutex
+	callId     uint64
+	calls      map[uint64]chan<- *resultMessage
+	handlerMux sync.RWMutex
+	handlers   map[string]CallHandler
+	// streamHandlers is guarded by handlerMux
+	streamHandlers map[string]StreamHandler
+	// rpcMethods is guarded by handlerMux, and rpcId and rpcCalls are guarded by callMux
+	rpcMethods map[string]CallHandler
+	rpcId      uint64
+	rpcCalls   map[uint64]chan<- *jsonrpcResponse
+
+	streamMux   sync.Mutex
+	streamId    uint64
+	streams     map[uint64]*StreamReader
+	callStreams map[uint64]*StreamReader
+	streamCh    chan *StreamReader
+	// writers are the StreamWriters not ended yet, which receive the credits sent by the opposite's StreamReaders
+	writers    map[uint64]*StreamWriter
+	maxStreams int
+
+	valuesMux sync.RWMutex
+	values    map[any]any
+
+	tagMux sync.Mutex
+	tags   map[string]struct{}
+	// hubs are the hubs containing the connection, they index the connection by its tags
+	hubs map[*Hub]struct{}
+
+	halfCloseState
+
+	// state is the State, it's only changed with stateMux locked so the handlers observe the transitions in order
+	state         atomic.Int32
+	stateMux      sync.Mutex
+	stateHandlers []func(old, new State)
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 }
 
 func (w *WebSocket) init() {
-	if w.pingInterval <= 0 {
-		w.pingInterval = time.Second * 15
+	if w.codec == nil {
+		w.codec = JSONCodec
+	}
+	if w.metrics == nil {
+		w.metrics = nopMetrics{}
+	}
+	if w.logger == nil {
+		w.logger = slog.New(nopHandler{})
 	}
-	if w.pongTimeout <= 0 {
-		w.pongTimeout = time.Second * 10
+	w.logger = w.logger.With("remote", w.ws.RemoteAddr().String())
+	context.AfterFunc(w.ctx, func() {
+		w.setState(WSClosed)
+		if cause := context.Cause(w.ctx); cause == ErrClosed {
+			w.logger.Debug("Connection closed")
+		} else {
+			w.logger.Info("Connection closed", "cause", cause)
+		}
+	})
+	if w.clock == nil {
+		w.clock = RealClock
+	}
+	w.createdAt = w.clock.Now()
+	if w.closeTimeout <= 0 {
+		w.closeTimeout = closeHandshakeTimeout
+	}
+	if w.inboundRateLimit > 0 {
+		w.inboundLimiter = newTokenBucket(w.clock, w.inboundRateLimit, w.inboundBurst)
+	}
+	if w.maxMessageSize > 0 {
+		w.ws.SetReadLimit(w.maxMessageSize)
+	}
+	if w.outboundRateLimit > 0 {
+		burst := w.outboundBurst
+		if burst <= 0 {
+			burst = (int)(math.Ceil(w.outboundRateLimit))
+		}
+		w.outboundLimiter = newTokenBucket(w.clock, w.outboundRateLimit, burst)
+	}
+	if w.controlRateLimit > 0 {
+		w.controlLimiter = newTokenBucket(w.clock, w.controlRateLimit, (int)(math.Ceil(w.controlRateLimit)))
+	}
+	w.ws.SetPingHandler(func(message string) error {
+		if !w.allowControl() {
+			return nil
+		}
+		err := w.ws.WriteControl(websocket.PongMessage, ([]byte)(message), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return err
+	})
+	w.ws.SetPongHandler(func(string) error {
+		if w.allowControl() {
+			w.keepalive()
+		}
+		return nil
+	})
+	w.ws.SetCloseHandler(w.handleClose)
+	if w.pingInterval.Load() <= 0 {
+		w.pingInterval.Store((int64)(time.Second * 15))
+	}
+	if w.pongTimeout.Load() <= 0 {
+		w.pongTimeout.Store((int64)(time.Second * 10))
 	}
 	w.readCh = make(chan *Message, 8)
+	w.binaryCh = make(chan []byte, 8)
 	w.writeCh = make(chan *Message, 8)
+	w.queueSignal = make(chan struct{}, 1)
+	w.generatorSignal = make(chan struct{}, 1)
+	if w.sendQueueSize > 0 {
+		w.sendSlots = newSendSlots(w.sendQueueSize)
+	}
+	w.pongSignal = make(chan struct{}, 1)
 	w.flushSignal = make(chan struct{}, 1)
 	w.authCh = make(chan *Message, 1)
+	w.authBinaryCh = make(chan []byte, 1)
+	w.readyCh = make(chan *Message, 2)
+	w.resumeCh = make(chan *Message, 1)
+	w.streamCh = make(chan *StreamReader, 8)
+	if w.dispatchWorkers > 0 {
+		if w.dispatchQueue <= 0 {
+			w.dispatchQueue = w.dispatchWorkers
+		}
+		w.dispatchCh = make(chan func(), w.dispatchQueue)
+		for range w.dispatchWorkers {
+			go w.dispatchWorker()
+		}
+	}
+	w.readStop = make(chan struct{})
+	w.writeStop = make(chan struct{})
+	w.keepaliveStop = make(chan struct{})
 	go w.readHelper()
 	go w.writeHelper()
-	go w.pingHelper()
 }
 
+// Context returns the connection's context
+// For connections created by Upgrader, the context is derived from the request's context
+// The context is cancelled when the connection is closed for any reason,
+// and context.Cause returns the reason
 func (w *WebSocket) Context() context.Context {
 	return w.ctx
 }
 
+// Done returns a channel which is closed when the connection is closed
+func (w *WebSocket) Done() <-chan struct{} {
+	return w.ctx.Done()
+}
+
+// IsClosed reports whether the connection is closed, it never blocks
+func (w *WebSocket) IsClosed() bool {
+	return w.ctx.Err() != nil
+}
+
+// OnClose registers fn to be called exactly once in its own goroutine after the connection is closed,
+// with the cause of the connection
+// If the connection is already closed, fn will be called immediately
+func (w *WebSocket) OnClose(fn func(cause error)) {
+	context.AfterFunc(w.ctx, func() {
+		fn(context.Cause(w.ctx))
+	})
+}
+
+func (w *WebSocket) buildMessage(typ string, data any) (*Message, error) {
+	if w.onSend != nil && (len(typ) == 0 || typ[0] != '$') {
+		var err error
+		if data, err = w.onSend(typ, data); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := w.codec.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Type: typ,
+		Data: (json.RawMessage)(buf),
+	}, nil
+}
+
+// ParseMessage decodes the message data with the connection's codec
+func (w *WebSocket) ParseMessage(m *Message, ptr any) error {
+	return w.codec.Unmarshal(([]byte)(m.Data), ptr)
+}
+
+// Codec returns the codec used to encode and decode messages
+// Use it to parse Message.Data when the codec is not JSONCodec
+func (w *WebSocket) Codec() Codec {
+	return w.codec
+}
+
+// AuthData returns the value produced by the Authorizer during upgrade
+// The value is set before Upgrade returns, and can only be replaced by the Reauthorizer
+// It is safe to call AuthData from multiple goroutines
 func (w *WebSocket) AuthData() any {
-	return w.authData
+	if p := w.authData.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (w *WebSocket) setAuthData(data any) {
+	w.authData.Store(&data)
 }
 
+// AuthDataAs returns the auth data as type T
+// The second return value reports whether the auth data is a T
+func AuthDataAs[T any](w *WebSocket) (T, bool) {
+	v, ok := w.AuthData().(T)
+	return v, ok
+}
+
+// WebSocket returns the underlying connection
+// Writing to it directly is not safe since it's concurrent with the internal writer goroutine
 func (w *WebSocket) WebSocket() *websocket.Conn {
 	return w.ws
 }
 
+// Set stores a value with the key on the connection
+// The key should be comparable, and it's recommended to use an unexported type to avoid collisions
+func (w *WebSocket) Set(key, value any) {
+	w.valuesMux.Lock()
+	defer w.valuesMux.Unlock()
+	if w.values == nil {
+		w.values = make(map[any]any)
+	}
+	w.values[key] = value
+}
+
+// Get returns the value stored with the key
+func (w *WebSocket) Get(key any) (any, bool) {
+	w.valuesMux.RLock()
+	defer w.valuesMux.RUnlock()
+	value, ok := w.values[key]
+	return value, ok
+}
+
+// Delete removes the value stored with the key
+func (w *WebSocket) Delete(key any) {
+	w.valuesMux.Lock()
+	defer w.valuesMux.Unlock()
+	delete(w.values, key)
+}
+
+// Subprotocol returns the negotiated subprotocol, or an empty string if there is none
+func (w *WebSocket) Subprotocol() string {
+	return w.ws.Subprotocol()
+}
+
 func (w *WebSocket) PingInterval() time.Duration {
-	return w.pingInterval
+	return (time.Duration)(w.pingInterval.Load())
 }
 
 func (w *WebSocket) PongTimeout() time.Duration {
-	return w.pongTimeout
+	return (time.Duration)(w.pongTimeout.Load())
+}
+
+// SetPingInterval changes the interval of the pings sent by this side
+// It takes effect after the pending ping is sent, and the opposite is not notified
+// Non-positive values are ignored
+func (w *WebSocket) SetPingInterval(d time.Duration) {
+	if d > 0 {
+		w.pingInterval.Store((int64)(d))
+	}
+}
+
+// SetPongTimeout changes how long to wait for a pong after a ping is sent
+// It takes effect from the next ping, non-positive values are ignored
+func (w *WebSocket) SetPongTimeout(d time.Duration) {
+	if d > 0 {
+		w.pongTimeout.Store((int64)(d))
+	}
+}
+
+// BytesSent returns the bytes written to the underlying connection, including the handshake and control frames
+func (w *WebSocket) BytesSent() int64 {
+	return w.counter.sent.Load()
+}
+
+// BytesReceived returns the bytes read from the underlying connection, including the handshake and control frames
+// On the server side, the upgrade request which is read before upgrading is not counted
+func (w *WebSocket) BytesReceived() int64 {
+	return w.counter.received.Load()
+}
+
+// ConnInfo describes the parameters negotiated and applied to a connection
+type ConnInfo struct {
+	RemoteAddr   net.Addr
+	ClientIP     string
+	Subprotocol  string
+	Compression  bool
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	AuthData     any
+	// Session is the session token, it's empty if session resumption is not enabled
+	Session       string
+	CreatedAt     time.Time
+	State         State
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Info returns the parameters and the stats of the connection
+func (w *WebSocket) Info() ConnInfo {
+	return ConnInfo{
+		RemoteAddr:   w.RemoteAddr(),
+		ClientIP:     w.ClientIP(),
+		Subprotocol:  w.ws.Subprotocol(),
+		Compression:  w.compression,
+		PingInterval: w.PingInterval(),
+		PongTimeout:  w.PongTimeout(),
+		AuthData:     w.AuthData(),
+		Session:      w.sessionToken,
+		CreatedAt:    w.createdAt,
+
+		State:         w.State(),
+		BytesSent:     w.BytesSent(),
+		BytesReceived: w.BytesReceived(),
+	}
+}
+
+// LastBatchSeq returns the sequence of the last batch flushed by the connection
+// Batches are numbered from 1 for each connection,
+// and a resumed connection continues from the last batch of the session if the SessionStore implements BatchSessionStore,
+// the sequence is sent as the "b" field of the first message in the batch frame, so the opposite can detect gaps
+// Binary frames are not numbered
+func (w *WebSocket) LastBatchSeq() uint64 {
+	return w.batchSeq.Load()
 }
 
 func (w *WebSocket) MinBatchTimeout() time.Duration {
-	return w.minBatchTimeout
+	return (time.Duration)(w.minBatchTimeout.Load())
 }
 
 func (w *WebSocket) MaxBatchTimeout() time.Duration {
-	return w.maxBatchTimeout
+	return (time.Duration)(w.maxBatchTimeout.Load())
+}
+
+// SetBatchTimeouts changes MinBatchTimeout and MaxBatchTimeout of the connection
+// It takes effect from the next queued message, the pending batch keeps its max timeout
+// Batching is disabled if either of them is not positive
+func (w *WebSocket) SetBatchTimeouts(minTimeout, maxTimeout time.Duration) {
+	w.minBatchTimeout.Store((int64)(minTimeout))
+	w.maxBatchTimeout.Store((int64)(maxTimeout))
+	select {
+	case w.queueSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *WebSocket) IdleTimeout() time.Duration {
+	return w.idleTimeout
+}
+
+func (w *WebSocket) WriteTimeout() time.Duration {
+	return w.writeTimeout
+}
+
+func (w *WebSocket) ReadTimeout() time.Duration {
+	return w.readTimeout
+}
+
+func (w *WebSocket) MaxBatchCount() int {
+	return w.maxBatchCount
+}
+
+func (w *WebSocket) MaxBatchBytes() int {
+	return w.maxBatchBytes
 }
 
+func (w *WebSocket) MaxMessageSize() int64 {
+	return w.maxMessageSize
+}
+
+// MessageReader returns the channel of the received application messages
+// The messages are delivered in the receive order
+// The channel is only closed after the read side is closed, use Done to know when the connection is closed
 func (w *WebSocket) MessageReader() <-chan *Message {
 	return w.readCh
 }
@@ -115,17 +646,149 @@ func (w *WebSocket) MessageWriter() chan<- *Message {
 	return w.writeCh
 }
 
+// Close flushes the queued messages within the close flush timeout,
+// then closes the connection normally with code 1000 (normal closure)
+// The connection's cause will be ErrClosed
+// It blocks up to CloseFlushTimeout plus CloseHandshakeTimeout, use Abort to close without waiting
 func (w *WebSocket) Close() error {
+	w.drain()
+	return w.closeWithCause(websocket.CloseNormalClosure, "", ErrClosed)
+}
+
+// CloseError is same as Close but closes the connection because of err
+// The connection's cause will be err, and the close code is taken from *AuthError or *websocket.CloseError,
+// otherwise it's 1011 (internal server error) with the error message as the reason
+// The reason is truncated to 123 bytes on a rune boundary
+// It blocks as long as Close does
+func (w *WebSocket) CloseError(err error) error {
+	code, reason := websocket.CloseInternalServerErr, err.Error()
+	var authErr *AuthError
+	var closeErr *websocket.CloseError
+	if errors.As(err, &authErr) {
+		code, reason = authErr.Code, authErr.Reason
+	} else if errors.As(err, &closeErr) {
+		code, reason = closeErr.Code, closeErr.Text
+	}
+	w.drain()
+	return w.closeWithCause(code, reason, err)
+}
+
+// maxCloseReason is the maximum length of the reason of a close frame
+const maxCloseReason = 123
+
+// truncateCloseReason cuts the reason to maxCloseReason bytes without splitting a rune
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	n := maxCloseReason
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
+}
+
+// IsNormalClose reports whether the cause of a connection means the connection is closed normally,
+// which is closed by Close, or the opposite closed with code 1000 (normal closure) or 1001 (going away)
+func IsNormalClose(cause error) bool {
+	return errors.Is(cause, ErrClosed) ||
+		websocket.IsCloseError(cause, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// Abort closes the connection immediately, the queued messages will be discarded
+func (w *WebSocket) Abort() error {
 	if w.ctx.Err() == nil {
-		w.cancel(net.ErrClosed)
+		w.cancel(ErrClosed)
 	}
 	err := context.Cause(w.ctx)
-	if err == net.ErrClosed {
+	if err == ErrClosed {
 		return nil
 	}
 	return err
 }
 
+// closeHandshakeTimeout is the default close handshake timeout and close flush timeout
+const closeHandshakeTimeout = time.Second * 3
+
+// CloseWithCode flushes the queued messages within the close flush timeout,
+// then sends a close frame with the code and reason to the opposite,
+// and waits until the opposite echo the close frame or the close handshake timeout is reached before closing the connection
+// If the opposite echoed, the connection's cause will be a *websocket.CloseError, otherwise it will be ErrCloseTimeout
+// The reason is truncated to 123 bytes on a rune boundary
+// It blocks as long as Close does
+func (w *WebSocket) CloseWithCode(code int, reason string) error {
+	w.drain()
+	return w.closeWithCause(code, reason, nil)
+}
+
+// drain waits until the messages queued before are written, or the close flush timeout is reached
+func (w *WebSocket) drain() {
+	if w.ctx.Err() != nil || w.closeFlushTimeout < 0 {
+		return
+	}
+	timeout := w.closeFlushTimeout
+	if timeout == 0 {
+		timeout = closeHandshakeTimeout
+	}
+	w.waitFlushed(timeout)
+}
+
+// waitFlushed waits until the messages queued before are written, or the timeout is reached
+func (w *WebSocket) waitFlushed(timeout time.Duration) {
+	p := &pendingMessage{
+		barrier: true,
+		done:    make(chan error, 1),
+	}
+	if w.enqueue(p) != nil {
+		return
+	}
+	w.Flush()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+	case <-w.ctx.Done():
+	}
+}
+
+// closeWithCause is the same as CloseWithCode, but the connection's cause will be set to cause if it's not nil
+func (w *WebSocket) closeWithCause(code int, reason string, cause error) error {
+	if w.ctx.Err() != nil {
+		return w.Abort()
+	}
+	if !w.closing.CompareAndSwap(false, true) {
+		// the connection is already closing, which will be done within the close handshake timeout
+		<-w.ctx.Done()
+		return w.Abort()
+	}
+	if cause != nil {
+		w.closeCause.Store(&cause)
+	}
+	deadline := time.Now().Add(w.closeTimeout)
+	// ErrCloseSent means the close frame sent by the opposite is already echoed
+	if err := w.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, truncateCloseReason(reason)), deadline); err != nil && err != websocket.ErrCloseSent {
+		w.cancel(&WSWriteError{err})
+		return err
+	}
+	select {
+	case <-w.ctx.Done():
+		var closeErr *websocket.CloseError
+		if errors.As(context.Cause(w.ctx), &closeErr) {
+			return nil
+		}
+	case <-time.After(time.Until(deadline)):
+		// the opposite did not echo the close frame
+		if cause == nil || cause == ErrClosed {
+			cause = ErrCloseTimeout
+		}
+	}
+	if cause != nil {
+		w.cancel(cause)
+	}
+	return w.Abort()
+}
+
 // ReadMessage receive a message from MessageReader
 // It calls ReadMessageContext with context.Background()
 func (w *WebSocket) ReadMessage() (*Message, error) {
@@ -133,14 +796,26 @@ func (w *WebSocket) ReadMessage() (*Message, error) {
 }
 
 // ReadMessageContext receive a message from MessageReader
+// The messages received before the connection is closed are still returned
+// If the read side is closed, ErrReadClosed is returned after the buffered messages
 func (w *WebSocket) ReadMessageContext(ctx context.Context) (*Message, error) {
 	select {
-	case msg := <-w.readCh:
+	case msg, ok := <-w.readCh:
+		if !ok {
+			return nil, ErrReadClosed
+		}
 		return msg, nil
 	case <-ctx.Done():
 		return nil, context.Cause(ctx)
 	case <-w.ctx.Done():
-		return nil, net.ErrClosed
+		select {
+		case msg, ok := <-w.readCh:
+			if ok {
+				return msg, nil
+			}
+		default:
+		}
+		return nil, w.closedError()
 	}
 }
 
@@ -150,26 +825,37 @@ func (w *WebSocket) WriteMessage(typ string, data any) error {
 	return w.WriteMessageContext(context.Background(), typ, data)
 }
 
-// WriteMessageContext build and send a message to MessageWriter
+// WriteMessageContext build and queue a message
+// If SendQueueSize is set, it blocks until the queue has room or ctx is done
+// It will not wait for the message to be flushed, use SendContext if you need to
 func (w *WebSocket) WriteMessageContext(ctx context.Context, typ string, data any) error {
-	msg, err := BuildMessage(typ, data)
+	msg, err := w.buildMessage(typ, data)
 	if err != nil {
 		return err
 	}
-	select {
-	case w.writeCh <- msg:
-		return nil
-	case <-ctx.Done():
+	if err := ctx.Err(); err != nil {
 		return context.Cause(ctx)
-	case <-w.ctx.Done():
-		return net.ErrClosed
 	}
+	return w.enqueueContext(ctx, &pendingMessage{msg: msg})
 }
 
-// Flush flush the buffered messages to the opposite
+// writeInternal queues an internal message, it never blocks on the bounded queue
+func (w *WebSocket) writeInternal(typ string, data any) error {
+	if w.rawJSONRPC {
+		return w.writeRawInternal(typ, data)
+	}
+	msg, err := w.buildMessage(typ, data)
+	if err != nil {
+		return err
+	}
+	return w.enqueue(&pendingMessage{msg: msg})
+}
+
+// Flush flush the buffered messages to the opposite immediately,
+// without waiting for the batch timeouts or size thresholds
 func (w *WebSocket) Flush() error {
 	if w.ctx.Err() != nil {
-		return context.Cause(w.ctx)
+		return w.closedError()
 	}
 	select {
 	case w.flushSignal <- struct{}{}:
@@ -178,14 +864,34 @@ func (w *WebSocket) Flush() error {
 	return nil
 }
 
+// readAuthMessage waits for the auth message
+// It returns immediately if the connection is closed by the opposite, or the request's context is done,
+// since the connection's context is derived from the request's context
 func (w *WebSocket) readAuthMessage(timeout time.Duration) (json.RawMessage, error) {
+	timer := w.clock.NewTimer(timeout)
+	defer timer.Stop()
 	select {
 	case msg := <-w.authCh:
 		return msg.Data, nil
-	case <-time.After(timeout):
-		return nil, os.ErrDeadlineExceeded
+	case <-timer.C():
+		return nil, ErrAuthTimeout
+	case <-w.ctx.Done():
+		return nil, context.Cause(w.ctx)
+	}
+}
+
+func (w *WebSocket) readReadyMessage(ctx context.Context, timeout time.Duration) (*Message, error) {
+	timer := w.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-w.readyCh:
+		return msg, nil
+	case <-timer.C():
+		return nil, ErrAuthTimeout
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
 	case <-w.ctx.Done():
-		return nil, net.ErrClosed
+		return nil, context.Cause(w.ctx)
 	}
 }
 
@@ -213,6 +919,27 @@ func (e *WSReadError) Unwrap() error {
 	return e.Err
 }
 
+// ErrHandlerPanic is the cause when a handler panicked
+var ErrHandlerPanic = errors.New("Handler panicked")
+
+// handlePanic reports the recovered value to OnPanic, and returns an error wraps ErrHandlerPanic
+func (w *WebSocket) handlePanic(recovered any) error {
+	stack := debug.Stack()
+	w.logger.Error("Handler panicked", "panic", recovered, "stack", (string)(stack))
+	if w.onPanic != nil {
+		w.onPanic(recovered, stack)
+	}
+	return fmt.Errorf("%w: %v", ErrHandlerPanic, recovered)
+}
+
+// recoverPanic closes the connection if the goroutine panicked
+// It must be called directly with defer
+func (w *WebSocket) recoverPanic() {
+	if r := recover(); r != nil {
+		w.cancel(w.handlePanic(r))
+	}
+}
+
 type WSRemoteError struct {
 	Message string
 }
@@ -224,23 +951,46 @@ func (e *WSRemoteError) Error() string {
 func (w *WebSocket) handleInternalMessage(msg *Message) {
 	switch msg.Type {
 	case "$ping":
-		go func(data json.RawMessage) {
-			select {
-			case w.writeCh <- &Message{
-				Type: "$pong",
-				Data: data,
-			}:
-			case <-time.After(w.pingInterval + w.pongTimeout):
-			}
-		}(msg.Data)
+		w.enqueue(&pendingMessage{msg: &Message{
+			Type: "$pong",
+			Data: msg.Data,
+		}})
 	case "$auth":
+		if w.State() >= WSOpen && !w.authRequested.Load() {
+			w.handleUnrequestedAuth(msg)
+			return
+		}
 		select {
 		case w.authCh <- msg:
 		default:
 		}
+	case "$pong":
+		w.handlePong(msg)
+	case "$call":
+		w.handleCall(msg)
+	case "$result":
+		w.handleResult(msg)
+	case "$stream":
+		w.handleStream(msg)
+	case "$jsonrpc":
+		w.handleJSONRPC(msg)
+	case "$auth_ready", "$ready":
+		select {
+		case w.readyCh <- msg:
+		default:
+		}
+	case "$ack":
+		w.handleAck(msg)
+	case "$shutdown":
+		w.handleShutdown(msg)
+	case "$resume":
+		select {
+		case w.resumeCh <- msg:
+		default:
+		}
 	case "$error":
 		var errMsg string
-		if err := msg.ParseData(&errMsg); err != nil {
+		if err := w.ParseMessage(msg, &errMsg); err != nil {
 			w.cancel(&WSRemoteError{Message: "<Error when parsing remote error message: " + err.Error() + ">"})
 			return
 		}
@@ -248,103 +998,508 @@ func (w *WebSocket) handleInternalMessage(msg *Message) {
 	}
 }
 
+// ErrReadTimeout is the cause when the rest of a message is not received within the read timeout
+// It also matches os.ErrDeadlineExceeded
+var ErrReadTimeout = fmt.Errorf("Read timeout: %w", os.ErrDeadlineExceeded)
+
+// readFrame reads the rest of the message within the read timeout
+// The deadline is cleared afterwards, so the time waiting for the next message is not limited
+// The deadline set by CloseRead is kept, so the read goroutine is still stopped
+func (w *WebSocket) readFrame(r io.Reader) ([]byte, error) {
+	w.setReadDeadline(time.Now().Add(w.readTimeout))
+	data, err := io.ReadAll(r)
+	w.setReadDeadline(time.Time{})
+	// the timeout errors are converted by websocket.Conn, so they do not match os.ErrDeadlineExceeded
+	if e, ok := err.(net.Error); ok && e.Timeout() && !w.readHalted.Load() {
+		return nil, ErrReadTimeout
+	}
+	return data, err
+}
+
+// setReadDeadline sets the read deadline unless the read side is halted by CloseRead
+func (w *WebSocket) setReadDeadline(t time.Time) {
+	w.ws.SetReadDeadline(t)
+	// CloseRead may set its deadline before the one above
+	if w.readHalted.Load() {
+		w.ws.SetReadDeadline(time.Now())
+	}
+}
+
+// handleUnrequestedAuth handles an auth message received after the handshake which is not requested by reauthHelper
+func (w *WebSocket) handleUnrequestedAuth(msg *Message) {
+	switch w.duplicateAuth {
+	case DuplicateAuthReauth:
+		if w.unrequestedAuth != nil {
+			select {
+			case w.unrequestedAuth <- msg.Data:
+			default:
+			}
+			return
+		}
+	case DuplicateAuthClose:
+		w.logger.Debug("Closing for unrequested auth message")
+		go w.closeWithCause(websocket.CloseProtocolError, "unexpected auth message", ErrUnexpectedAuth)
+		return
+	}
+	w.logger.Debug("Ignored unrequested auth message")
+}
+
 func (w *WebSocket) readHelper() {
+	defer w.recoverPanic()
+	// the read channels are only closed by the read goroutine after the read side is closed
+	readChClosed := false
+	closeReadCh := func() {
+		if !readChClosed {
+			readChClosed = true
+			close(w.readCh)
+			close(w.binaryCh)
+		}
+	}
 	for {
 		typ, r, err := w.ws.NextReader()
+		w.controlFrames = 0
+		if err == nil && w.readTimeout > 0 {
+			raw, err := w.readFrame(r)
+			if err == ErrReadTimeout {
+				w.logger.Warn("Read timeout", "timeout", w.readTimeout)
+				w.cancel(ErrReadTimeout)
+				return
+			}
+			if err != nil {
+				// the read errors are returned by the next NextReader
+				continue
+			}
+			r = bytes.NewReader(raw)
+		}
+		if err == nil && typ == websocket.TextMessage && (w.appPing != nil || w.keepaliveMatcher != nil) {
+			raw, err := io.ReadAll(r)
+			if err != nil {
+				// the read errors are returned by the next NextReader
+				continue
+			}
+			if w.appPing != nil && w.handleAppPing(raw) {
+				continue
+			}
+			if w.keepaliveMatcher != nil && w.handleHeartbeat(raw) {
+				continue
+			}
+			r = bytes.NewReader(raw)
+		}
 		if err != nil {
-			w.cancel(&WSReadError{err})
+			if w.readHalted.Load() {
+				// stopped by CloseRead
+				closeReadCh()
+				return
+			}
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				if cause := w.closeCause.Load(); cause != nil {
+					w.cancel(*cause)
+				} else {
+					w.cancel(closeErr)
+				}
+			} else {
+				w.cancel(&WSReadError{err})
+			}
 			return
 		}
-		if typ == websocket.TextMessage {
-			d := json.NewDecoder(r)
+		if w.rawJSONRPC && typ == websocket.TextMessage {
+			w.readRawJSONRPC(r)
+			continue
+		}
+		if typ == w.codec.FrameType() {
+			var raw []byte
+			if w.onDecodeError != nil {
+				// the read errors are returned by the next NextReader
+				if raw, err = io.ReadAll(r); err != nil {
+					continue
+				}
+				r = bytes.NewReader(raw)
+			}
+			d := w.newFrameDecoder(r)
 			for {
 				msg := new(Message)
 				if err := d.Decode(msg); err != nil {
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if w.onDecodeError == nil {
+						w.logger.Warn("Failed to decode message", "err", err)
+						w.countDrop(dropDecodeError, 1)
+					} else if w.onDecodeError(raw, err) {
+						w.countDrop(dropDecodeError, 1)
+					} else {
+						w.logger.Debug("Closing for invalid message", "err", err)
+						go w.closeWithCause(websocket.CloseInvalidFramePayloadData, "invalid message", fmt.Errorf("%w: %w", ErrInvalidMessage, err))
+					}
 					break
 				}
+				if w.debug.Load() {
+					w.debugMessage("received", msg)
+				}
+				// the internal messages such as the handshake, calls and acks are never limited
 				if len(msg.Type) > 0 && msg.Type[0] == '$' {
 					w.handleInternalMessage(msg)
+					if w.readClosed.Load() {
+						closeReadCh()
+					}
+				} else if w.readClosed.Load() {
+					w.ackSkip(msg)
+					closeReadCh()
 				} else {
+					if !w.allowInbound() || !w.waitAuthDone() {
+						w.ackSkip(msg)
+						continue
+					}
+					w.activeAt.Store((int64)(w.since()))
+					w.countReceived(len(msg.Type) + len(msg.Data))
+					if w.onReceive != nil {
+						if err := w.onReceive(msg); err != nil {
+							w.logger.Debug("Message rejected by OnReceive", "type", msg.Type, "err", err)
+							w.countDrop(dropRejected, 1)
+							w.ackSkip(msg)
+							if msg.Seq > 0 {
+								w.recvSeq.Store(msg.Seq)
+							}
+							continue
+						}
+					}
+					w.ackBegin(msg)
+					if handler := w.route(msg); handler != nil {
+						if w.tracksAck(msg) {
+							handle := handler
+							handler = func() {
+								defer w.ackDone(msg)
+								handle()
+							}
+						}
+						if !w.dispatch(handler) {
+							w.ackDone(msg)
+						} else if msg.Seq > 0 {
+							w.recvSeq.Store(msg.Seq)
+						}
+						continue
+					}
 					select {
 					case w.readCh <- msg:
+						w.ackQueued(msg)
+					case <-w.readStop:
+						w.ackDone(msg)
+						closeReadCh()
+						continue
 					case <-w.ctx.Done():
 						return
 					}
+					if msg.Seq > 0 {
+						w.recvSeq.Store(msg.Seq)
+					}
 				}
 			}
+		} else if typ == websocket.BinaryMessage && w.binaryAuth.Load() {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				continue
+			}
+			select {
+			case w.authBinaryCh <- data:
+			default:
+			}
+		} else if w.onRawFrame != nil {
+			data, err := w.readRawFrame(r)
+			if err != nil {
+				continue
+			}
+			if w.debug.Load() {
+				w.debugBinary("received", data)
+			}
+			if !w.allowInbound() {
+				continue
+			}
+			if w.readClosed.Load() {
+				closeReadCh()
+				continue
+			}
+			if !w.waitAuthDone() {
+				continue
+			}
+			w.activeAt.Store((int64)(w.since()))
+			w.countReceived(len(data))
+			w.onRawFrame(typ, data)
+		} else if typ == websocket.BinaryMessage {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				continue
+			}
+			if w.debug.Load() {
+				w.debugBinary("received", data)
+			}
+			if !w.allowInbound() {
+				continue
+			}
+			if w.readClosed.Load() {
+				closeReadCh()
+				continue
+			}
+			if !w.waitAuthDone() {
+				continue
+			}
+			w.activeAt.Store((int64)(w.since()))
+			w.countReceived(len(data))
+			// an application which does not read the binary frames must not stall the read goroutine,
+			// or the pongs, the auth messages and the close frame are not processed either
+			select {
+			case w.binaryCh <- data:
+			default:
+				w.logger.Debug("Binary frame dropped, BinaryReader is full", "size", len(data))
+				w.countDrop(dropQueueFull, 1)
+			}
 		}
 	}
 }
 
-func (w *WebSocket) writeHelper() {
-	minTimeout, maxTimeout := w.minBatchTimeout, w.maxBatchTimeout
-	enableBatch := minTimeout > 0 && maxTimeout > 0
-MSG_LOOP:
+// handleClose is called by the read goroutine when a close frame is received
+// The close frame is echoed as the spec requires, unless echo is disabled
+func (w *WebSocket) handleClose(code int, text string) error {
+	if w.onPeerClose != nil {
+		w.onPeerClose(code, text)
+	}
+	if w.noCloseEcho {
+		return nil
+	}
+	message := []byte{}
+	if code != websocket.CloseNoStatusReceived {
+		message = websocket.FormatCloseMessage(code, "")
+	}
+	w.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(w.closeTimeout))
+	return nil
+}
+
+// ready marks the connection is ready to use
+func (w *WebSocket) ready() {
+	w.setState(WSOpen)
+	w.metrics.OnConnect()
+	context.AfterFunc(w.ctx, func() {
+		w.metrics.OnDisconnect(context.Cause(w.ctx))
+	})
+	if w.inboundLimiter != nil {
+		w.limiterActive.Store(true)
+	}
+	if w.idleTimeout > 0 {
+		w.activeAt.Store((int64)(w.since()))
+		go w.idleHelper()
+	}
+	if w.ackInterval > 0 {
+		go w.ackHelper()
+	}
+}
+
+// ErrIdleTimeout is the cause when no application message is received within the idle timeout
+var ErrIdleTimeout = errors.New("Idle timeout")
+
+func (w *WebSocket) idleHelper() {
+	timer := w.clock.NewTimer(w.idleTimeout)
+	defer timer.Stop()
 	for {
 		select {
-		case msg := <-w.writeCh:
-			wc, err := w.ws.NextWriter(websocket.TextMessage)
-			if err != nil {
-				w.cancel(&WSWriteError{err})
-				return
-			}
-			e := json.NewEncoder(wc)
-			e.SetEscapeHTML(false)
-			if err := e.Encode(msg); err != nil {
-				continue
-			}
-			if enableBatch {
-				minTimer := time.NewTimer(minTimeout)
-				maxTimer := time.NewTimer(maxTimeout)
-				for {
-					select {
-					case msg := <-w.writeCh:
-						if !minTimer.Stop() {
-							<-minTimer.C
-						}
-						minTimer.Reset(minTimeout)
-						if err := e.Encode(msg); err != nil {
-							continue MSG_LOOP
-						}
-						continue
-					case <-w.flushSignal:
-					case <-minTimer.C:
-					case <-maxTimer.C:
-					case <-w.ctx.Done():
-						return
-					}
-					break
-				}
-				maxTimer.Stop()
+		case <-timer.C():
+			idle := w.since() - (time.Duration)(w.activeAt.Load())
+			// the clock went backward, the connection is considered active just now
+			if idle < 0 {
+				idle = 0
 			}
-			if err := wc.Close(); err != nil {
-				w.cancel(&WSWriteError{err})
+			if idle >= w.idleTimeout {
+				w.closeWithCause(websocket.CloseGoingAway, "idle timeout", ErrIdleTimeout)
 				return
 			}
+			timer.Reset(w.idleTimeout - idle)
+		case <-w.readStop:
+			return
 		case <-w.ctx.Done():
 			return
 		}
 	}
 }
 
+// ErrPongTimeout is the cause when the opposite did not reply a pong within the pong timeout
+var ErrPongTimeout = errors.New("Pong timeout")
+
 func (w *WebSocket) pingHelper() {
-	pingTicker := time.NewTicker(w.pingInterval)
-	defer pingTicker.Stop()
+	pingTimer := w.clock.NewTimer(w.PingInterval())
+	defer pingTimer.Stop()
+	pongTimer := w.clock.NewTimer(0)
+	if !pongTimer.Stop() {
+		<-pongTimer.C()
+	}
+	defer pongTimer.Stop()
+	waitingPong := false
 	for {
 		select {
-		case <-pingTicker.C:
-			if err := w.WriteMessageContext(w.ctx, "$ping", time.Now().UnixMilli()); err != nil {
-				w.cancel(err)
+		case <-pingTimer.C():
+			pingTimer.Reset(w.PingInterval())
+			if err := w.writeInternal("$ping", w.pingPayload((int64)(w.since()))); err != nil {
+				// the write side may be closed just now, pings are stopped in that case
+				if !errors.Is(err, ErrWriteClosed) {
+					w.cancel(fmt.Errorf("%w: %w", ErrPingFailed, err))
+				}
 				return
 			}
 			w.Flush()
+			if !waitingPong {
+				waitingPong = true
+				pongTimer.Reset(w.PongTimeout())
+			}
+		case <-w.pongSignal:
+			if waitingPong {
+				waitingPong = false
+				if !pongTimer.Stop() {
+					<-pongTimer.C()
+				}
+			}
+		case <-pongTimer.C():
+			waitingPong = false
+			w.logger.Warn("Pong timeout", "timeout", w.PongTimeout())
+			if w.onPingTimeout != nil {
+				w.onPingTimeout()
+			}
+			w.cancel(ErrPongTimeout)
+			return
+		case <-w.keepaliveStop:
+			return
 		case <-w.ctx.Done():
 			return
 		}
 	}
 }
 
+// pingMessage is the ping payload when PingMessage is set
+type pingMessage struct {
+	Time int64  `json:"t"`
+	Data []byte `json:"d"`
+}
+
+// pingPayload returns the payload of the ping sent at now
+// The time is the monotonic time since the connection is created
+func (w *WebSocket) pingPayload(now int64) any {
+	if w.pingMessage == nil {
+		return now
+	}
+	return &pingMessage{
+		Time: now,
+		Data: w.pingMessage,
+	}
+}
+
+func (w *WebSocket) handlePong(msg *Message) {
+	var sentAt int64
+	if w.pingMessage == nil {
+		if err := w.ParseMessage(msg, &sentAt); err != nil {
+			return
+		}
+	} else {
+		var pong pingMessage
+		if err := w.ParseMessage(msg, &pong); err != nil {
+			return
+		}
+		if w.validatePong && !bytes.Equal(pong.Data, w.pingMessage) {
+			return
+		}
+		sentAt = pong.Time
+	}
+	// the round trip time is unknown if the clock went backward, but the pong is still valid
+	rtt := w.since() - (time.Duration)(sentAt)
+	if rtt >= 0 {
+		w.latency.Store((int64)(rtt))
+		if w.onPong != nil {
+			w.onPong(rtt)
+		}
+	}
+	w.keepalive()
+	w.pingMux.Lock()
+	waiter := w.pingWaiters[sentAt]
+	w.pingMux.Unlock()
+	if waiter != nil {
+		select {
+		case waiter <- max(rtt, 0):
+		default:
+		}
+	}
+}
+
+// Ping sends a ping and waits for the matching pong, then returns the round-trip time
+// It works along with the automatic pings, and the pong also resets the pong timeout
+// If the pong is not received within the pong timeout, ErrPongTimeout is returned,
+// the connection is only closed by the automatic pings
+func (w *WebSocket) Ping(ctx context.Context) (time.Duration, error) {
+	waiter := make(chan time.Duration, 1)
+	sentAt := (int64)(w.since())
+	w.pingMux.Lock()
+	if w.pingWaiters == nil {
+		w.pingWaiters = make(map[int64]chan time.Duration)
+	}
+	// the time is the key, so the concurrent pings must not have the same time
+	for w.pingWaiters[sentAt] != nil {
+		sentAt++
+	}
+	w.pingWaiters[sentAt] = waiter
+	w.pingMux.Unlock()
+	defer func() {
+		w.pingMux.Lock()
+		delete(w.pingWaiters, sentAt)
+		w.pingMux.Unlock()
+	}()
+	if err := w.writeInternal("$ping", w.pingPayload(sentAt)); err != nil {
+		return 0, err
+	}
+	w.Flush()
+	var timeoutC <-chan time.Time
+	if timeout := w.PongTimeout(); timeout > 0 {
+		timer := w.clock.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C()
+	}
+	select {
+	case rtt := <-waiter:
+		return rtt, nil
+	case <-timeoutC:
+		return 0, ErrPongTimeout
+	case <-ctx.Done():
+		return 0, context.Cause(ctx)
+	case <-w.ctx.Done():
+		return 0, w.closedError()
+	}
+}
+
+// handleHeartbeat reports whether the raw text frame is matched by KeepaliveMatcher, and resets the pong timeout if so
+// The heartbeats count towards MaxControlFramesPerSec
+func (w *WebSocket) handleHeartbeat(raw []byte) bool {
+	if !w.keepaliveMatcher(raw) {
+		return false
+	}
+	// it's not an application message, so the idle timeout is not reset
+	if w.allowControl() {
+		w.keepalive()
+	}
+	return true
+}
+
+// keepalive resets the pong timeout
+func (w *WebSocket) keepalive() {
+	select {
+	case w.pongSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Latency returns the most recent round-trip time measured by ping and pong
+// It returns zero if no pong is received yet
+func (w *WebSocket) Latency() time.Duration {
+	return (time.Duration)(w.latency.Load())
+}
+
 type ReadyMessage struct {
 	PingInterval int64 `json:"pingInterval"`
 	PongTimeout  int64 `json:"pongTimeout"`
+	// Session is the session token if session resumption is enabled
+	Session string `json:"session,omitempty"`
+	// Resumed is true if the previous session is resumed
+	Resumed bool `json:"resumed,omitempty"`
 }
@@ -0,0 +1,281 @@
+// Authorized WebSocket
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package aws_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aws "github.com/LiterMC/go-aws"
+	"github.com/gorilla/websocket"
+)
+
+// serve starts a server which upgrades the requests with up, and returns its ws url and the upgraded connections
+func serve(t testing.TB, up *aws.Upgrader) (string, <-chan *aws.WebSocket) {
+	ch := make(chan *aws.WebSocket, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w, err := up.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		ch <- w
+		<-w.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), ch
+}
+
+// pair returns a connected server and client
+func pair(t testing.TB, up *aws.Upgrader, d *aws.Dialer) (*aws.WebSocket, *aws.WebSocket) {
+	url, ch := serve(t, up)
+	if d.Dialer == nil {
+		d.Dialer = websocket.DefaultDialer
+	}
+	c, _, err := d.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	s := <-ch
+	t.Cleanup(func() { s.Close() })
+	return s, c
+}
+
+func TestSlowConsumerCause(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:              &websocket.Upgrader{},
+		MinBatchTimeout:       20 * time.Millisecond,
+		MaxBatchTimeout:       50 * time.Millisecond,
+		MaxPendingMessages:    3,
+		CloseHandshakeTimeout: 500 * time.Millisecond,
+	}
+	url, ch := serve(t, up)
+	// a raw client never reads, so the close frame is not echoed until the close handshake timeout
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-ch
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Send("n", i)
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-s.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	if cause := context.Cause(s.Context()); !errors.Is(cause, aws.ErrSlowConsumer) {
+		t.Fatal(cause)
+	}
+}
+
+func TestSlowConsumerPingAtLimit(t *testing.T) {
+	up := &aws.Upgrader{
+		Upgrader:           &websocket.Upgrader{},
+		MinBatchTimeout:    time.Hour,
+		MaxBatchTimeout:    time.Hour,
+		MaxPendingMessages: 2,
+		PingInterval:       50 * time.Millisecond,
+		PongTimeout:        time.Hour,
+	}
+	url, ch := serve(t, up)
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-ch
+	errs := make(chan error, 2)
+	for i := range 2 {
+		go func() {
+			errs <- s.Send("n", i)
+		}()
+	}
+	for s.PendingCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// the ping is queued while the queue is at the limit, then it flushes the queue
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("messages are not flushed by the ping")
+		}
+	}
+	if cause := context.Cause(s.Context()); cause != nil {
+		t.Fatal("closed by the ping", cause)
+	}
+	if n := s.DroppedByReason()[aws.DropSlowConsumer]; n != 0 {
+		t.Fatal("dropped", n)
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range 1000 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				s.Close()
+			case 1:
+				s.CloseWithCode(4000, "concurrent")
+			case 2:
+				s.Abort()
+			case 3:
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatal("close took", d)
+	}
+	<-s.Done()
+	<-c.Done()
+	if err := s.Send("m", 1); !errors.Is(err, aws.ErrClosed) {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseBothSides(t *testing.T) {
+	for range 20 {
+		s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+		start := time.Now()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+		wg.Wait()
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatal("close took", d)
+		}
+	}
+}
+
+func TestCloseErrorLongReason(t *testing.T) {
+	s, c := pair(t, &aws.Upgrader{Upgrader: &websocket.Upgrader{}}, &aws.Dialer{})
+	cause := errors.New(strings.Repeat("\u00e9", 100))
+	s.CloseError(cause)
+	if err := context.Cause(s.Context()); err != cause {
+		t.Fatal("unexpected server cause", err)
+	}
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client is not closed")
+	}
+	var closeErr *websocket.CloseError
+	if err := context.Cause(c.Context()); !errors.As(err, &closeErr) {
+		t.Fatal("unexpected client cause", err)
+	}
+	if closeErr.Code != websocket.CloseInternalServerErr || closeErr.Text != strings.Repeat("\u00e9", 61) {
+		t.Fatalf("unexpected close frame %d %q", closeErr.Code, closeErr.Text)
+	}
+}
+
+// failConn fails the writes after fail is set
+type failConn struct {
+	net.Conn
+	fail *atomic.Bool
+}
+
+func (c failConn) Write(p []byte) (int, error) {
+	if c.fail.Load() {
+		return 0, errors.New("injected write error")
+	}
+	return c.Conn.Write(p)
+}
+
+type failListener struct {
+	net.Listener
+	fail *atomic.Bool
+}
+
+func (l failListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return failConn{c, l.fail}, nil
+}
+
+func TestPingWriteFailed(t *testing.T) {
+	var fail atomic.Bool
+	up := &aws.Upgrader{Upgrader: &websocket.Upgrader{}, PingInterval: 50 * time.Millisecond}
+	ch := make(chan *aws.WebSocket, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w, err := up.Upgrade(rw, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- w
+		<-w.Context().Done()
+	}))
+	srv.Listener = failListener{srv.Listener, &fail}
+	srv.Start()
+	defer srv.Close()
+	// a raw client does not send pings, so the server only writes its own pings
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := <-ch
+	fail.Store(true)
+	select {
+	case <-s.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	cause := context.Cause(s.Context())
+	if !errors.Is(cause, aws.ErrPingFailed) {
+		t.Fatal(cause)
+	}
+	var writeErr *aws.WSWriteError
+	if !errors.As(cause, &writeErr) {
+		t.Fatal(cause)
+	}
+}